@@ -9,6 +9,15 @@ var _boltDB *bbolt.DB
 
 var CFG_BUCKET = []byte("cfg")
 
+// CFG 标签的历史版本，每个标签一个子 bucket
+var CFG_HISTORY_BUCKET = []byte("cfg_history")
+
+// 启用保持的 MEM 标签的值
+var MEM_BUCKET = []byte("mem")
+
+// IO 标签的最后值，见 collect.Service.SaveCache
+var IO_BUCKET = []byte("io")
+
 func Connect(file string) {
 	bboltDB, err := bbolt.Open(file, 0600, nil)
 	if err != nil {
@@ -20,6 +29,21 @@ func Connect(file string) {
 		if err != nil {
 			return err
 		}
+
+		_, err = tx.CreateBucketIfNotExists(CFG_HISTORY_BUCKET)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists(MEM_BUCKET)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists(IO_BUCKET)
+		if err != nil {
+			return err
+		}
 		return nil
 	})
 
@@ -36,4 +60,5 @@ func GetBoltDB() *bbolt.DB {
 
 func Close() {
 	_boltDB.Close()
+	_boltDB = nil
 }
@@ -0,0 +1,166 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/danclive/july/collect"
+	"github.com/danclive/july/device"
+	"github.com/danclive/march/consts"
+	"github.com/danclive/nson-go"
+)
+
+// 批量读写时每个名称的错误，键为名称
+type NameErrors map[string]error
+
+func (e NameErrors) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		return "no names failed"
+	}
+
+	return fmt.Sprintf("%v names failed, %v: %v", len(names), names[0], e[names[0]])
+}
+
+// 没有失败的名称时返回 nil
+func (e NameErrors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+
+	return e
+}
+
+// 从 device 的索引查询名称对应的标签，名称格式与 GetTagByName 相同，为 slot.tag 或 tag。
+// 不存在的名称在 NameErrors 中返回 ErrNotFound
+func (s *Service) resolve(names []string) (map[string]*device.Tag, NameErrors) {
+	tags := make(map[string]*device.Tag, len(names))
+	errs := make(NameErrors)
+
+	for _, name := range names {
+		if tag, ok := lookupTag(name); ok {
+			tags[name] = tag
+		} else {
+			errs[name] = ErrNotFound
+		}
+	}
+
+	return tags, errs
+}
+
+// 批量读取标签值，返回名称对应的标签，失败的名称在 NameErrors 中返回
+func (s *Service) GetValues(names []string) (map[string]*device.Tag, NameErrors) {
+	tags, errs := s.resolve(names)
+
+	for name, tag := range tags {
+		if err := s.GetValue(tag); err != nil {
+			errs[name] = err
+			delete(tags, name)
+		}
+	}
+
+	return tags, errs
+}
+
+func (s *Service) SetValues(values map[string]nson.Value) NameErrors {
+	return s.SetValuesContext(context.Background(), values)
+}
+
+// 批量写入标签值，IO 标签按 slot 分组，每个 slot 写入一次，各 slot 并行写入。
+// 失败的名称在 NameErrors 中返回，其他名称的写入不受影响
+func (s *Service) SetValuesContext(ctx context.Context, values map[string]nson.Value) NameErrors {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+
+	tags, errs := s.resolve(names)
+
+	type group struct {
+		names []string
+		tags  []device.Tag
+	}
+
+	groups := make(map[string]*group)
+
+	for name, tag := range tags {
+		value := values[name]
+
+		if value == nil {
+			errs[name] = errors.New("value is nil")
+			continue
+		}
+
+		if tag.DefaultValue().Tag() != value.Tag() {
+			errs[name] = fmt.Errorf("data type not match, expect: %v, provide: %v", tag.DefaultValue().Tag(), value.Tag())
+			continue
+		}
+
+		if tag.Type != device.TypeIO {
+			if err := s.SetValueContext(ctx, tag, value); err != nil {
+				errs[name] = err
+			}
+			continue
+		}
+
+		// 提前检查，避免一个标签导致整个 slot 写入失败
+		if tag.Access != consts.ON {
+			errs[name] = errors.New("tag.Access != RW(consts.ON)")
+			continue
+		}
+
+		g, ok := groups[tag.SlotID]
+		if !ok {
+			g = &group{}
+			groups[tag.SlotID] = g
+		}
+
+		tag.Value = value
+		g.names = append(g.names, name)
+		g.tags = append(g.tags, *tag)
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, g := range groups {
+		wg.Add(1)
+
+		go func(g *group) {
+			defer wg.Done()
+
+			err := collect.GetService().WriteContext(ctx, g.tags)
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			// 驱动返回的 TagErrors 与标签数量不一致时，按整体失败处理
+			if tagErrs, ok := err.(collect.TagErrors); ok && len(tagErrs) == len(g.names) {
+				for i, err := range tagErrs {
+					if err != nil {
+						errs[g.names[i]] = err
+					}
+				}
+				return
+			}
+
+			if err != nil {
+				for _, name := range g.names {
+					errs[name] = err
+				}
+			}
+		}(g)
+	}
+
+	wg.Wait()
+
+	return errs
+}
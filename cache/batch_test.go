@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/danclive/july/bolt"
+	"github.com/danclive/july/collect"
+	"github.com/danclive/july/device"
+	"github.com/danclive/july/sqlite"
+	"github.com/danclive/march/consts"
+	"github.com/danclive/nson-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatch(t *testing.T) {
+	dir := t.TempDir()
+
+	sqlite.Connect(filepath.Join(dir, "july.db"), false)
+	defer sqlite.Close()
+	device.InitService(sqlite.GetEngine())
+
+	bolt.Connect(filepath.Join(dir, "july.bolt"))
+	defer bolt.Close()
+
+	collect.InitService(1, 60, 1)
+	InitService()
+	service := GetService()
+
+	slot := &device.Slot{Name: "plc", Driver: "FAKE", Status: consts.ON}
+	_, err := device.GetService().CreateSlot(slot)
+	assert.Nil(t, err)
+
+	tags := []*device.Tag{
+		{SlotID: slot.ID, Name: "mem", Type: device.TypeMEM, DataType: device.TypeI32},
+		{SlotID: slot.ID, Name: "cfg", Type: device.TypeCFG, DataType: device.TypeF32},
+		{SlotID: slot.ID, Name: "io", Type: device.TypeIO, DataType: device.TypeI32, Access: consts.ON, Status: consts.ON},
+		{SlotID: slot.ID, Name: "ro", Type: device.TypeIO, DataType: device.TypeI32},
+		{SlotID: "other", Name: "global", Type: device.TypeMEM, DataType: device.TypeI32},
+	}
+
+	for _, tag := range tags {
+		_, err := device.GetService().CreateTag(tag)
+		assert.Nil(t, err)
+	}
+
+	errs := service.SetValues(map[string]nson.Value{
+		"plc.mem": nson.I32(1),
+		"plc.cfg": nson.F32(1.5),
+		"global":  nson.I32(2),
+		"plc.io":  nson.I32(3),
+		"plc.ro":  nson.I32(4),
+		"plc.bad": nson.I32(5),
+		"a.b.c":   nson.I32(6),
+		"plc.x":   nil,
+	})
+
+	assert.NotNil(t, errs.Err())
+	assert.Exactly(t, 5, len(errs))
+	assert.Exactly(t, collect.ErrSlotOffline, errs["plc.io"])
+	assert.NotNil(t, errs["plc.ro"])
+	assert.Exactly(t, ErrNotFound, errs["plc.bad"])
+	assert.Exactly(t, ErrNotFound, errs["a.b.c"])
+	assert.Exactly(t, ErrNotFound, errs["plc.x"])
+
+	// 数据类型不一致
+	errs = service.SetValues(map[string]nson.Value{"plc.mem": nson.F32(1)})
+	assert.NotNil(t, errs["plc.mem"])
+
+	values, errs := service.GetValues([]string{"plc.mem", "plc.cfg", "global", "mem", "plc.io", "none"})
+	assert.Exactly(t, 1, len(errs))
+	assert.Exactly(t, ErrNotFound, errs["none"])
+	assert.Exactly(t, nson.I32(1), values["plc.mem"].Value)
+	assert.Exactly(t, nson.F32(1.5), values["plc.cfg"].Value)
+	assert.Exactly(t, nson.I32(2), values["global"].Value)
+	assert.Exactly(t, nson.I32(1), values["mem"].Value)
+	assert.Exactly(t, nson.I32(0), values["plc.io"].Value)
+
+	_, errs = service.GetValues([]string{"plc.mem"})
+	assert.Nil(t, errs.Err())
+}
+
+// 返回的 TagErrors 比写入的标签多一项
+type longErrorsDriver struct{}
+
+func (d *longErrorsDriver) Connect(slot device.Slot) (collect.Driver, error) { return d, nil }
+func (d *longErrorsDriver) Close() error                                     { return nil }
+func (d *longErrorsDriver) Name() string                                     { return "LONG" }
+func (d *longErrorsDriver) Read(tags []device.Tag) error                     { return nil }
+
+func (d *longErrorsDriver) Write(tags []device.Tag) error {
+	errs := make(collect.TagErrors, len(tags)+1)
+	errs[len(tags)] = errors.New("extra")
+	return errs
+}
+
+func TestBatchTagErrorsLength(t *testing.T) {
+	dir := t.TempDir()
+
+	sqlite.Connect(filepath.Join(dir, "july.db"), false)
+	defer sqlite.Close()
+	device.InitService(sqlite.GetEngine())
+
+	bolt.Connect(filepath.Join(dir, "july.bolt"))
+	defer bolt.Close()
+
+	collect.RegisterDriver("LONG", &longErrorsDriver{})
+
+	collect.InitService(1, 60, 1)
+	InitService()
+	service := GetService()
+
+	slot := &device.Slot{Name: "plc", Driver: "LONG", Status: consts.ON}
+	_, err := device.GetService().CreateSlot(slot)
+	assert.Nil(t, err)
+
+	tag := &device.Tag{SlotID: slot.ID, Name: "io", Type: device.TypeIO, DataType: device.TypeI32, Access: consts.ON, Status: consts.ON}
+	_, err = device.GetService().CreateTag(tag)
+	assert.Nil(t, err)
+
+	assert.Nil(t, collect.GetService().Start(context.Background()))
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		collect.GetService().Stop(ctx)
+	}()
+
+	assert.Eventually(t, func() bool {
+		state, ok := collect.GetService().SlotState(slot.ID)
+		return ok && state.State == collect.StateConnected
+	}, time.Second*5, time.Millisecond*20)
+
+	// 不会越界，按整体失败处理
+	errs := service.SetValues(map[string]nson.Value{"plc.io": nson.I32(1)})
+	assert.Exactly(t, 1, len(errs))
+	assert.IsType(t, collect.TagErrors{}, errs["plc.io"])
+}
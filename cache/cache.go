@@ -2,24 +2,34 @@ package cache
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/danclive/july/bolt"
 	"github.com/danclive/july/collect"
 	"github.com/danclive/july/device"
 	"github.com/danclive/july/log"
+	"github.com/danclive/march/consts"
 	"github.com/danclive/nson-go"
 	"go.etcd.io/bbolt"
 )
 
 var _service *Service
 
+var ErrNotFound = errors.New("not found")
+
 func InitService() {
 	_service = &Service{
-		cache: make(map[string]nson.Value),
+		cache:      make(map[string]collect.Record),
+		cfgHistory: DefaultCfgHistory,
+	}
+
+	if err := _service.loadRetained(); err != nil {
+		log.Suger.Error("load retained: ", err)
 	}
 }
 
@@ -28,91 +38,164 @@ func GetService() *Service {
 }
 
 type Service struct {
-	cache map[string]nson.Value
-	lock  sync.RWMutex
+	cache      map[string]collect.Record
+	lock       sync.RWMutex
+	cfgHistory int // 每个 CFG 标签保存的历史版本数量
 }
 
+// 清空 MEM 标签的值，启用保持的标签重新从 bolt 加载
 func (s *Service) Clear() {
 	s.lock.Lock()
-	defer s.lock.Unlock()
-
 	s.cache = nil
-	s.cache = make(map[string]nson.Value)
-}
+	s.cache = make(map[string]collect.Record)
+	s.lock.Unlock()
 
-func (s *Service) GetTagById(id string) (*device.Tag, error) {
-	tag, err := device.GetService().GetTag(id)
-	if err != nil {
-		return nil, err
+	if err := s.loadRetained(); err != nil {
+		log.Suger.Error("load retained: ", err)
 	}
+}
 
-	if tag == nil {
-		return nil, errors.New("not found")
+// 从 bolt 加载启用保持的 MEM 标签的值，删除不再保持的标签的值。
+// 加载的值不记录时间戳，与 CFG 标签相同
+func (s *Service) loadRetained() error {
+	db := bolt.GetBoltDB()
+	if db == nil || device.GetService() == nil {
+		return nil
 	}
 
-	err = s.GetValue(tag)
+	tags, err := device.GetService().ListTagRetain()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return tag, nil
-}
+	retained := make(map[string]*device.Tag, len(tags))
+	for i := 0; i < len(tags); i++ {
+		retained[tags[i].ID] = &tags[i]
+	}
 
-func (s *Service) GetTagByName(name string) (*device.Tag, error) {
-	if strings.Contains(name, ".") {
-		split := strings.Split(name, ".")
-		if len(split) != 2 {
-			return nil, errors.New("not found")
-		}
+	values := make(map[string]nson.Value)
 
-		slot, err := device.GetService().GetSlotByName(split[0])
-		if err != nil {
-			return nil, err
-		}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(bolt.MEM_BUCKET)
 
-		if slot == nil {
-			return nil, errors.New("not found")
-		}
+		stale := make([][]byte, 0)
+
+		err := bucket.ForEach(func(k, v []byte) error {
+			tag, ok := retained[string(k)]
+			if !ok {
+				stale = append(stale, append([]byte{}, k...))
+				return nil
+			}
+
+			value, err := decodeValue(v, tag)
+			if err != nil {
+				log.Suger.Warnf("tag: %v(%v) load retained: %v", tag.Name, tag.ID, err)
+				return nil
+			}
 
-		tag, err := device.GetService().GetTagBySlotIDAndName(slot.ID, split[1])
+			values[tag.ID] = value
+			return nil
+		})
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		if tag == nil {
-			return nil, errors.New("not found")
+		for _, k := range stale {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
 		}
 
-		err = s.GetValue(tag)
-		if err != nil {
-			return nil, err
-		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
-		return tag, nil
+	for id, value := range values {
+		s.cache[id] = collect.Record{Value: value}
 	}
 
-	tag, err := device.GetService().GetTagByName(name)
+	return nil
+}
+
+func (s *Service) GetTagById(id string) (*device.Tag, error) {
+	tag, ok := device.GetService().LookupTag(id)
+	if !ok {
+		return nil, ErrNotFound
+	}
 
+	err := s.GetValue(tag)
 	if err != nil {
 		return nil, err
 	}
 
-	if tag == nil {
-		return nil, errors.New("not found")
+	return tag, nil
+}
+
+// 从 device 的索引查询标签，name 为 slot.tag 或 tag
+func lookupTag(name string) (*device.Tag, bool) {
+	if !strings.Contains(name, ".") {
+		return device.GetService().LookupTagByName(name)
+	}
+
+	split := strings.Split(name, ".")
+	if len(split) != 2 {
+		return nil, false
 	}
 
-	err = s.GetValue(tag)
+	slot, ok := device.GetService().LookupSlotByName(split[0])
+	if !ok {
+		return nil, false
+	}
+
+	return device.GetService().LookupTagBySlotIDAndName(slot.ID, split[1])
+}
+
+func (s *Service) GetTagByName(name string) (*device.Tag, error) {
+	tag, ok := lookupTag(name)
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	err := s.GetValue(tag)
 	if err != nil {
-		log.Suger.Error(err)
+		return nil, err
 	}
 
 	return tag, nil
 }
 
 func (s *Service) GetValue(tag *device.Tag) error {
+	record, err := s.GetRecord(tag)
+	if err != nil {
+		return err
+	}
+
+	tag.Value = record.Value
+	if tag.Value == nil {
+		tag.Value = tag.DefaultValue()
+	}
+
+	return nil
+}
+
+// 获取标签值的完整记录，包括质量和时间戳
+// IO 标签没有缓存时质量为尚未读取，重启后恢复的值质量为 collect.QualityUncertainRestored；
+// CFG 标签不记录时间戳。
+func (s *Service) GetRecord(tag *device.Tag) (collect.Record, error) {
+	var record collect.Record
+
 	switch tag.Type {
 	case device.TypeIO:
-		tag.Value = collect.CacheGet(tag.ID)
+		var ok bool
+		record, ok = collect.CacheGetRecord(tag.ID)
+		if !ok {
+			record.Quality = collect.QualityBadNotYetRead
+		}
 	case device.TypeCFG:
 		err := bolt.GetBoltDB().View(func(tx *bbolt.Tx) error {
 			bucket := tx.Bucket(bolt.CFG_BUCKET)
@@ -121,23 +204,12 @@ func (s *Service) GetValue(tag *device.Tag) error {
 				return fmt.Errorf("tag: %v(%v) not exit", tag.Name, tag.ID)
 			}
 
-			buffer := bytes.NewBuffer(v)
-
-			data_tag, err := buffer.ReadByte()
-			if err != nil {
-				return err
-			}
-
-			value, err := decode_value(buffer, data_tag)
+			value, err := decodeValue(v, tag)
 			if err != nil {
 				return err
 			}
 
-			if tag.DefaultValue().Tag() != value.Tag() {
-				return fmt.Errorf("data type not match, expect: %v, provide: %v", tag.DefaultValue().Tag(), value.Tag())
-			}
-
-			tag.Value = value
+			record.Value = value
 			return nil
 		})
 
@@ -147,70 +219,37 @@ func (s *Service) GetValue(tag *device.Tag) error {
 	default:
 		s.lock.RLock()
 		defer s.lock.RUnlock()
-		tag.Value = s.cache[tag.ID]
+		record = s.cache[tag.ID]
 	}
 
-	if tag.Value == nil {
-		tag.Value = tag.DefaultValue()
-	}
-
-	return nil
+	return record, nil
 }
 
 func (s *Service) SetValueById(id string, value nson.Value) error {
-	tag, err := device.GetService().GetTag(id)
-	if err != nil {
-		return err
-	}
-
-	if tag == nil {
-		return errors.New("not found")
+	tag, ok := device.GetService().LookupTag(id)
+	if !ok {
+		return ErrNotFound
 	}
 
 	return s.SetValue(tag, value)
 }
 
 func (s *Service) SetValueByName(name string, value nson.Value) error {
-	if strings.Contains(name, ".") {
-		split := strings.Split(name, ".")
-		if len(split) != 2 {
-			return errors.New("not found")
-		}
-
-		slot, err := device.GetService().GetSlotByName(split[0])
-		if err != nil {
-			return err
-		}
-
-		if slot == nil {
-			return errors.New("not found")
-		}
-
-		tag, err := device.GetService().GetTagBySlotIDAndName(slot.ID, split[1])
-		if err != nil {
-			return err
-		}
-
-		if tag == nil {
-			return errors.New("not found")
-		}
-
-		return s.SetValue(tag, value)
-	}
-
-	tag, err := device.GetService().GetTagByName(name)
-	if err != nil {
-		return err
-	}
-
-	if tag == nil {
-		return errors.New("not found")
+	tag, ok := lookupTag(name)
+	if !ok {
+		return ErrNotFound
 	}
 
 	return s.SetValue(tag, value)
 }
 
 func (s *Service) SetValue(tag *device.Tag, value nson.Value) error {
+	return s.SetValueContext(context.Background(), tag, value)
+}
+
+// IO 标签等待设备确认写入结果，ctx 用于控制超时，见 collect.Service.WriteContext
+// CFG 标签记录历史版本，来源见 WithOrigin
+func (s *Service) SetValueContext(ctx context.Context, tag *device.Tag, value nson.Value) error {
 	if tag == nil {
 		return errors.New("tag in nil")
 	}
@@ -222,39 +261,92 @@ func (s *Service) SetValue(tag *device.Tag, value nson.Value) error {
 	switch tag.Type {
 	case device.TypeIO:
 		tag.Value = value
-		return collect.GetService().Write([]device.Tag{*tag})
+		return collect.GetService().WriteContext(ctx, []device.Tag{*tag})
 	case device.TypeCFG:
-		err := bolt.GetBoltDB().Update(func(tx *bbolt.Tx) error {
-			b := tx.Bucket(bolt.CFG_BUCKET)
-
-			buffer := new(bytes.Buffer)
-
-			err := buffer.WriteByte(value.Tag())
-			if err != nil {
-				return err
-			}
+		err := putCfg(tag, value, Origin(ctx), s.cfgHistory)
+		if err != nil {
+			log.Suger.Error("bolt.BoltDB.Update:", err)
+			return err
+		}
 
-			err = value.Encode(buffer)
+		collect.Publish(tag, collect.Record{Value: value})
+	default:
+		// 启用保持时先写入 bolt
+		if tag.Retain == consts.ON {
+			err := putValue(bolt.MEM_BUCKET, tag, value)
 			if err != nil {
+				log.Suger.Error("bolt.BoltDB.Update:", err)
 				return err
 			}
+		}
 
-			return b.Put([]byte(tag.ID), buffer.Bytes())
-		})
+		record := collect.Record{Value: value, SourceTime: time.Now()}
+		record.RecvTime = record.SourceTime
 
-		if err != nil {
-			log.Suger.Error("bolt.BoltDB.Update:", err)
-			return err
-		}
-	default:
 		s.lock.Lock()
-		defer s.lock.Unlock()
-		s.cache[tag.ID] = value
+		s.cache[tag.ID] = record
+		s.lock.Unlock()
+
+		collect.Publish(tag, record)
 	}
 
 	return nil
 }
 
+// 订阅标签值变化，包括 IO 标签的读取和 MEM、CFG 标签的写入
+func (s *Service) Subscribe(opts collect.SubscribeOptions) *collect.Subscription {
+	return collect.Subscribe(opts)
+}
+
+func putValue(bucket []byte, tag *device.Tag, value nson.Value) error {
+	data, err := encodeValue(value)
+	if err != nil {
+		return err
+	}
+
+	return bolt.GetBoltDB().Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(tag.ID), data)
+	})
+}
+
+// 值的编码，数据类型标记 + nson 编码
+func encodeValue(value nson.Value) ([]byte, error) {
+	buffer := new(bytes.Buffer)
+
+	err := buffer.WriteByte(value.Tag())
+	if err != nil {
+		return nil, err
+	}
+
+	err = value.Encode(buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// 解码 encodeValue 编码的值，并检查是否与标签的数据类型一致
+func decodeValue(data []byte, tag *device.Tag) (nson.Value, error) {
+	buffer := bytes.NewBuffer(data)
+
+	data_tag, err := buffer.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := decode_value(buffer, data_tag)
+	if err != nil {
+		return nil, err
+	}
+
+	if tag.DefaultValue().Tag() != value.Tag() {
+		return nil, fmt.Errorf("data type not match, expect: %v, provide: %v", tag.DefaultValue().Tag(), value.Tag())
+	}
+
+	return value, nil
+}
+
 func decode_value(buf *bytes.Buffer, tag uint8) (nson.Value, error) {
 	switch tag {
 	case nson.TAG_F32:
@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/danclive/july/bolt"
+	"github.com/danclive/july/device"
+	"github.com/danclive/july/sqlite"
+	"github.com/danclive/march/consts"
+	"github.com/danclive/nson-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetainedMem(t *testing.T) {
+	dir := t.TempDir()
+
+	sqlite.Connect(filepath.Join(dir, "july.db"), false)
+	defer sqlite.Close()
+	device.InitService(sqlite.GetEngine())
+
+	bolt.Connect(filepath.Join(dir, "july.bolt"))
+	defer bolt.Close()
+
+	InitService()
+
+	retained := &device.Tag{SlotID: "mem", Name: "counter", Type: device.TypeMEM, DataType: device.TypeI32, Retain: consts.ON}
+	_, err := device.GetService().CreateTag(retained)
+	assert.Nil(t, err)
+
+	plain := &device.Tag{SlotID: "mem", Name: "plain", Type: device.TypeMEM, DataType: device.TypeI32}
+	_, err = device.GetService().CreateTag(plain)
+	assert.Nil(t, err)
+
+	assert.Nil(t, GetService().SetValue(retained, nson.I32(10)))
+	assert.Nil(t, GetService().SetValue(plain, nson.I32(20)))
+	assert.NotNil(t, GetService().SetValue(retained, nson.String("a")))
+
+	// 清空后启用保持的标签重新加载
+	GetService().Clear()
+
+	tag, err := GetService().GetTagById(retained.ID)
+	assert.Nil(t, err)
+	assert.Exactly(t, nson.I32(10), tag.Value)
+
+	tag, err = GetService().GetTagById(plain.ID)
+	assert.Nil(t, err)
+	assert.Exactly(t, nson.I32(0), tag.Value)
+
+	// 重启
+	InitService()
+
+	tag, err = GetService().GetTagById(retained.ID)
+	assert.Nil(t, err)
+	assert.Exactly(t, nson.I32(10), tag.Value)
+
+	// 数据类型变化后不加载
+	tag.DataType = device.TypeF32
+	_, err = device.GetService().UpdateTag(tag)
+	assert.Nil(t, err)
+
+	InitService()
+
+	tag, err = GetService().GetTagById(retained.ID)
+	assert.Nil(t, err)
+	assert.Exactly(t, nson.F32(0), tag.Value)
+}
@@ -0,0 +1,357 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/danclive/july/bolt"
+	"github.com/danclive/july/device"
+	"github.com/danclive/nson-go"
+	"go.etcd.io/bbolt"
+)
+
+// 每个 CFG 标签保存的历史版本数量
+const DefaultCfgHistory = 100
+
+// 回滚时写入的来源
+const OriginRollback = "rollback"
+
+type originKey struct{}
+
+// 设置写入的来源，例如用户名或服务名称，CFG 标签的历史版本中记录此来源
+func WithOrigin(ctx context.Context, origin string) context.Context {
+	return context.WithValue(ctx, originKey{}, origin)
+}
+
+// 写入的来源，没有设置时为空
+func Origin(ctx context.Context) string {
+	origin, _ := ctx.Value(originKey{}).(string)
+	return origin
+}
+
+// CFG 标签的一个历史版本
+type CfgVersion struct {
+	Version uint64     `json:"version"` // 单调递增
+	Value   nson.Value `json:"value"`
+	Time    time.Time  `json:"time"`
+	Origin  string     `json:"origin"`
+}
+
+// CFG 标签两个版本的差异，没有版本时对应的值为 nil
+type CfgDiff struct {
+	TagID string     `json:"tag_id"`
+	Name  string     `json:"name"`
+	From  nson.Value `json:"from"`
+	To    nson.Value `json:"to"`
+}
+
+func encodeVersion(version CfgVersion) ([]byte, error) {
+	msg := nson.Message{
+		"value": version.Value,
+		"time":  nson.I64(version.Time.UnixNano()),
+	}
+
+	// nson 不能解码空字符串
+	if version.Origin != "" {
+		msg.Insert("origin", nson.String(version.Origin))
+	}
+
+	buffer := new(bytes.Buffer)
+	if err := msg.Encode(buffer); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func decodeVersion(k, v []byte) (CfgVersion, error) {
+	version := CfgVersion{Version: binary.BigEndian.Uint64(k)}
+
+	value, err := nson.Message{}.Decode(bytes.NewBuffer(v))
+	if err != nil {
+		return version, err
+	}
+
+	msg := value.(nson.Message)
+
+	var ok bool
+	if version.Value, ok = msg.Get("value"); !ok {
+		return version, errors.New("value not present")
+	}
+
+	t, err := msg.GetI64("time")
+	if err != nil {
+		return version, err
+	}
+	version.Time = time.Unix(0, t)
+
+	if msg.Contains("origin") {
+		if version.Origin, err = msg.GetString("origin"); err != nil {
+			return version, err
+		}
+	}
+
+	return version, nil
+}
+
+// 写入 CFG 标签的值，并在同一个事务中记录历史版本，超过 limit 时删除最早的版本
+func putCfg(tag *device.Tag, value nson.Value, origin string, limit int) error {
+	data, err := encodeValue(value)
+	if err != nil {
+		return err
+	}
+
+	version, err := encodeVersion(CfgVersion{Value: value, Time: time.Now(), Origin: origin})
+	if err != nil {
+		return err
+	}
+
+	return bolt.GetBoltDB().Update(func(tx *bbolt.Tx) error {
+		if err := tx.Bucket(bolt.CFG_BUCKET).Put([]byte(tag.ID), data); err != nil {
+			return err
+		}
+
+		history, err := tx.Bucket(bolt.CFG_HISTORY_BUCKET).CreateBucketIfNotExists([]byte(tag.ID))
+		if err != nil {
+			return err
+		}
+
+		seq, err := history.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+
+		if err := history.Put(key, version); err != nil {
+			return err
+		}
+
+		if limit <= 0 {
+			return nil
+		}
+
+		keys := make([][]byte, 0)
+		c := history.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+
+		for i := 0; i < len(keys)-limit; i++ {
+			if err := history.Delete(keys[i]); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// CFG 标签的历史版本，从新到旧，limit 小于等于 0 时返回全部
+func (s *Service) ListCfgVersions(tag *device.Tag, limit int) ([]CfgVersion, error) {
+	if tag.Type != device.TypeCFG {
+		return nil, fmt.Errorf("tag: %v(%v) is not CFG", tag.Name, tag.ID)
+	}
+
+	list := make([]CfgVersion, 0)
+
+	err := bolt.GetBoltDB().View(func(tx *bbolt.Tx) error {
+		history := tx.Bucket(bolt.CFG_HISTORY_BUCKET).Bucket([]byte(tag.ID))
+		if history == nil {
+			return nil
+		}
+
+		c := history.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			if limit > 0 && len(list) >= limit {
+				break
+			}
+
+			version, err := decodeVersion(k, v)
+			if err != nil {
+				return err
+			}
+
+			list = append(list, version)
+		}
+
+		return nil
+	})
+
+	return list, err
+}
+
+// at 时刻生效的版本，没有时返回 false
+func (s *Service) cfgVersionAt(tag *device.Tag, at time.Time) (CfgVersion, bool, error) {
+	list, err := s.ListCfgVersions(tag, 0)
+	if err != nil {
+		return CfgVersion{}, false, err
+	}
+
+	for _, version := range list {
+		if !version.Time.After(at) {
+			return version, true, nil
+		}
+	}
+
+	return CfgVersion{}, false, nil
+}
+
+func (s *Service) cfgVersion(tag *device.Tag, version uint64) (CfgVersion, error) {
+	list, err := s.ListCfgVersions(tag, 0)
+	if err != nil {
+		return CfgVersion{}, err
+	}
+
+	for _, v := range list {
+		if v.Version == version {
+			return v, nil
+		}
+	}
+
+	return CfgVersion{}, fmt.Errorf("tag: %v(%v) version %v not found", tag.Name, tag.ID, version)
+}
+
+// CFG 标签两个版本的差异，值相同时返回 false
+func (s *Service) DiffCfgVersions(tag *device.Tag, from, to uint64) (CfgDiff, bool, error) {
+	diff := CfgDiff{TagID: tag.ID, Name: tag.Name}
+
+	a, err := s.cfgVersion(tag, from)
+	if err != nil {
+		return diff, false, err
+	}
+
+	b, err := s.cfgVersion(tag, to)
+	if err != nil {
+		return diff, false, err
+	}
+
+	diff.From = a.Value
+	diff.To = b.Value
+
+	return diff, !reflect.DeepEqual(a.Value, b.Value), nil
+}
+
+// slot 的 CFG 标签在 from 和 to 两个时刻的差异，只返回值不同的标签
+func (s *Service) DiffCfgSlot(slotID string, from, to time.Time) ([]CfgDiff, error) {
+	tags, err := device.GetService().ListTag(slotID)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]CfgDiff, 0)
+
+	for i := 0; i < len(tags); i++ {
+		if tags[i].Type != device.TypeCFG {
+			continue
+		}
+
+		diff := CfgDiff{TagID: tags[i].ID, Name: tags[i].Name}
+
+		a, ok, err := s.cfgVersionAt(&tags[i], from)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			diff.From = a.Value
+		}
+
+		b, ok, err := s.cfgVersionAt(&tags[i], to)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			diff.To = b.Value
+		}
+
+		if !reflect.DeepEqual(diff.From, diff.To) {
+			list = append(list, diff)
+		}
+	}
+
+	return list, nil
+}
+
+// 将 CFG 标签回滚到 at 时刻的值，回滚本身记录为新的版本，来源为 ctx 中的来源或 OriginRollback。
+// at 之前没有版本时返回错误；值没有变化时不写入，返回 false
+func (s *Service) RollbackCfg(ctx context.Context, tag *device.Tag, at time.Time) (bool, error) {
+	version, ok, err := s.cfgVersionAt(tag, at)
+	if err != nil {
+		return false, err
+	}
+
+	if !ok {
+		return false, fmt.Errorf("tag: %v(%v) has no version before %v", tag.Name, tag.ID, at)
+	}
+
+	_, changed, err := s.rollbackCfg(ctx, tag, version)
+	return changed, err
+}
+
+// 将 slot 的所有 CFG 标签回滚到 at 时刻的值，at 之前没有版本的标签不变。
+// 返回回滚的标签，出错时返回已经回滚的标签和错误
+func (s *Service) RollbackCfgSlot(ctx context.Context, slotID string, at time.Time) ([]CfgDiff, error) {
+	tags, err := device.GetService().ListTag(slotID)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]CfgDiff, 0)
+
+	for i := 0; i < len(tags); i++ {
+		if tags[i].Type != device.TypeCFG {
+			continue
+		}
+
+		version, ok, err := s.cfgVersionAt(&tags[i], at)
+		if err != nil {
+			return list, err
+		}
+
+		if !ok {
+			continue
+		}
+
+		diff, changed, err := s.rollbackCfg(ctx, &tags[i], version)
+		if err != nil {
+			return list, err
+		}
+
+		if changed {
+			list = append(list, diff)
+		}
+	}
+
+	return list, nil
+}
+
+func (s *Service) rollbackCfg(ctx context.Context, tag *device.Tag, version CfgVersion) (CfgDiff, bool, error) {
+	diff := CfgDiff{TagID: tag.ID, Name: tag.Name, To: version.Value}
+
+	record, err := s.GetRecord(tag)
+	if err != nil {
+		return diff, false, err
+	}
+
+	diff.From = record.Value
+
+	if reflect.DeepEqual(record.Value, version.Value) {
+		return diff, false, nil
+	}
+
+	if Origin(ctx) == "" {
+		ctx = WithOrigin(ctx, OriginRollback)
+	}
+
+	if err := s.SetValueContext(ctx, tag, version.Value); err != nil {
+		return diff, false, err
+	}
+
+	return diff, true, nil
+}
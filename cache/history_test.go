@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/danclive/july/bolt"
+	"github.com/danclive/july/device"
+	"github.com/danclive/july/sqlite"
+	"github.com/danclive/nson-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCfgHistory(t *testing.T) {
+	dir := t.TempDir()
+
+	sqlite.Connect(filepath.Join(dir, "july.db"), false)
+	defer sqlite.Close()
+	device.InitService(sqlite.GetEngine())
+
+	bolt.Connect(filepath.Join(dir, "july.bolt"))
+	defer bolt.Close()
+
+	InitService()
+	service := GetService()
+	service.cfgHistory = 3
+
+	a := &device.Tag{SlotID: "cfg", Name: "a", Type: device.TypeCFG, DataType: device.TypeI32}
+	_, err := device.GetService().CreateTag(a)
+	assert.Nil(t, err)
+
+	b := &device.Tag{SlotID: "cfg", Name: "b", Type: device.TypeCFG, DataType: device.TypeF32}
+	_, err = device.GetService().CreateTag(b)
+	assert.Nil(t, err)
+
+	ctx := WithOrigin(context.Background(), "alice")
+
+	assert.Nil(t, service.SetValueContext(ctx, a, nson.I32(1)))
+	assert.Nil(t, service.SetValue(b, nson.F32(1.5)))
+	time.Sleep(time.Millisecond * 5)
+	point := time.Now()
+	time.Sleep(time.Millisecond * 5)
+
+	assert.Nil(t, service.SetValue(a, nson.I32(2)))
+	assert.Nil(t, service.SetValue(b, nson.F32(2.5)))
+
+	versions, err := service.ListCfgVersions(a, 0)
+	assert.Nil(t, err)
+	assert.Exactly(t, 2, len(versions))
+	assert.Exactly(t, nson.I32(2), versions[0].Value)
+	assert.Exactly(t, "alice", versions[1].Origin)
+	assert.True(t, versions[0].Version > versions[1].Version)
+
+	diff, changed, err := service.DiffCfgVersions(a, versions[1].Version, versions[0].Version)
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Exactly(t, nson.I32(1), diff.From)
+	assert.Exactly(t, nson.I32(2), diff.To)
+
+	diffs, err := service.DiffCfgSlot("cfg", point, time.Now())
+	assert.Nil(t, err)
+	assert.Exactly(t, 2, len(diffs))
+
+	// 回滚单个标签
+	changed, err = service.RollbackCfg(context.Background(), a, point)
+	assert.Nil(t, err)
+	assert.True(t, changed)
+
+	tag, _ := service.GetTagById(a.ID)
+	assert.Exactly(t, nson.I32(1), tag.Value)
+
+	versions, _ = service.ListCfgVersions(a, 1)
+	assert.Exactly(t, 1, len(versions))
+	assert.Exactly(t, OriginRollback, versions[0].Origin)
+
+	// 没有更早的版本
+	_, err = service.RollbackCfg(context.Background(), a, point.Add(-time.Hour))
+	assert.NotNil(t, err)
+
+	// 回滚整个 slot，a 已经回滚
+	diffs, err = service.RollbackCfgSlot(context.Background(), "cfg", point)
+	assert.Nil(t, err)
+	assert.Exactly(t, 1, len(diffs))
+	assert.Exactly(t, b.ID, diffs[0].TagID)
+	assert.Exactly(t, nson.F32(2.5), diffs[0].From)
+
+	tag, _ = service.GetTagById(b.ID)
+	assert.Exactly(t, nson.F32(1.5), tag.Value)
+
+	// 超过数量限制时删除最早的版本
+	assert.Nil(t, service.SetValue(a, nson.I32(3)))
+	versions, _ = service.ListCfgVersions(a, 0)
+	assert.Exactly(t, 3, len(versions))
+	assert.Exactly(t, nson.I32(3), versions[0].Value)
+	assert.Exactly(t, nson.I32(2), versions[2].Value)
+}
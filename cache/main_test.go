@@ -0,0 +1,14 @@
+package cache
+
+import (
+	"os"
+	"testing"
+
+	"github.com/danclive/july/log"
+)
+
+// 只初始化一次日志，Wire 的 goroutine 退出时仍会写日志，与下一个测试并发
+func TestMain(m *testing.M) {
+	log.Init(false)
+	os.Exit(m.Run())
+}
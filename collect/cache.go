@@ -2,17 +2,27 @@ package collect
 
 import (
 	"sync"
+	"time"
 
+	"github.com/danclive/july/device"
 	"github.com/danclive/nson-go"
 )
 
-var _cache map[string]nson.Value
-var _tick map[string]nson.Value
+type tagMeta struct {
+	SlotID string
+	Name   string
+}
+
+var _cache map[string]Record
+var _meta map[string]tagMeta
 var _rwlock sync.RWMutex
 
 func initCache() {
-	_cache = make(map[string]nson.Value)
-	_tick = make(map[string]nson.Value)
+	_rwlock.Lock()
+	defer _rwlock.Unlock()
+
+	_cache = make(map[string]Record)
+	_meta = make(map[string]tagMeta)
 }
 
 func CacheGet(key string) nson.Value {
@@ -20,34 +30,137 @@ func CacheGet(key string) nson.Value {
 	defer _rwlock.RUnlock()
 
 	if v, ok := _cache[key]; ok {
-		return v
+		return v.Value
 	}
 
 	return nil
 }
 
+func CacheGetRecord(key string) (Record, bool) {
+	_rwlock.RLock()
+	defer _rwlock.RUnlock()
+
+	v, ok := _cache[key]
+	return v, ok
+}
+
+// 写入质量为好的值，源时间为当前时间
 func CacheSet(key string, value nson.Value) {
+	now := time.Now()
+
+	CacheSetRecord(key, Record{
+		Value:      value,
+		Quality:    QualityGood,
+		SourceTime: now,
+		RecvTime:   now,
+	})
+}
+
+func CacheSetRecord(key string, record Record) {
+	publish(cacheSetRecord(key, nil, record))
+}
+
+// 与 CacheSetRecord 相同，同时记录标签所属的 slot 和名称，用于订阅
+func CacheSetTag(tag *device.Tag, record Record) {
+	publish(cacheSetRecord(tag.ID, tag, record))
+}
+
+func cacheSetRecord(key string, tag *device.Tag, record Record) Event {
 	_rwlock.Lock()
 	defer _rwlock.Unlock()
 
-	_cache[key] = value
-	_tick[key] = value
+	return cacheSetRecordLocked(key, tag, record)
 }
 
-func CacheDel(key string) {
+// 调用时需持有锁
+func cacheSetRecordLocked(key string, tag *device.Tag, record Record) Event {
+	if record.RecvTime.IsZero() {
+		record.RecvTime = time.Now()
+	}
+
+	if record.SourceTime.IsZero() {
+		record.SourceTime = record.RecvTime
+	}
+
+	_cache[key] = record
+
+	return cacheEvent(key, tag, record)
+}
+
+// 只更新质量，保留最后的值，没有缓存时创建空值的记录
+func CacheSetQuality(key string, quality Quality) {
+	if ev, changed := cacheSetQuality(key, nil, quality); changed {
+		publish(ev)
+	}
+}
+
+func CacheSetTagQuality(tag *device.Tag, quality Quality) {
+	if ev, changed := cacheSetQuality(tag.ID, tag, quality); changed {
+		publish(ev)
+	}
+}
+
+func cacheSetQuality(key string, tag *device.Tag, quality Quality) (Event, bool) {
 	_rwlock.Lock()
 	defer _rwlock.Unlock()
 
-	delete(_cache, key)
-	delete(_tick, key)
+	record, ok := _cache[key]
+	if !ok {
+		record.SourceTime = time.Now()
+	}
+
+	changed := !ok || record.Quality != quality
+
+	record.Quality = quality
+	record.RecvTime = time.Now()
+
+	_cache[key] = record
+
+	return cacheEvent(key, tag, record), changed
 }
 
-func CacheTick() map[string]nson.Value {
+// 调用时需持有锁
+func cacheEvent(key string, tag *device.Tag, record Record) Event {
+	if tag != nil {
+		_meta[key] = tagMeta{SlotID: tag.SlotID, Name: tag.Name}
+	}
+
+	meta := _meta[key]
+
+	return Event{
+		TagID:  key,
+		SlotID: meta.SlotID,
+		Name:   meta.Name,
+		Record: record,
+	}
+}
+
+// 发布非 IO 标签的值变化，例如 MEM、CFG 标签，不写入缓存
+func Publish(tag *device.Tag, record Record) {
+	if record.RecvTime.IsZero() {
+		record.RecvTime = time.Now()
+	}
+
+	if record.SourceTime.IsZero() {
+		record.SourceTime = record.RecvTime
+	}
+
+	publish(Event{
+		TagID:  tag.ID,
+		SlotID: tag.SlotID,
+		Name:   tag.Name,
+		Record: record,
+	})
+}
+
+func CacheDel(key string) {
 	_rwlock.Lock()
 	defer _rwlock.Unlock()
 
-	tmp := _tick
-	_tick = make(map[string]nson.Value)
+	delete(_cache, key)
+	delete(_meta, key)
 
-	return tmp
+	_deadbandLock.Lock()
+	delete(_deadbands, key)
+	_deadbandLock.Unlock()
 }
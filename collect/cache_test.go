@@ -0,0 +1,61 @@
+package collect
+
+import (
+	"testing"
+	"time"
+
+	"github.com/danclive/july/device"
+	"github.com/danclive/march/consts"
+	"github.com/danclive/nson-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWireQuality(t *testing.T) {
+	initCache()
+
+	driver := &fakeDriver{reads: make(map[string]int)}
+
+	tags := []device.Tag{
+		{ID: "good", Name: "good", DataType: device.TypeI32},
+		{ID: "fail", Name: "fail", Address: "fail", DataType: device.TypeI32},
+		{ID: "range", Name: "range", DataType: device.TypeI32, Convert: consts.ON, ConvertDataType: device.TypeF32, LLimit: 10, HLimit: 20, LValue: 0, HValue: 100},
+	}
+
+	wire := NewWire(driver, device.Slot{ID: "1"}, tags, time.Minute, time.Millisecond*20)
+
+	done := make(chan struct{})
+	go func() {
+		wire.Run()
+		close(done)
+	}()
+
+	time.Sleep(time.Millisecond * 100)
+
+	record, ok := CacheGetRecord("good")
+	assert.True(t, ok)
+	assert.Exactly(t, QualityGood, record.Quality)
+	assert.NotNil(t, record.Value)
+	assert.False(t, record.SourceTime.IsZero())
+
+	record, ok = CacheGetRecord("fail")
+	assert.True(t, ok)
+	assert.Exactly(t, QualityBadDeviceFailure, record.Quality)
+	assert.Nil(t, record.Value)
+
+	record, _ = CacheGetRecord("range")
+	assert.Exactly(t, QualityUncertainOutOfRange, record.Quality)
+	assert.True(t, record.Quality.IsUncertain())
+
+	<-wire.Close()
+	<-done
+
+	record, _ = CacheGetRecord("good")
+	assert.Exactly(t, QualityBadCommFailure, record.Quality)
+	assert.True(t, record.Quality.IsBad())
+	assert.NotNil(t, record.Value)
+
+	CacheSet("good", nson.I32(1))
+	record, _ = CacheGetRecord("good")
+	assert.Exactly(t, QualityGood, record.Quality)
+	assert.Exactly(t, "bad: comm failure", QualityBadCommFailure.String())
+}
@@ -1,7 +1,9 @@
 package collect
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"sync"
 	"time"
 
@@ -12,6 +14,13 @@ import (
 
 var _service *Service
 
+// 写入的默认超时时间
+const DefaultWriteTimeout = time.Second * 10
+
+// 停止的默认超时时间
+const DefaultStopTimeout = time.Second * 10
+
+// 初始化采集服务，并恢复保存的标签最后值，见 SaveCache
 func InitService(readInterval int, keepalive int, connectInterval int) {
 	initCache()
 
@@ -20,7 +29,18 @@ func InitService(readInterval int, keepalive int, connectInterval int) {
 		connectInterval: time.Second * time.Duration(connectInterval),
 		readInterval:    time.Second * time.Duration(readInterval),
 		wires:           make(map[string]*Wire),
-		close:           make(chan struct{}),
+		states:          newConnStates(time.Second*time.Duration(connectInterval), DefaultMaxBackoff),
+		faults:          make(map[string]*faultMonitor),
+		stats:           make(map[string]*wireStats),
+		tracers:         make(map[string]*Tracer),
+		persistInterval: DefaultPersistInterval,
+	}
+
+	count, err := _service.restoreCache()
+	if err != nil {
+		log.Suger.Error("restore cache: ", err)
+	} else if count > 0 {
+		log.Suger.Infof("restored %v tag values", count)
 	}
 }
 
@@ -33,38 +53,132 @@ type Service struct {
 	connectInterval time.Duration
 	readInterval    time.Duration
 	wires           map[string]*Wire
+	states          *connStates
+	faults          map[string]*faultMonitor
+	faultLock       sync.Mutex
+	stats           map[string]*wireStats
+	statsLock       sync.Mutex
+	tracers         map[string]*Tracer
+	traceLock       sync.Mutex
+	persistInterval time.Duration
 	lock            sync.RWMutex
-	close           chan struct{}
+
+	runLock  sync.Mutex
+	close    chan struct{}  // 运行时不为 nil，停止时关闭
+	done     chan struct{}  // 所有连接都已经关闭
+	routines sync.WaitGroup // 连接线程和各 slot 的连接
 }
 
 func Run() {
+	if err := _service.Start(context.Background()); err != nil {
+		log.Suger.Error(err)
+	}
+}
+
+func Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultStopTimeout)
+	defer cancel()
+
+	return _service.Stop(ctx)
+}
+
+// 启动采集服务，停止后可以再次启动。ctx 只用于启动过程
+func (c *Service) Start(ctx context.Context) error {
+	c.runLock.Lock()
+	defer c.runLock.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if c.close != nil {
+		return errors.New("collect already started")
+	}
+
+	// 上次停止超时，还有连接没有关闭
+	if c.done != nil {
+		select {
+		case <-c.done:
+		default:
+			return errors.New("collect is stopping")
+		}
+	}
+
 	log.Logger.Info("starting collect")
 
 	device.GetService().SlotReset("")
 
-	go _service.connect()
+	closeCh := make(chan struct{})
+	done := make(chan struct{})
+
+	c.lock.Lock()
+	c.close = closeCh
+	c.lock.Unlock()
+
+	c.done = done
+
+	c.routines.Add(2)
+	go c.connect(closeCh)
+	go c.persist(closeCh)
+
+	go func() {
+		c.routines.Wait()
+		close(done)
+	}()
+
+	return nil
 }
 
-func Stop() error {
-	select {
-	case <-_service.close:
+// 停止采集服务，关闭所有连接，并等待所有连接关闭，直到 ctx 结束。
+// 连接都关闭后保存标签最后值。
+// 超时后再次调用可以继续等待
+func (c *Service) Stop(ctx context.Context) error {
+	c.runLock.Lock()
+	defer c.runLock.Unlock()
+
+	if c.done == nil {
 		return nil
-	default:
-		close(_service.close)
 	}
 
-	_service.lock.RLock()
-	defer _service.lock.RUnlock()
+	c.lock.Lock()
+	if c.close != nil {
+		close(c.close)
+		c.close = nil
+	}
+
+	wires := make([]*Wire, 0, len(c.wires))
+	for _, wire := range c.wires {
+		wires = append(wires, wire)
+	}
+	c.lock.Unlock()
 
-	for slotId, wire := range _service.wires {
+	// slot 的协程在 wire 退出后调用 SlotOffline
+	for _, wire := range wires {
 		wire.Close()
-		device.GetService().SlotOffline(slotId)
 	}
 
-	return nil
+	for _, wire := range wires {
+		select {
+		case <-wire.closeComplete:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if err := c.SaveCache(); err != nil {
+		log.Suger.Error("save cache: ", err)
+	}
+
+	select {
+	case <-c.done:
+		log.Logger.Info("collect stopped")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-// 更新 slot/tag 后，需要调用此函数
+// 更新 slot 的驱动、参数或配置后，需要调用此函数，断开连接后重新连接
 func (c *Service) Reset(slotId string) {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
@@ -75,108 +189,228 @@ func (c *Service) Reset(slotId string) {
 	}
 }
 
+// 只有标签变化时调用此函数，重新加载标签，不断开连接。
+// slot 未连接时不做处理，下次连接时加载
+func (c *Service) Reload(slotId string) {
+	c.lock.RLock()
+	wire, ok := c.wires[slotId]
+	c.lock.RUnlock()
+
+	if !ok {
+		return
+	}
+
+	tags, err := device.GetService().ListTagStatusOnAndTypeIO(slotId)
+	if err != nil {
+		log.Suger.Error(err)
+		return
+	}
+
+	if err := wire.Reload(tags); err != nil {
+		log.Suger.Errorf("slot: %v reload: %v", slotId, err)
+		return
+	}
+
+	device.GetService().SlotUpdated(slotId, true)
+}
+
 // 注意，要写入的标签必须为同一个 slot
 func (c *Service) Write(tags []device.Tag) error {
+	return c.WriteContext(context.Background(), tags)
+}
+
+// 写入标签并等待设备确认，ctx 没有截止时间时使用 DefaultWriteTimeout。
+// slot 未连接时返回 ErrSlotOffline，写入队列满时返回 ErrWriteQueueFull，
+// 部分标签写入失败时返回 TagErrors，与 tags 一一对应。
+// 注意，要写入的标签必须为同一个 slot
+func (c *Service) WriteContext(ctx context.Context, tags []device.Tag) error {
 	if len(tags) == 0 {
 		return nil
 	}
 
 	slotID := tags[0].SlotID
 
-	for _, tag := range tags {
-		if tag.SlotID != slotID {
+	list := make([]device.Tag, len(tags))
+	copy(list, tags)
+
+	for i := 0; i < len(list); i++ {
+		if list[i].SlotID != slotID {
 			return errors.New("the tag to write to must be the same slot")
 		}
 
-		if tag.Access != consts.ON {
+		if list[i].Access != consts.ON {
 			return errors.New("tag.Access != RW(consts.ON)")
 		}
 
-		if tag.Value == nil {
+		if list[i].Value == nil {
 			return errors.New("tag.Value == nil")
 		}
 
-		tag.WriteConvert()
+		list[i].WriteConvert()
 	}
 
-	slot, err := device.GetService().GetSlot(slotID)
-	if err != nil {
-		return err
+	slot, ok := device.GetService().LookupSlot(slotID)
+	if !ok {
+		return errors.New("slot not found")
 	}
 
 	if slot.Status != consts.ON {
 		return errors.New("slot don't enable")
 	}
 
+	c.lock.RLock()
+	wire, ok := c.wires[slotID]
+	c.lock.RUnlock()
+
+	if !ok {
+		return ErrSlotOffline
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultWriteTimeout)
+		defer cancel()
+	}
+
+	return wire.SendContext(ctx, list)
+}
+
+// slot 各扫描类的统计，slot 未连接时返回 false
+func (c *Service) ScanStats(slotId string) ([]ScanStats, bool) {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
 
-	if wire, ok := c.wires[slotID]; ok {
-		wire.Send(tags)
+	if wire, ok := c.wires[slotId]; ok {
+		return wire.ScanStats(), true
 	}
 
-	return nil
+	return nil, false
 }
 
-func (c *Service) connect() {
-	for {
-		time.Sleep(c.connectInterval)
+// slot 的连接状态，slot 未启用时返回 false
+func (c *Service) SlotState(slotId string) (SlotState, bool) {
+	return c.states.get(slotId)
+}
+
+// 所有启用的 slot 的连接状态
+func (c *Service) SlotStates() []SlotState {
+	return c.states.list()
+}
 
+func (c *Service) connect(closeCh chan struct{}) {
+	defer c.routines.Done()
+
+	timer := time.NewTimer(c.connectInterval)
+	defer timer.Stop()
+
+	for {
 		select {
-		case <-c.close:
+		case <-closeCh:
 			return
-		default:
-			slots, err := device.GetService().ListSlotStatusOn()
-			if err != nil {
-				log.Suger.Error(err)
+		case <-timer.C:
+			timer.Reset(c.connectInterval)
+		}
+
+		slots, err := device.GetService().ListSlotStatusOn()
+		if err != nil {
+			log.Suger.Error(err)
+			continue
+		}
+
+		now := time.Now()
+		enabled := make(map[string]struct{}, len(slots))
+
+		for _, slot := range slots {
+			// 没有注册驱动的 slot 由其他服务处理，例如 MQTT
+			if _, ok := _drivers[slot.Driver]; !ok {
 				continue
 			}
 
-			for _, slot := range slots {
-				func(slot device.Slot) {
-					c.lock.Lock()
+			enabled[slot.ID] = struct{}{}
 
-					if _, ok := c.wires[slot.ID]; ok {
-						c.lock.Unlock()
-						return
-					}
-					c.lock.Unlock()
+			if c.states.begin(slot.ID, now) {
+				c.routines.Add(1)
+				go c.dial(slot, closeCh)
+			}
+		}
+
+		c.states.retain(enabled)
+	}
+}
 
-					if driver, ok := _drivers[slot.Driver]; ok {
-						conn, err := driver.Connect(slot)
-						if err != nil {
-							log.Suger.Error(err)
-							return
-						}
+// 连接 slot 并运行直到断开，失败时进入退避状态
+func (c *Service) dial(slot device.Slot, closeCh chan struct{}) {
+	defer c.routines.Done()
 
-						device.GetService().SlotOnline(slot.ID)
+	fault := c.faultMonitor(slot)
 
-						tags, err := device.GetService().ListTagStatusOnAndTypeIO(slot.ID)
-						if err != nil {
-							log.Suger.Error(err)
-							return
-						}
+	stats := c.slotStats(slot.ID, slot.Name)
 
-						// fmt.Printf("%#v", tags[0])
+	wire, err := c.open(slot)
+	if err != nil {
+		stats.connectFailed(err, time.Now())
+		fault.failure(err)
+		delay := c.states.failed(slot.ID, err, time.Now())
+		log.Suger.Errorf("slot: %v(%v) connect: %v, retry in %v", slot.Name, slot.ID, err, delay)
+		return
+	}
 
-						wire := NewWire(conn, slot.ID, tags, c.keepalive, c.readInterval)
+	c.lock.Lock()
+	select {
+	case <-closeCh:
+		c.lock.Unlock()
+		wire.conn.Close()
+		c.states.disconnected(slot.ID)
+		return
+	default:
+	}
+	wire.fault = fault
+	wire.stats = stats
+	c.wires[slot.ID] = wire
+	c.lock.Unlock()
 
-						c.lock.Lock()
-						c.wires[slot.ID] = wire
-						c.lock.Unlock()
+	device.GetService().SlotOnline(slot.ID)
+	device.GetService().SlotUpdated(slot.ID, true)
+	c.states.connected(slot.ID, time.Now())
 
-						go func(wire *Wire) {
-							wire.Run()
+	wire.Run()
 
-							c.lock.Lock()
-							delete(c.wires, wire.slotID)
-							c.lock.Unlock()
+	c.lock.Lock()
+	delete(c.wires, wire.slotID)
+	c.lock.Unlock()
 
-							log.Suger.Errorf("wire break: %v", wire.err)
-						}(wire)
-					}
-				}(slot)
-			}
-		}
+	device.GetService().SlotOffline(slot.ID)
+
+	// 主动关闭时没有错误
+	if wire.err == nil {
+		c.states.disconnected(slot.ID)
+		return
+	}
+
+	// 空闲关闭不是设备的错误
+	if wire.err != errWireIdle {
+		fault.failure(wire.err)
+	}
+
+	delay := c.states.failed(slot.ID, wire.err, time.Now())
+	log.Suger.Errorf("wire break: %v, retry in %v", wire.err, delay)
+}
+
+func (c *Service) open(slot device.Slot) (*Wire, error) {
+	driver, ok := _drivers[slot.Driver]
+	if !ok {
+		return nil, fmt.Errorf("unknown driver %q", slot.Driver)
 	}
+
+	tags, err := device.GetService().ListTagStatusOnAndTypeIO(slot.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := driver.Connect(slot)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewWire(conn, slot, tags, c.keepalive, c.readInterval), nil
 }
@@ -0,0 +1,150 @@
+package collect
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/danclive/july/device"
+	"github.com/danclive/july/sqlite"
+	"github.com/danclive/march/consts"
+	"github.com/danclive/nson-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func initTestService(t *testing.T) {
+	sqlite.Connect(filepath.Join(t.TempDir(), "july.db"), false)
+	device.InitService(sqlite.GetEngine())
+
+	InitService(1, 60, 1)
+	_service.connectInterval = time.Millisecond * 10
+	_service.states = newConnStates(time.Millisecond*10, time.Second)
+
+	RegisterDriver("FAKE", &fakeDriver{reads: make(map[string]int)})
+}
+
+func waitSlotState(slotID string, state ConnState) bool {
+	for i := 0; i < 100; i++ {
+		if s, ok := GetService().SlotState(slotID); ok && s.State == state {
+			return true
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	return false
+}
+
+func TestServiceLifecycle(t *testing.T) {
+	initTestService(t)
+	defer sqlite.Close()
+	defer delete(_drivers, "FAKE")
+
+	slot := &device.Slot{Name: "fake", Driver: "FAKE", Status: consts.ON, Config: "scan=10ms"}
+	_, err := device.GetService().CreateSlot(slot)
+	assert.Nil(t, err)
+
+	tag := &device.Tag{SlotID: slot.ID, Name: "a", Type: device.TypeIO, Status: consts.ON}
+	_, err = device.GetService().CreateTag(tag)
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	service := GetService()
+
+	// 没有启动时停止
+	assert.Nil(t, service.Stop(ctx))
+
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, service.Start(ctx))
+		assert.NotNil(t, service.Start(ctx))
+
+		assert.True(t, waitSlotState(slot.ID, StateConnected))
+
+		s, _ := device.GetService().GetSlot(slot.ID)
+		assert.Exactly(t, int32(consts.ON), s.LinkStatus)
+		assert.Exactly(t, int32(consts.ON), s.Update)
+
+		time.Sleep(time.Millisecond * 50)
+		assert.NotNil(t, CacheGet(tag.ID))
+
+		ctx, cancel := context.WithTimeout(ctx, time.Second)
+		assert.Nil(t, service.Stop(ctx))
+		cancel()
+
+		service.lock.RLock()
+		assert.Exactly(t, 0, len(service.wires))
+		service.lock.RUnlock()
+
+		state, _ := service.SlotState(slot.ID)
+		assert.Exactly(t, StateDisconnected, state.State)
+
+		s, _ = device.GetService().GetSlot(slot.ID)
+		assert.Exactly(t, int32(consts.OFF), s.LinkStatus)
+
+		record, _ := CacheGetRecord(tag.ID)
+		assert.Exactly(t, QualityBadCommFailure, record.Quality)
+	}
+
+	assert.Nil(t, service.Stop(ctx))
+}
+
+func TestServiceWriteContextTagErrors(t *testing.T) {
+	initTestService(t)
+	defer sqlite.Close()
+
+	serv, address := newModbusServer(t)
+	defer serv.Close()
+
+	host, port, _ := net.SplitHostPort(address)
+
+	slot := &device.Slot{
+		Name:   "plc",
+		Driver: device.DriverModbusTCP,
+		Params: "host=" + host + "&port=" + port,
+		Status: consts.ON,
+		Config: "scan=10ms",
+	}
+	_, err := device.GetService().CreateSlot(slot)
+	assert.Nil(t, err)
+
+	service := GetService()
+
+	assert.Nil(t, service.Start(context.Background()))
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		assert.Nil(t, service.Stop(ctx))
+	}()
+
+	assert.True(t, waitSlotState(slot.ID, StateConnected))
+
+	service.lock.RLock()
+	wire := service.wires[slot.ID]
+	service.lock.RUnlock()
+
+	tags := []device.Tag{
+		{SlotID: slot.ID, Name: "ir", Address: "IR0", DataType: device.TypeU16, Access: consts.ON, Value: nson.U32(1)},
+		{SlotID: slot.ID, Name: "hr", Address: "HR0", DataType: device.TypeU16, Access: consts.ON, Value: nson.U32(7)},
+	}
+
+	// 只读区域只影响对应的标签，其他标签确认写入，连接保持
+	err = service.WriteContext(context.Background(), tags)
+	errs, ok := err.(TagErrors)
+	assert.True(t, ok)
+	assert.Exactly(t, 2, len(errs))
+	assert.NotNil(t, errs[0])
+	assert.Nil(t, errs[1])
+	assert.Exactly(t, uint16(7), serv.HoldingRegisters[0])
+
+	tags[1].Value = nson.U32(8)
+	assert.Nil(t, service.WriteContext(context.Background(), tags[1:]))
+	assert.Exactly(t, uint16(8), serv.HoldingRegisters[0])
+
+	state, _ := service.SlotState(slot.ID)
+	assert.Exactly(t, StateConnected, state.State)
+
+	service.lock.RLock()
+	assert.True(t, wire == service.wires[slot.ID])
+	service.lock.RUnlock()
+}
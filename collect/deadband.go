@@ -0,0 +1,164 @@
+package collect
+
+import (
+	"math"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/danclive/july/device"
+	"github.com/danclive/july/log"
+	"github.com/danclive/july/util"
+	"github.com/danclive/march/consts"
+	"github.com/danclive/nson-go"
+)
+
+// 按死区和心跳过滤标签值，只有明显的变化才写入缓存
+type Deadband struct {
+	abs       float64
+	pct       float64
+	span      float64
+	heartbeat time.Duration
+}
+
+// 标签没有配置死区和心跳时返回 nil，此时每次读取都写入缓存
+func NewDeadband(tag *device.Tag) *Deadband {
+	config, err := tag.ParseConfig()
+	if err != nil {
+		log.Suger.Warnf("tag: %v(%v) config: %v", tag.Name, tag.ID, err)
+		return nil
+	}
+
+	if !config.ReportByException() {
+		return nil
+	}
+
+	d := &Deadband{
+		abs:       config.Deadband,
+		pct:       config.DeadbandPct,
+		heartbeat: config.Heartbeat,
+	}
+
+	if tag.Convert == consts.ON {
+		d.span = math.Abs(tag.HValue - tag.LValue)
+	}
+
+	return d
+}
+
+type deadbandEntry struct {
+	config   string
+	convert  int32
+	hvalue   float64
+	lvalue   float64
+	deadband *Deadband
+}
+
+var _deadbands = make(map[string]deadbandEntry)
+var _deadbandLock sync.Mutex
+
+// 与 NewDeadband 相同，按标签 ID 缓存，标签的配置或量程变化时重新创建。
+// 用于没有 Wire 的上报，例如 MQTT，配置错误时只记录一次日志
+func TagDeadband(tag *device.Tag) *Deadband {
+	_deadbandLock.Lock()
+	defer _deadbandLock.Unlock()
+
+	entry, ok := _deadbands[tag.ID]
+	if ok && entry.config == tag.Config && entry.convert == tag.Convert &&
+		entry.hvalue == tag.HValue && entry.lvalue == tag.LValue {
+		return entry.deadband
+	}
+
+	entry = deadbandEntry{
+		config:   tag.Config,
+		convert:  tag.Convert,
+		hvalue:   tag.HValue,
+		lvalue:   tag.LValue,
+		deadband: NewDeadband(tag),
+	}
+
+	_deadbands[tag.ID] = entry
+
+	return entry.deadband
+}
+
+// 与上次记录的值相比，新值是否需要记录
+func (d *Deadband) Significant(last Record, record Record) bool {
+	if d == nil || last.Value == nil || last.Quality != record.Quality {
+		return true
+	}
+
+	if d.heartbeat > 0 && record.RecvTime.Sub(last.RecvTime) >= d.heartbeat {
+		return true
+	}
+
+	return d.changed(last.Value, record.Value)
+}
+
+func (d *Deadband) changed(old, value nson.Value) bool {
+	if value == nil {
+		return false
+	}
+
+	_, isBool := value.(nson.Bool)
+
+	f1, ok1 := util.NsonValueToFloat64(old)
+	f2, ok2 := util.NsonValueToFloat64(value)
+
+	if isBool || !ok1 || !ok2 {
+		return old.Tag() != value.Tag() || !reflect.DeepEqual(old, value)
+	}
+
+	diff := math.Abs(f2 - f1)
+
+	if d.abs == 0 && d.pct == 0 {
+		return diff != 0
+	}
+
+	if d.abs > 0 && diff <= d.abs {
+		return false
+	}
+
+	if d.pct > 0 {
+		base := d.span
+		if base == 0 {
+			base = math.Abs(f1)
+		}
+
+		if diff <= base*d.pct/100 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// 按死区过滤后写入缓存，返回是否写入
+func CacheReport(tag *device.Tag, record Record, deadband *Deadband) bool {
+	if deadband == nil {
+		CacheSetTag(tag, record)
+		return true
+	}
+
+	ev, ok := cacheReport(tag, record, deadband)
+	if ok {
+		publish(ev)
+	}
+
+	return ok
+}
+
+func cacheReport(tag *device.Tag, record Record, deadband *Deadband) (Event, bool) {
+	_rwlock.Lock()
+	defer _rwlock.Unlock()
+
+	if record.RecvTime.IsZero() {
+		record.RecvTime = time.Now()
+	}
+
+	if !deadband.Significant(_cache[tag.ID], record) {
+		return Event{}, false
+	}
+
+	return cacheSetRecordLocked(tag.ID, tag, record), true
+}
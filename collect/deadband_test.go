@@ -0,0 +1,82 @@
+package collect
+
+import (
+	"testing"
+	"time"
+
+	"github.com/danclive/july/device"
+	"github.com/danclive/march/consts"
+	"github.com/danclive/nson-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeadband(t *testing.T) {
+	assert.Nil(t, NewDeadband(&device.Tag{}))
+	assert.Nil(t, NewDeadband(&device.Tag{Config: "scan=1s"}))
+
+	now := time.Now()
+	last := Record{Value: nson.F32(10), RecvTime: now}
+	next := func(v nson.Value, d time.Duration) Record {
+		return Record{Value: v, RecvTime: now.Add(d)}
+	}
+
+	abs := NewDeadband(&device.Tag{Config: "deadband=0.5"})
+	assert.False(t, abs.Significant(last, next(nson.F32(10.4), time.Second)))
+	assert.True(t, abs.Significant(last, next(nson.F32(10.6), time.Second)))
+	assert.True(t, abs.Significant(Record{}, next(nson.F32(10), time.Second)))
+	assert.True(t, abs.Significant(last, Record{Value: nson.F32(10), Quality: QualityUncertainOutOfRange, RecvTime: now}))
+
+	// 相对于上次的值
+	pct := NewDeadband(&device.Tag{Config: "deadband_pct=10"})
+	assert.False(t, pct.Significant(last, next(nson.F32(10.9), time.Second)))
+	assert.True(t, pct.Significant(last, next(nson.F32(8.9), time.Second)))
+
+	// 相对于量程
+	span := NewDeadband(&device.Tag{Config: "deadband_pct=1", Convert: consts.ON, LValue: 0, HValue: 1000})
+	assert.False(t, span.Significant(last, next(nson.F32(19), time.Second)))
+	assert.True(t, span.Significant(last, next(nson.F32(21), time.Second)))
+
+	heartbeat := NewDeadband(&device.Tag{Config: "heartbeat=1m"})
+	assert.False(t, heartbeat.Significant(last, next(nson.F32(10), time.Second)))
+	assert.True(t, heartbeat.Significant(last, next(nson.F32(10.01), time.Second)))
+	assert.True(t, heartbeat.Significant(last, next(nson.F32(10), time.Minute)))
+
+	str := Record{Value: nson.String("a"), RecvTime: now}
+	assert.False(t, heartbeat.Significant(str, next(nson.String("a"), time.Second)))
+	assert.True(t, heartbeat.Significant(str, next(nson.String("b"), time.Second)))
+
+	initCache()
+
+	sub := Subscribe(SubscribeOptions{})
+	defer sub.Close()
+
+	tag := &device.Tag{ID: "a", Config: "deadband=1"}
+	deadband := NewDeadband(tag)
+
+	assert.True(t, CacheReport(tag, Record{Value: nson.F32(1)}, deadband))
+	assert.False(t, CacheReport(tag, Record{Value: nson.F32(1.5)}, deadband))
+	assert.True(t, CacheReport(tag, Record{Value: nson.F32(2.5)}, deadband))
+	assert.Exactly(t, nson.F32(2.5), CacheGet("a"))
+	assert.Exactly(t, 2, len(sub.C()))
+}
+
+func TestTagDeadband(t *testing.T) {
+	tag := &device.Tag{ID: "deadband", Config: "deadband=0.5"}
+
+	d := TagDeadband(tag)
+	assert.NotNil(t, d)
+	assert.True(t, d == TagDeadband(tag))
+
+	// 配置变化时重新创建
+	tag.Config = "deadband=1"
+	d2 := TagDeadband(tag)
+	assert.False(t, d == d2)
+	assert.Exactly(t, 1.0, d2.abs)
+
+	tag.Config = ""
+	assert.Nil(t, TagDeadband(tag))
+
+	CacheDel(tag.ID)
+	_, ok := _deadbands[tag.ID]
+	assert.False(t, ok)
+}
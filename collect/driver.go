@@ -1,14 +1,17 @@
 package collect
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"sync"
 	"time"
 
 	"github.com/danclive/july/device"
 	"github.com/danclive/july/log"
+	"github.com/danclive/july/util"
 	"go.uber.org/zap"
 )
 
@@ -20,16 +23,153 @@ type Driver interface {
 	Write([]device.Tag) error
 }
 
+// 支持 context 的驱动，ctx 取消或超时时读写应尽快返回 ctx.Err()。
+// 没有实现此接口的驱动由 WithContext 适配。
+type ContextDriver interface {
+	Close() error
+	Name() string
+	ReadContext(ctx context.Context, tags []device.Tag) error
+	WriteContext(ctx context.Context, tags []device.Tag) error
+}
+
+// 将驱动适配为 ContextDriver，驱动已经实现时直接返回。
+// 适配器在单独的 goroutine 中读写标签的副本，ctx 结束时立即返回 ctx.Err()，
+// 此时驱动的状态未知，应关闭连接，Close 通常会使阻塞的读写返回。
+func WithContext(driver Driver) ContextDriver {
+	if d, ok := driver.(ContextDriver); ok {
+		return d
+	}
+
+	return &driverAdapter{driver: driver, busy: make(chan struct{}, 1)}
+}
+
+type driverAdapter struct {
+	driver Driver
+	busy   chan struct{}
+}
+
+func (a *driverAdapter) Close() error {
+	return a.driver.Close()
+}
+
+func (a *driverAdapter) Name() string {
+	return a.driver.Name()
+}
+
+func (a *driverAdapter) ReadContext(ctx context.Context, tags []device.Tag) error {
+	return a.do(ctx, tags, a.driver.Read)
+}
+
+func (a *driverAdapter) WriteContext(ctx context.Context, tags []device.Tag) error {
+	return a.do(ctx, tags, a.driver.Write)
+}
+
+func (a *driverAdapter) do(ctx context.Context, tags []device.Tag, op func([]device.Tag) error) error {
+	// 上一次超时的读写可能还没有返回
+	select {
+	case a.busy <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	list := make([]device.Tag, len(tags))
+	copy(list, tags)
+
+	done := make(chan error, 1)
+
+	go func() {
+		var err error
+
+		defer func() {
+			if re := recover(); re != nil {
+				err = errors.New(fmt.Sprint(re))
+			}
+			<-a.busy
+			done <- err
+		}()
+
+		err = op(list)
+	}()
+
+	select {
+	case err := <-done:
+		copy(tags, list)
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 驱动写入时部分标签失败，与写入的标签一一对应，nil 表示成功。
+// Write 返回 TagErrors 时连接保持，返回其他错误时连接断开，所有标签都失败。
+type TagErrors []error
+
+func (e TagErrors) Error() string {
+	failed := 0
+	var first error
+
+	for _, err := range e {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			failed++
+		}
+	}
+
+	return fmt.Sprintf("%v of %v tags failed: %v", failed, len(e), first)
+}
+
+// 没有失败的标签时返回 nil
+func (e TagErrors) Err() error {
+	for _, err := range e {
+		if err != nil {
+			return e
+		}
+	}
+
+	return nil
+}
+
 var _drivers = make(map[string]Driver)
 
+// 连接空闲超过 keepalive 时关闭
+var errWireIdle = errors.New("free")
+
+var (
+	ErrSlotOffline    = errors.New("slot offline")
+	ErrWriteQueueFull = errors.New("write queue full")
+)
+
+// Slot.Params 中所有驱动通用的参数，例如：read_timeout=5s&write_timeout=5s
+// 一次读写超过时间没有完成时连接断开，0 表示不限制。
+type wireParams struct {
+	ReadTimeout  time.Duration `cfg:"read_timeout,default=30s"`
+	WriteTimeout time.Duration `cfg:"write_timeout,default=30s"`
+}
+
+type reloadRequest struct {
+	tags []device.Tag
+	done chan struct{}
+}
+
+type writeRequest struct {
+	ctx  context.Context
+	tags []device.Tag
+	done chan error
+}
+
 func RegisterDriver(name string, driver Driver) {
 	_drivers[name] = driver
 }
 
 type Wire struct {
 	wg            sync.WaitGroup
-	conn          Driver
-	out           chan []device.Tag
+	conn          ContextDriver
+	ctx           context.Context
+	cancel        context.CancelFunc
+	out           chan writeRequest
+	reload        chan reloadRequest
 	close         chan struct{}
 	closeComplete chan struct{}
 	error         chan error
@@ -40,29 +180,92 @@ type Wire struct {
 	lock        sync.Mutex
 
 	keepalive    time.Duration
-	readInterval time.Duration
+	readTimeout  time.Duration
+	writeTimeout time.Duration
 
-	slotID string
-	tags   []device.Tag
+	slot         device.Slot
+	slotID       string
+	readInterval time.Duration
+	classes      []*scanClass
+	classLock    sync.RWMutex
+	fault        *faultMonitor
+	stats        *wireStats
+	counter      ByteCounter
+	deadbands    map[string]*Deadband
 }
 
-func NewWire(conn Driver, slotID string, tags []device.Tag, keepalive time.Duration, readInterval time.Duration) *Wire {
+func NewWire(conn Driver, slot device.Slot, tags []device.Tag, keepalive time.Duration, readInterval time.Duration) *Wire {
 	w := &Wire{
-		conn:          conn,
-		out:           make(chan []device.Tag, 10),
+		conn:          WithContext(conn),
+		out:           make(chan writeRequest, 10),
+		reload:        make(chan reloadRequest),
 		close:         make(chan struct{}),
 		closeComplete: make(chan struct{}),
 		error:         make(chan error, 1),
 		lastUseTime:   time.Now(),
 		keepalive:     keepalive,
+		slot:          slot,
+		slotID:        slot.ID,
 		readInterval:  readInterval,
-		slotID:        slotID,
-		tags:          tags,
+		classes:       buildScanClasses(slot, tags, readInterval),
+		deadbands:     buildDeadbands(tags),
+		stats:         newWireStats(slot.ID, slot.Name),
+	}
+
+	if counter, ok := conn.(ByteCounter); ok {
+		w.counter = counter
+	}
+
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+
+	var params wireParams
+	u, err := url.ParseQuery(slot.Params)
+	if err == nil {
+		err = util.MapConfig(&params, u)
+	}
+	if err != nil {
+		log.Suger.Warnf("slot: %v params: %v", slot.ID, err)
+		params = wireParams{ReadTimeout: time.Second * 30, WriteTimeout: time.Second * 30}
 	}
 
+	w.readTimeout = params.ReadTimeout
+	w.writeTimeout = params.WriteTimeout
+
 	return w
 }
 
+func buildDeadbands(tags []device.Tag) map[string]*Deadband {
+	deadbands := make(map[string]*Deadband)
+
+	for i := 0; i < len(tags); i++ {
+		if deadband := NewDeadband(&tags[i]); deadband != nil {
+			deadbands[tags[i].ID] = deadband
+		}
+	}
+
+	return deadbands
+}
+
+func (w *Wire) scanClasses() []*scanClass {
+	w.classLock.RLock()
+	defer w.classLock.RUnlock()
+
+	return w.classes
+}
+
+// 空闲关闭的时间，扫描周期较长时，至少为两个周期，避免空闲关闭
+func (w *Wire) idleTimeout() time.Duration {
+	keepalive := w.keepalive
+
+	for _, class := range w.scanClasses() {
+		if keepalive < class.interval*2 {
+			keepalive = class.interval * 2
+		}
+	}
+
+	return keepalive
+}
+
 func (w *Wire) Close() <-chan struct{} {
 	w.setError(nil)
 	return w.closeComplete
@@ -78,38 +281,94 @@ func (w *Wire) setError(err error) {
 	}
 }
 
+// 单次读写的 ctx，连接关闭时取消
+func (w *Wire) opContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(w.ctx)
+	}
+
+	return context.WithTimeout(w.ctx, timeout)
+}
+
+// 写入标签，部分标签失败时返回 TagErrors，连接故障时返回其他错误
 func (w *Wire) write(tags []device.Tag) error {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
-	err := w.conn.Write(tags)
+	ctx, cancel := w.opContext(w.writeTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := w.conn.WriteContext(ctx, tags)
+	w.stats.write(len(tags), time.Since(start), err, time.Now())
+
 	if err != nil {
-		return err
+		errs, ok := err.(TagErrors)
+		if !ok {
+			return err
+		}
+
+		for i := 0; i < len(errs) && i < len(tags); i++ {
+			if errs[i] != nil {
+				log.Suger.Warnf("write tag: %v(%v): %v", tags[i].Name, tags[i].ID, errs[i])
+			}
+		}
+
+		w.fault.failure(err)
 	}
 
 	w.setLastUseTime()
-	return nil
+	return err
 }
 
-func (w *Wire) read() error {
+// 读取标签并写入缓存，返回质量为坏的标签数量
+func (w *Wire) read(tags []device.Tag) (int, error) {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
-	err := w.conn.Read(w.tags)
+	ctx, cancel := w.opContext(w.readTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := w.conn.ReadContext(ctx, tags)
+	now := time.Now()
+
 	if err != nil {
+		w.stats.read(len(tags), 0, now.Sub(start), err, now)
 		log.Suger.Debugf("read: %v", err)
-		return err
+		return 0, err
 	}
 
-	for i := 0; i < len(w.tags); i++ {
-		if w.tags[i].Value != nil {
-			w.tags[i].ReadConvert()
-			CacheSet(w.tags[i].ID, w.tags[i].Value)
+	bad := 0
+
+	for i := 0; i < len(tags); i++ {
+		if tags[i].Value == nil {
+			CacheSetTagQuality(&tags[i], QualityBadDeviceFailure)
+			bad++
+			continue
+		}
+
+		quality := QualityGood
+		if outOfRange(&tags[i], tags[i].Value) {
+			quality = QualityUncertainOutOfRange
 		}
+
+		tags[i].ReadConvert()
+
+		CacheReport(&tags[i], Record{
+			Value:      tags[i].Value,
+			Quality:    quality,
+			SourceTime: tags[i].SourceTime,
+			RecvTime:   now,
+		}, w.deadbands[tags[i].ID])
+
+		tags[i].SourceTime = time.Time{}
 	}
 
+	w.stats.read(len(tags), bad, now.Sub(start), nil, now)
+
 	w.setLastUseTime()
-	return nil
+	return bad, nil
 }
 
 func (w *Wire) setLastUseTime() {
@@ -140,9 +399,23 @@ func (w *Wire) writeLoop() {
 		select {
 		case <-w.close:
 			return
-		case msg := <-w.out:
+		case req := <-w.out:
+			// 调用者已经放弃的写入不再执行
+			if req.ctx != nil && req.ctx.Err() != nil {
+				req.done <- req.ctx.Err()
+				continue
+			}
+
+			err = w.write(req.tags)
+
+			if req.done != nil {
+				req.done <- err
+			}
+
+			if _, ok := err.(TagErrors); ok {
+				err = nil
+			}
 
-			err = w.write(msg)
 			if err != nil {
 				return
 			}
@@ -150,26 +423,191 @@ func (w *Wire) writeLoop() {
 	}
 }
 
-func (w *Wire) readLoop() {
+// 运行所有扫描类的读取，重新加载标签时重启
+func (w *Wire) scan() {
+	defer func() {
+		w.wg.Done()
+		log.Logger.Debug("scan thread exit")
+	}()
+
+	for {
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+
+		classes := w.scanClasses()
+		wg.Add(len(classes))
+		for _, class := range classes {
+			go w.readLoop(class, stop, &wg)
+		}
+
+		select {
+		case <-w.close:
+			wg.Wait()
+			return
+		case req := <-w.reload:
+			close(stop)
+			wg.Wait()
+
+			w.apply(req.tags)
+			close(req.done)
+		}
+	}
+}
+
+func (w *Wire) readLoop(class *scanClass, stop chan struct{}, wg *sync.WaitGroup) {
 	var err error
+	stopped := false
 
 	defer func() {
 		if re := recover(); re != nil {
 			err = errors.New(fmt.Sprint(re))
 		}
-		w.setError(err)
-		w.wg.Done()
-		log.Logger.Debug("read loop thread exit")
+		// 重新加载时停止，不关闭连接
+		if !stopped || err != nil {
+			w.setError(err)
+		}
+		wg.Done()
+		log.Logger.Debug("read loop thread exit", zap.String("class", class.name))
 	}()
 
+	next := time.Now().Add(class.interval)
+	timer := time.NewTimer(class.interval)
+	defer timer.Stop()
+
 	for {
-		time.Sleep(w.readInterval)
-		log.Suger.Debugf("read, id: %s", w.slotID)
-		err = w.read()
+		select {
+		case <-w.close:
+			return
+		case <-stop:
+			stopped = true
+			return
+		case <-timer.C:
+		}
+
+		log.Suger.Debugf("read, id: %s, class: %s", w.slotID, class.name)
+
+		var bad int
+
+		start := time.Now()
+		bad, err = w.read(class.tags)
 		if err != nil {
 			return
 		}
+
+		duration := time.Since(start)
+		overrun := class.record(start, duration, bad)
+
+		w.fault.healthy(w.badShare())
+
+		if overrun {
+			log.Suger.Debugf("read overrun, id: %s, class: %s, interval: %v, duration: %v", w.slotID, class.name, class.interval, duration)
+		}
+
+		// 超时时跳过错过的周期
+		next = next.Add(class.interval)
+		if now := time.Now(); next.Before(now) {
+			next = now.Add(class.interval - now.Sub(next)%class.interval)
+		}
+
+		timer.Reset(time.Until(next))
+	}
+}
+
+// 重新加载标签，不断开连接。读取暂停，直到新的扫描类开始运行
+func (w *Wire) Reload(tags []device.Tag) error {
+	req := reloadRequest{tags: tags, done: make(chan struct{})}
+
+	select {
+	case w.reload <- req:
+	case <-w.close:
+		return ErrSlotOffline
+	}
+
+	select {
+	case <-req.done:
+		return nil
+	case <-w.close:
+		return ErrSlotOffline
+	}
+}
+
+// 替换扫描类和死区，保留名称和周期不变的扫描类的统计
+func (w *Wire) apply(tags []device.Tag) {
+	classes := buildScanClasses(w.slot, tags, w.readInterval)
+
+	old := make(map[string]*scanClass)
+	for _, class := range w.scanClasses() {
+		old[class.name] = class
+	}
+
+	ids := make(map[string]struct{}, len(tags))
+	for i := 0; i < len(tags); i++ {
+		ids[tags[i].ID] = struct{}{}
+	}
+
+	for _, class := range classes {
+		if o, ok := old[class.name]; ok && o.interval == class.interval {
+			class.stats = o.Stats()
+		}
+
+		for i := 0; i < len(class.tags); i++ {
+			if _, ok := CacheGetRecord(class.tags[i].ID); !ok {
+				CacheSetTagQuality(&class.tags[i], QualityBadNotYetRead)
+			}
+		}
+	}
+
+	// 删除的标签不再保留缓存
+	for _, class := range old {
+		for i := 0; i < len(class.tags); i++ {
+			if _, ok := ids[class.tags[i].ID]; !ok {
+				CacheDel(class.tags[i].ID)
+			}
+		}
+	}
+
+	w.lock.Lock()
+	w.deadbands = buildDeadbands(tags)
+	w.lock.Unlock()
+
+	w.classLock.Lock()
+	w.classes = classes
+	w.classLock.Unlock()
+
+	log.Suger.Debugf("wire reload, id: %v, tags: %v", w.slotID, len(tags))
+}
+
+// 读写统计
+func (w *Wire) Stats() WireStats {
+	return w.stats.Stats()
+}
+
+// 各扫描类的统计
+func (w *Wire) ScanStats() []ScanStats {
+	classes := w.scanClasses()
+
+	stats := make([]ScanStats, 0, len(classes))
+	for _, class := range classes {
+		stats = append(stats, class.Stats())
+	}
+
+	return stats
+}
+
+// 所有扫描类最近一次读取中，质量为坏的标签比例
+func (w *Wire) badShare() float64 {
+	bad, total := 0, 0
+	for _, class := range w.scanClasses() {
+		stats := class.Stats()
+		bad += stats.Bad
+		total += stats.Tags
+	}
+
+	if total == 0 {
+		return 0
 	}
+
+	return float64(bad) / float64(total)
 }
 
 func (w *Wire) errorWatch() {
@@ -183,6 +621,7 @@ func (w *Wire) errorWatch() {
 		return
 	case err := <-w.error: //有错误关闭
 		w.err = err
+		w.cancel() // 取消进行中的读写
 		w.lock.Lock()
 		w.conn.Close()
 		w.lock.Unlock()
@@ -193,7 +632,7 @@ func (w *Wire) errorWatch() {
 
 func (w *Wire) free() {
 	defer func() {
-		w.setError(errors.New("free"))
+		w.setError(errWireIdle)
 		w.wg.Done()
 		log.Logger.Debug("free thread exit")
 	}()
@@ -205,7 +644,7 @@ func (w *Wire) free() {
 		case <-w.close:
 			return
 		case t := <-ticker.C:
-			if t.Sub(w.lastUseTime) > w.keepalive {
+			if t.Sub(w.LastUseTime()) > w.idleTimeout() {
 				return
 			}
 		}
@@ -216,19 +655,80 @@ func (w *Wire) Send(tags []device.Tag) {
 	select {
 	case <-w.close:
 		return
-	case w.out <- tags:
+	case w.out <- writeRequest{tags: tags}:
 		log.Suger.Debugf("send tags: %v", tags)
 	}
 }
 
+// 写入并等待结果，写入队列满时立即返回 ErrWriteQueueFull，
+// 连接断开时返回 ErrSlotOffline，部分标签失败时返回 TagErrors
+func (w *Wire) SendContext(ctx context.Context, tags []device.Tag) error {
+	req := writeRequest{ctx: ctx, tags: tags, done: make(chan error, 1)}
+
+	select {
+	case <-w.close:
+		return ErrSlotOffline
+	default:
+	}
+
+	select {
+	case w.out <- req:
+		log.Suger.Debugf("send tags: %v", tags)
+	case <-w.close:
+		return ErrSlotOffline
+	default:
+		return ErrWriteQueueFull
+	}
+
+	select {
+	case err := <-req.done:
+		return err
+	case <-w.close:
+		// 连接断开前可能已经写入
+		select {
+		case err := <-req.done:
+			return err
+		default:
+			return ErrSlotOffline
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 将所有标签标记为指定质量，保留最后的值
+func (w *Wire) markQuality(quality Quality) {
+	for _, class := range w.scanClasses() {
+		for i := 0; i < len(class.tags); i++ {
+			CacheSetTagQuality(&class.tags[i], quality)
+		}
+	}
+}
+
 func (w *Wire) Run() {
 	log.Suger.Debugf("wire run, id: %v", w.slotID)
 	defer close(w.closeComplete)
+	defer w.cancel()
+
+	w.stats.connected(w.counter, time.Now())
+	defer w.stats.disconnected()
+
+	// 没有缓存的标签为尚未读取
+	for _, class := range w.scanClasses() {
+		for i := 0; i < len(class.tags); i++ {
+			if _, ok := CacheGetRecord(class.tags[i].ID); !ok {
+				CacheSetTagQuality(&class.tags[i], QualityBadNotYetRead)
+			}
+		}
+	}
+
+	// 连接断开后，所有标签的质量为通信中断
+	defer w.markQuality(QualityBadCommFailure)
 
 	w.wg.Add(4)
 
 	go w.errorWatch()
-	go w.readLoop()
+	go w.scan()
 	go w.writeLoop()
 	go w.free()
 
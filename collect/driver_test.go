@@ -0,0 +1,188 @@
+package collect
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/danclive/july/device"
+	"github.com/danclive/nson-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// 每个标签读写耗时 delay，并记录读取次数和写入的值，地址为 fail 的标签读写失败
+type fakeDriver struct {
+	lock   sync.Mutex
+	delay  time.Duration
+	reads  map[string]int
+	writes map[string]nson.Value
+}
+
+func (f *fakeDriver) Connect(slot device.Slot) (Driver, error) { return f, nil }
+func (f *fakeDriver) Close() error                             { return nil }
+func (f *fakeDriver) Name() string                             { return "FAKE" }
+
+func (f *fakeDriver) Read(tags []device.Tag) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for i := 0; i < len(tags); i++ {
+		time.Sleep(f.delay)
+		f.reads[tags[i].Name]++
+		tags[i].Value = nil
+
+		if tags[i].Address != "fail" {
+			tags[i].Value = nson.I32(f.reads[tags[i].Name])
+		}
+	}
+
+	return nil
+}
+
+func (f *fakeDriver) Write(tags []device.Tag) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	errs := make(TagErrors, len(tags))
+
+	for i := 0; i < len(tags); i++ {
+		time.Sleep(f.delay)
+
+		if tags[i].Address == "fail" {
+			errs[i] = errors.New("write failed")
+			continue
+		}
+
+		if f.writes != nil {
+			f.writes[tags[i].Name] = tags[i].Value
+		}
+	}
+
+	return errs.Err()
+}
+
+func (f *fakeDriver) Reads(name string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.reads[name]
+}
+
+func (f *fakeDriver) Written(name string) nson.Value {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.writes[name]
+}
+
+func TestTagErrors(t *testing.T) {
+	assert.Nil(t, make(TagErrors, 2).Err())
+	assert.Nil(t, TagErrors(nil).Err())
+
+	errs := TagErrors{nil, errors.New("a"), errors.New("b")}
+	assert.NotNil(t, errs.Err())
+	assert.Contains(t, errs.Error(), "2 of 3 tags failed")
+}
+
+func TestWireSendContext(t *testing.T) {
+	initCache()
+
+	driver := &fakeDriver{reads: make(map[string]int), writes: make(map[string]nson.Value)}
+	tags := []device.Tag{{ID: "a", Name: "a", Address: "fail"}}
+
+	wire := NewWire(driver, device.Slot{ID: "1"}, tags, time.Minute, time.Hour)
+	go wire.Run()
+
+	ctx := context.Background()
+
+	err := wire.SendContext(ctx, []device.Tag{{Name: "b", Value: nson.I32(1)}})
+	assert.Nil(t, err)
+	assert.Exactly(t, nson.I32(1), driver.Written("b"))
+
+	err = wire.SendContext(ctx, []device.Tag{
+		{Name: "b", Value: nson.I32(2)},
+		{Name: "c", Address: "fail", Value: nson.I32(3)},
+	})
+	errs, ok := err.(TagErrors)
+	assert.True(t, ok)
+	assert.Exactly(t, 2, len(errs))
+	assert.Nil(t, errs[0])
+	assert.NotNil(t, errs[1])
+	assert.Exactly(t, nson.I32(2), driver.Written("b"))
+
+	// 部分标签失败不会断开连接
+	err = wire.SendContext(ctx, []device.Tag{{Name: "b", Value: nson.I32(4)}})
+	assert.Nil(t, err)
+
+	// 写入超时，请求仍然留在队列中
+	driver.lock.Lock()
+	driver.delay = time.Millisecond * 50
+	driver.lock.Unlock()
+
+	var last error
+	for i := 0; i < 20 && last != ErrWriteQueueFull; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		last = wire.SendContext(ctx, []device.Tag{{Name: "d", Value: nson.I32(i)}})
+		cancel()
+
+		if last != ErrWriteQueueFull {
+			assert.Exactly(t, context.DeadlineExceeded, last)
+		}
+	}
+	assert.Exactly(t, ErrWriteQueueFull, last)
+
+	<-wire.Close()
+	assert.Exactly(t, ErrSlotOffline, wire.SendContext(ctx, []device.Tag{{Name: "b", Value: nson.I32(5)}}))
+}
+
+func TestWithContext(t *testing.T) {
+	driver := &fakeDriver{delay: time.Millisecond * 200, reads: make(map[string]int)}
+	conn := WithContext(driver)
+
+	tags := []device.Tag{{Name: "a"}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+
+	start := time.Now()
+	assert.Exactly(t, context.DeadlineExceeded, conn.ReadContext(ctx, tags))
+	assert.True(t, time.Since(start) < time.Millisecond*150)
+	assert.Nil(t, tags[0].Value)
+
+	// 等待上一次读取返回
+	assert.Nil(t, conn.ReadContext(context.Background(), tags))
+	assert.Exactly(t, nson.I32(2), tags[0].Value)
+
+	// 已经实现 ContextDriver 的驱动直接返回
+	http := &Http{}
+	assert.True(t, WithContext(http) == ContextDriver(http))
+}
+
+func TestWireCloseCancel(t *testing.T) {
+	initCache()
+
+	driver := &fakeDriver{delay: time.Second, reads: make(map[string]int)}
+	tags := []device.Tag{{ID: "a", Name: "a"}}
+
+	wire := NewWire(driver, device.Slot{ID: "1", Params: "read_timeout=0s"}, tags, time.Minute, time.Millisecond*10)
+	go wire.Run()
+
+	// 读取阻塞时关闭连接
+	time.Sleep(time.Millisecond * 50)
+
+	start := time.Now()
+	<-wire.Close()
+	assert.True(t, time.Since(start) < time.Millisecond*500)
+	record, _ := CacheGetRecord("a")
+	assert.Exactly(t, QualityBadCommFailure, record.Quality)
+
+	// 读取超时时连接断开
+	wire = NewWire(driver, device.Slot{ID: "1", Params: "read_timeout=50ms"}, tags, time.Minute, time.Millisecond*10)
+
+	start = time.Now()
+	wire.Run()
+	assert.True(t, time.Since(start) < time.Second*2)
+	assert.Exactly(t, context.DeadlineExceeded, wire.err)
+}
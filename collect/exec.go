@@ -0,0 +1,404 @@
+package collect
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/danclive/july/device"
+	"github.com/danclive/july/log"
+	"github.com/danclive/july/util"
+)
+
+func init() {
+	RegisterDriver(device.DriverExec, &Exec{})
+}
+
+// EXEC 驱动启动外部程序作为适配器，通过标准输入输出交换以换行分隔的 JSON 消息，
+// 适配器可以用任何语言编写，崩溃时只会断开连接，由采集服务重新启动。
+//
+// 请求写入适配器的标准输入，每行一个：
+//
+//	{"id":1,"method":"connect","slot":{"id":"..","name":"..","model":"..","params":"..","cfg":".."}}
+//	{"id":2,"method":"read","tags":[{"id":"..","name":"..","address":"..","dtype":"F32"}]}
+//	{"id":3,"method":"write","tags":[{"id":"..","name":"..","address":"..","dtype":"F32","value":1.5}]}
+//	{"id":4,"method":"close"}
+//
+// 适配器从标准输出按行返回响应，id 与请求相同：
+//
+//	{"id":1}
+//	{"id":2,"values":[1.5,null],"errors":["","timeout"]}
+//	{"id":3,"errors":[""]}
+//
+// error 不为空时表示连接故障，采集服务会关闭适配器并重新连接；
+// values 和 errors 与 tags 一一对应，值为 null 或 errors 不为空表示该标签读写失败。
+// 适配器写入标准错误的内容会记录到日志。收到 close 请求或标准输入关闭时适配器应退出。
+//
+// Slot.Params，例如：cmd=/opt/july/adapter&arg=-v&env=PORT=/dev/ttyS0&timeout=5s
+// 完整的 Slot.Params 也会在 connect 请求中发送给适配器，适配器可以使用自己的参数。
+type execParams struct {
+	Cmd     string        `cfg:"cmd"`
+	Args    []string      `cfg:"arg"`
+	Env     []string      `cfg:"env"`
+	Dir     string        `cfg:"dir"`
+	Timeout time.Duration `cfg:"timeout,default=5s"`
+}
+
+const (
+	ExecMethodConnect = "connect"
+	ExecMethodRead    = "read"
+	ExecMethodWrite   = "write"
+	ExecMethodClose   = "close"
+)
+
+// 适配器单行消息的最大长度
+const execMaxLine = 16 * 1024 * 1024
+
+type ExecSlot struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Model  string `json:"model"`
+	Params string `json:"params"`
+	Config string `json:"cfg"`
+}
+
+type ExecTag struct {
+	ID       string      `json:"id"`
+	Name     string      `json:"name"`
+	Address  string      `json:"address"`
+	DataType string      `json:"dtype"`
+	Value    interface{} `json:"value,omitempty"`
+}
+
+type ExecRequest struct {
+	ID     uint64    `json:"id"`
+	Method string    `json:"method"`
+	Slot   *ExecSlot `json:"slot,omitempty"`
+	Tags   []ExecTag `json:"tags,omitempty"`
+}
+
+type ExecResponse struct {
+	ID     uint64            `json:"id"`
+	Error  string            `json:"error,omitempty"`
+	Values []json.RawMessage `json:"values,omitempty"`
+	Errors []string          `json:"errors,omitempty"`
+}
+
+type Exec struct {
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	tracer    *Tracer
+	timeout   time.Duration
+	id        uint64
+	responses chan *ExecResponse
+	done      chan struct{}
+	err       error
+	closeOnce sync.Once
+}
+
+var _ Driver = &Exec{}
+
+func (e *Exec) Connect(slot device.Slot) (Driver, error) {
+	var params execParams
+
+	u, err := url.ParseQuery(slot.Params)
+	if err != nil {
+		return nil, err
+	}
+
+	err = util.MapConfig(&params, u)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.Cmd == "" {
+		return nil, errors.New("exec: cmd is required")
+	}
+
+	cmd := exec.Command(params.Cmd, params.Args...)
+	cmd.Dir = params.Dir
+	cmd.Env = append(os.Environ(), params.Env...)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	conn := &Exec{
+		cmd:       cmd,
+		stdin:     stdin,
+		tracer:    traceFor(slot.ID),
+		timeout:   params.Timeout,
+		responses: make(chan *ExecResponse, 1),
+		done:      make(chan struct{}),
+	}
+
+	go conn.logStderr(slot.Name, stderr)
+	go conn.recv(stdout)
+
+	_, err = conn.call(&ExecRequest{
+		Method: ExecMethodConnect,
+		Slot: &ExecSlot{
+			ID:     slot.ID,
+			Name:   slot.Name,
+			Model:  slot.Model,
+			Params: slot.Params,
+			Config: slot.Config,
+		},
+	})
+	if err != nil {
+		conn.kill()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (e *Exec) logStderr(name string, stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		log.Suger.Warnf("exec %v: %s", name, scanner.Bytes())
+	}
+}
+
+func (e *Exec) recv(stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), execMaxLine)
+
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		e.tracer.RX(scanner.Bytes())
+
+		resp := &ExecResponse{}
+		if err := json.Unmarshal(scanner.Bytes(), resp); err != nil {
+			e.err = fmt.Errorf("exec: invalid response: %v", err)
+			e.kill()
+			break
+		}
+
+		// 只保留最新的响应，超时请求的响应会被丢弃
+		for sent := false; !sent; {
+			select {
+			case e.responses <- resp:
+				sent = true
+			default:
+				select {
+				case <-e.responses:
+				default:
+				}
+			}
+		}
+	}
+
+	err := e.cmd.Wait()
+
+	if e.err == nil {
+		if err == nil {
+			err = scanner.Err()
+		}
+
+		if err == nil {
+			err = io.EOF
+		}
+
+		e.err = fmt.Errorf("exec: adapter exited: %v", err)
+	}
+
+	e.closeOnce.Do(func() { close(e.done) })
+}
+
+func (e *Exec) kill() {
+	if e.cmd.Process != nil {
+		e.cmd.Process.Kill()
+	}
+}
+
+func (e *Exec) call(req *ExecRequest) (*ExecResponse, error) {
+	e.id++
+	req.ID = e.id
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-e.done:
+		return nil, e.err
+	default:
+	}
+
+	e.tracer.TX(data)
+
+	if _, err := e.stdin.Write(append(data, '\n')); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(e.timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case resp := <-e.responses:
+			// 丢弃超时请求的响应
+			if resp.ID != req.ID {
+				continue
+			}
+
+			if resp.Error != "" {
+				return nil, errors.New(resp.Error)
+			}
+
+			return resp, nil
+		case <-e.done:
+			return nil, e.err
+		case <-timer.C:
+			e.kill()
+			return nil, fmt.Errorf("exec: %v timeout", req.Method)
+		}
+	}
+}
+
+func (e *Exec) Close() error {
+	select {
+	case <-e.done:
+		return nil
+	default:
+	}
+
+	_, err := e.call(&ExecRequest{Method: ExecMethodClose})
+	e.stdin.Close()
+
+	select {
+	case <-e.done:
+	case <-time.After(e.timeout):
+		e.kill()
+		<-e.done
+	}
+
+	return err
+}
+
+func (e *Exec) Name() string {
+	return device.DriverExec
+}
+
+func execTags(tags []device.Tag) []ExecTag {
+	list := make([]ExecTag, len(tags))
+	for i := 0; i < len(tags); i++ {
+		list[i] = ExecTag{
+			ID:       tags[i].ID,
+			Name:     tags[i].Name,
+			Address:  tags[i].Address,
+			DataType: tags[i].DataType,
+		}
+	}
+
+	return list
+}
+
+func (e *Exec) Read(tags []device.Tag) error {
+	resp, err := e.call(&ExecRequest{Method: ExecMethodRead, Tags: execTags(tags)})
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(tags); i++ {
+		tags[i].Value = nil
+
+		if i < len(resp.Errors) && resp.Errors[i] != "" {
+			log.Suger.Warnf("tag: %v(%v): %v", tags[i].Name, tags[i].ID, resp.Errors[i])
+			continue
+		}
+
+		if i >= len(resp.Values) {
+			continue
+		}
+
+		v, err := decodeJSON(resp.Values[i])
+		if err != nil {
+			log.Suger.Warnf("tag: %v(%v): %v", tags[i].Name, tags[i].ID, err)
+			continue
+		}
+
+		if v == nil {
+			continue
+		}
+
+		value, err := valueFromJSON(tags[i].DataType, v)
+		if err != nil {
+			log.Suger.Warnf("tag: %v(%v): %v", tags[i].Name, tags[i].ID, err)
+			continue
+		}
+
+		tags[i].Value = value
+	}
+
+	return nil
+}
+
+func (e *Exec) Write(tags []device.Tag) error {
+	errs := make(TagErrors, len(tags))
+
+	list := make([]ExecTag, 0, len(tags))
+	index := make([]int, 0, len(tags))
+
+	for i := 0; i < len(tags); i++ {
+		if tags[i].Value == nil {
+			continue
+		}
+
+		v, err := valueToJSON(tags[i].Value)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		tag := execTags(tags[i : i+1])[0]
+		tag.Value = v
+
+		list = append(list, tag)
+		index = append(index, i)
+	}
+
+	if len(list) == 0 {
+		return errs.Err()
+	}
+
+	resp, err := e.call(&ExecRequest{Method: ExecMethodWrite, Tags: list})
+	if err != nil {
+		return err
+	}
+
+	for i, j := range index {
+		if i < len(resp.Errors) && resp.Errors[i] != "" {
+			errs[j] = errors.New(resp.Errors[i])
+		}
+	}
+
+	return errs.Err()
+}
@@ -0,0 +1,111 @@
+package collect
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/danclive/july/device"
+	"github.com/danclive/nson-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// 作为 EXEC 驱动的适配器运行，由 TestExec 启动
+func TestExecHelperProcess(t *testing.T) {
+	if os.Getenv("JULY_EXEC_HELPER") != "1" {
+		return
+	}
+
+	values := map[string]interface{}{"temp": 21.5, "name": "pump"}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	encoder := json.NewEncoder(os.Stdout)
+
+	for scanner.Scan() {
+		var req ExecRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+
+		resp := map[string]interface{}{"id": req.ID}
+
+		switch req.Method {
+		case ExecMethodRead:
+			list := make([]interface{}, len(req.Tags))
+			errs := make([]string, len(req.Tags))
+			for i, tag := range req.Tags {
+				if v, ok := values[tag.Address]; ok {
+					list[i] = v
+				} else {
+					errs[i] = "unknown address"
+				}
+			}
+			resp["values"] = list
+			resp["errors"] = errs
+		case ExecMethodWrite:
+			for _, tag := range req.Tags {
+				if tag.Address == "crash" {
+					os.Exit(3)
+				}
+				values[tag.Address] = tag.Value
+			}
+		case ExecMethodClose:
+			encoder.Encode(resp)
+			os.Exit(0)
+		}
+
+		encoder.Encode(resp)
+	}
+
+	os.Exit(0)
+}
+
+func TestExec(t *testing.T) {
+	slot := device.Slot{
+		Name:   "exec",
+		Driver: device.DriverExec,
+		Params: "cmd=" + os.Args[0] + "&arg=-test.run=TestExecHelperProcess&env=JULY_EXEC_HELPER=1",
+	}
+
+	conn, err := (&Exec{}).Connect(slot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags := []device.Tag{
+		{Name: "temp", Address: "temp", DataType: device.TypeF32},
+		{Name: "name", Address: "name", DataType: device.TypeString},
+		{Name: "unknown", Address: "unknown", DataType: device.TypeI32},
+	}
+
+	assert.Nil(t, conn.Read(tags))
+	assert.Exactly(t, nson.F32(21.5), tags[0].Value)
+	assert.Exactly(t, nson.String("pump"), tags[1].Value)
+	assert.Nil(t, tags[2].Value)
+
+	err = conn.Write([]device.Tag{
+		{Name: "temp", Address: "temp", DataType: device.TypeF32, Value: nson.F32(30)},
+	})
+	assert.Nil(t, err)
+
+	assert.Nil(t, conn.Read(tags))
+	assert.Exactly(t, nson.F32(30), tags[0].Value)
+
+	assert.Nil(t, conn.Close())
+
+	// 适配器崩溃时返回错误
+	conn, err = (&Exec{}).Connect(slot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = conn.Write([]device.Tag{
+		{Name: "crash", Address: "crash", DataType: device.TypeI32, Value: nson.I32(1)},
+	})
+	assert.NotNil(t, err)
+	assert.NotNil(t, conn.Read(tags))
+	assert.Nil(t, conn.Close())
+}
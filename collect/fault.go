@@ -0,0 +1,157 @@
+package collect
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/danclive/july/device"
+	"github.com/danclive/july/log"
+	"github.com/danclive/march/consts"
+)
+
+// 检测 slot 的故障：连续错误达到 fault_errors 次，或者质量为坏的标签比例达到 fault_bad_pct，
+// 读取成功且质量为坏的标签比例低于 fault_bad_pct 时清除故障。
+// 故障状态变化时在锁外调用 notify，notify 可能写数据库，不阻塞读写线程更新状态。
+type faultMonitor struct {
+	lock    sync.Mutex
+	errors  int // 连续错误次数
+	faulted bool
+	reason  string
+
+	notifyLock sync.Mutex
+	notified   bool // 最后一次通知的状态
+
+	maxErrors int
+	badPct    float64
+	notify    func(faulted bool, reason string)
+}
+
+func newFaultMonitor(faulted bool, notify func(faulted bool, reason string)) *faultMonitor {
+	return &faultMonitor{
+		faulted:   faulted,
+		notified:  faulted,
+		maxErrors: 3,
+		notify:    notify,
+	}
+}
+
+// 更新检测的配置
+func (f *faultMonitor) configure(config device.SlotConfig) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.maxErrors = config.FaultErrors
+	f.badPct = config.FaultBadPct
+}
+
+// 更新状态，返回状态是否变化，调用时需要持有 f.lock
+func (f *faultMonitor) set(faulted bool, reason string) bool {
+	if f.faulted == faulted {
+		return false
+	}
+
+	f.faulted = faulted
+	f.reason = reason
+
+	return true
+}
+
+// 通知当前的状态，并发变化时按最后的状态通知，避免先后顺序颠倒
+func (f *faultMonitor) flush() {
+	f.notifyLock.Lock()
+	defer f.notifyLock.Unlock()
+
+	f.lock.Lock()
+	faulted, reason := f.faulted, f.reason
+	f.lock.Unlock()
+
+	if f.notified == faulted {
+		return
+	}
+
+	f.notified = faulted
+
+	if f.notify != nil {
+		f.notify(faulted, reason)
+	}
+}
+
+// 记录一次错误
+func (f *faultMonitor) failure(err error) {
+	if f == nil {
+		return
+	}
+
+	f.lock.Lock()
+	f.errors++
+
+	changed := false
+	if f.maxErrors > 0 && f.errors >= f.maxErrors {
+		changed = f.set(true, fmt.Sprintf("%v consecutive errors: %v", f.errors, err))
+	}
+	f.lock.Unlock()
+
+	if changed {
+		f.flush()
+	}
+}
+
+// 记录一次成功的读取，bad 为质量为坏的标签比例（0～1）
+func (f *faultMonitor) healthy(bad float64) {
+	if f == nil {
+		return
+	}
+
+	f.lock.Lock()
+	f.errors = 0
+
+	var changed bool
+	if f.badPct > 0 && bad*100 >= f.badPct {
+		changed = f.set(true, fmt.Sprintf("%.0f%% tags bad quality", bad*100))
+	} else {
+		changed = f.set(false, "recovered")
+	}
+	f.lock.Unlock()
+
+	if changed {
+		f.flush()
+	}
+}
+
+func (f *faultMonitor) Faulted() (bool, string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.faulted, f.reason
+}
+
+// slot 的故障检测，不存在时创建，并更新为 slot 当前的配置
+func (c *Service) faultMonitor(slot device.Slot) *faultMonitor {
+	c.faultLock.Lock()
+	monitor, ok := c.faults[slot.ID]
+	if !ok {
+		slotID := slot.ID
+		monitor = newFaultMonitor(slot.Fault == consts.ON, func(faulted bool, reason string) {
+			if faulted {
+				log.Suger.Warnf("slot: %v fault: %v", slotID, reason)
+			} else {
+				log.Suger.Infof("slot: %v fault cleared", slotID)
+			}
+
+			if err := device.GetService().SlotFault(slotID, faulted, reason); err != nil {
+				log.Suger.Error(err)
+			}
+		})
+		c.faults[slot.ID] = monitor
+	}
+	c.faultLock.Unlock()
+
+	config, err := slot.ParseConfig()
+	if err != nil {
+		log.Suger.Warnf("slot: %v(%v) config: %v", slot.Name, slot.ID, err)
+	}
+
+	monitor.configure(config)
+
+	return monitor
+}
@@ -0,0 +1,151 @@
+package collect
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/danclive/july/device"
+	"github.com/stretchr/testify/assert"
+)
+
+type faultEvents struct {
+	lock   sync.Mutex
+	events []bool
+}
+
+func (f *faultEvents) notify(faulted bool, reason string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.events = append(f.events, faulted)
+}
+
+func (f *faultEvents) list() []bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return append([]bool{}, f.events...)
+}
+
+func TestFaultMonitor(t *testing.T) {
+	events := &faultEvents{}
+
+	monitor := newFaultMonitor(false, events.notify)
+	monitor.configure(device.SlotConfig{FaultErrors: 3, FaultBadPct: 50})
+
+	err := errors.New("refused")
+
+	monitor.failure(err)
+	monitor.failure(err)
+	monitor.healthy(0)
+	monitor.failure(err)
+	monitor.failure(err)
+	assert.Empty(t, events.list())
+
+	monitor.failure(err)
+	faulted, reason := monitor.Faulted()
+	assert.True(t, faulted)
+	assert.Exactly(t, "3 consecutive errors: refused", reason)
+
+	monitor.failure(err)
+	monitor.healthy(0.2)
+	monitor.healthy(0.5)
+	faulted, reason = monitor.Faulted()
+	assert.True(t, faulted)
+	assert.Exactly(t, "50% tags bad quality", reason)
+
+	monitor.healthy(0.1)
+	assert.Exactly(t, []bool{true, false, true, false}, events.list())
+
+	// 不检测
+	monitor.configure(device.SlotConfig{})
+	for i := 0; i < 10; i++ {
+		monitor.failure(err)
+	}
+	monitor.healthy(1)
+	assert.Exactly(t, 4, len(events.list()))
+
+	// 已经标记为故障的 slot 恢复后清除
+	events = &faultEvents{}
+	monitor = newFaultMonitor(true, events.notify)
+	monitor.healthy(0)
+	assert.Exactly(t, []bool{false}, events.list())
+
+	var nilMonitor *faultMonitor
+	nilMonitor.failure(err)
+	nilMonitor.healthy(0)
+}
+
+func TestFaultMonitorSlowNotify(t *testing.T) {
+	events := &faultEvents{}
+	release := make(chan struct{})
+
+	monitor := newFaultMonitor(false, func(faulted bool, reason string) {
+		<-release
+		events.notify(faulted, reason)
+	})
+	monitor.configure(device.SlotConfig{FaultErrors: 1})
+
+	err := errors.New("refused")
+
+	done := make(chan struct{})
+	go func() {
+		monitor.failure(err)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		faulted, _ := monitor.Faulted()
+		return faulted
+	}, time.Second, time.Millisecond)
+
+	// notify 阻塞时，状态不变的读写不等待
+	returned := make(chan struct{})
+	go func() {
+		monitor.failure(err)
+		monitor.Faulted()
+		close(returned)
+	}()
+
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("blocked by notify")
+	}
+
+	close(release)
+	<-done
+
+	monitor.healthy(0)
+	assert.Exactly(t, []bool{true, false}, events.list())
+}
+
+func TestWireFault(t *testing.T) {
+	initCache()
+
+	driver := &fakeDriver{reads: make(map[string]int)}
+	slot := device.Slot{ID: "1", Config: "fault_bad_pct=50"}
+	tags := []device.Tag{
+		{ID: "a", Name: "a"},
+		{ID: "b", Name: "b", Address: "fail"},
+	}
+
+	config, err := slot.ParseConfig()
+	assert.Nil(t, err)
+	assert.Exactly(t, 3, config.FaultErrors)
+
+	events := &faultEvents{}
+
+	wire := NewWire(driver, slot, tags, time.Minute, time.Millisecond*10)
+	wire.fault = newFaultMonitor(false, events.notify)
+	wire.fault.configure(config)
+
+	go wire.Run()
+	time.Sleep(time.Millisecond * 100)
+	<-wire.Close()
+
+	assert.Exactly(t, []bool{true}, events.list())
+	assert.Exactly(t, 1, wire.ScanStats()[0].Bad)
+}
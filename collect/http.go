@@ -0,0 +1,415 @@
+package collect
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/danclive/july/device"
+	"github.com/danclive/july/log"
+	"github.com/danclive/july/util"
+)
+
+func init() {
+	RegisterDriver(device.DriverHTTP, &Http{})
+}
+
+// Slot.Params，例如：
+// url=http://192.168.1.10/api&header=X-Key: abc&token=xxx&timeout=3s
+// header 为请求头，格式为 Name: Value，可以有多个；
+// user 和 pass 为 Basic 认证，token 为 Bearer 认证；
+// write_url 和 body 为写入请求的 URL 和请求体模板（text/template），可以使用的字段：
+// .Name、.ID、.Address、.Resource、.Path 以及 .Value（JSON 编码后的值），
+// body 为空时请求体为只包含 JSON 路径和值的文档，例如 {"setpoint":{"temp":25}}。
+type httpParams struct {
+	URL         string        `cfg:"url"`
+	Method      string        `cfg:"method,default=GET"`
+	Headers     []string      `cfg:"header"`
+	User        string        `cfg:"user"`
+	Pass        string        `cfg:"pass"`
+	Token       string        `cfg:"token"`
+	Timeout     time.Duration `cfg:"timeout,default=5s"`
+	Insecure    bool          `cfg:"insecure,default=false"`
+	WriteMethod string        `cfg:"write_method,default=POST"`
+	WriteURL    string        `cfg:"write_url"`
+	Body        string        `cfg:"body"`
+	ContentType string        `cfg:"content_type,default=application/json"`
+}
+
+// HTTP 响应状态错误，只影响本次请求的标签
+type HttpError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *HttpError) Error() string {
+	return fmt.Sprintf("http: %v", e.Status)
+}
+
+// Tag.Address 为资源路径和 JSON 路径，以 # 分隔，例如：data.temp、/status#items[0].value，
+// 资源路径以 / 开头，拼接在 url 后；没有资源路径时请求 url。
+// 同一资源的标签每次读取只请求一次。
+type httpAddress struct {
+	Resource string
+	Path     jsonPath
+	path     string
+}
+
+func parseHttpAddress(address string) (*httpAddress, error) {
+	resource, path := "", address
+	if strings.HasPrefix(address, "/") {
+		resource, path = address, ""
+		if i := strings.Index(address, "#"); i >= 0 {
+			resource, path = address[:i], address[i+1:]
+		}
+	}
+
+	p, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &httpAddress{Resource: resource, Path: p, path: path}, nil
+}
+
+type httpWriteData struct {
+	Name     string
+	ID       string
+	Address  string
+	Resource string
+	Path     string
+	Value    string
+}
+
+type Http struct {
+	client    *http.Client
+	params    httpParams
+	headers   http.Header
+	writeURL  *template.Template
+	body      *template.Template
+	addresses map[string]*httpAddress
+}
+
+var _ Driver = &Http{}
+var _ ContextDriver = &Http{}
+
+func (h *Http) Connect(slot device.Slot) (Driver, error) {
+	var params httpParams
+
+	u, err := url.ParseQuery(slot.Params)
+	if err != nil {
+		return nil, err
+	}
+
+	err = util.MapConfig(&params, u)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := url.ParseRequestURI(params.URL); err != nil {
+		return nil, fmt.Errorf("http: invalid url %q", params.URL)
+	}
+
+	headers := make(http.Header)
+	for _, header := range params.Headers {
+		i := strings.Index(header, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("http: invalid header %q", header)
+		}
+
+		headers.Add(strings.TrimSpace(header[:i]), strings.TrimSpace(header[i+1:]))
+	}
+
+	conn := &Http{
+		params:    params,
+		headers:   headers,
+		addresses: make(map[string]*httpAddress),
+	}
+
+	if params.WriteURL == "" {
+		params.WriteURL = params.URL + "{{.Resource}}"
+	}
+
+	if conn.writeURL, err = template.New("write_url").Parse(params.WriteURL); err != nil {
+		return nil, err
+	}
+
+	if params.Body != "" {
+		if conn.body, err = template.New("body").Parse(params.Body); err != nil {
+			return nil, err
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if params.Insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	conn.client = &http.Client{
+		Timeout:   params.Timeout,
+		Transport: transport,
+	}
+
+	if tracer := traceFor(slot.ID); tracer != nil {
+		tracer.SetPort(httpPort(params.URL))
+		conn.client.Transport = &httpTraceTransport{next: transport, tracer: tracer}
+	}
+
+	return conn, nil
+}
+
+// 把请求和响应按 HTTP/1.1 报文记录为 TX 和 RX，HTTPS 记录的是加密前的报文
+type httpTraceTransport struct {
+	next   http.RoundTripper
+	tracer *Tracer
+}
+
+func (t *httpTraceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.tracer.Enabled() {
+		return t.next.RoundTrip(req)
+	}
+
+	if data, err := httputil.DumpRequestOut(req, true); err == nil {
+		t.tracer.TX(data)
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if data, err := httputil.DumpResponse(resp, true); err == nil {
+		t.tracer.RX(data)
+	}
+
+	return resp, nil
+}
+
+func (t *httpTraceTransport) CloseIdleConnections() {
+	if c, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+func httpPort(rawurl string) int {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return 0
+	}
+
+	if port, err := strconv.Atoi(u.Port()); err == nil {
+		return port
+	}
+
+	if u.Scheme == "https" {
+		return 443
+	}
+
+	return 80
+}
+
+func (h *Http) Close() error {
+	h.client.CloseIdleConnections()
+	return nil
+}
+
+func (h *Http) Name() string {
+	return device.DriverHTTP
+}
+
+func (h *Http) address(address string) (*httpAddress, error) {
+	if a, ok := h.addresses[address]; ok {
+		return a, nil
+	}
+
+	a, err := parseHttpAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	h.addresses[address] = a
+
+	return a, nil
+}
+
+func (h *Http) do(ctx context.Context, method, url string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range h.headers {
+		req.Header[k] = v
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", h.params.ContentType)
+	}
+
+	if h.params.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.params.Token)
+	} else if h.params.User != "" {
+		req.SetBasicAuth(h.params.User, h.params.Pass)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &HttpError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	return data, nil
+}
+
+func (h *Http) Read(tags []device.Tag) error {
+	return h.ReadContext(context.Background(), tags)
+}
+
+func (h *Http) ReadContext(ctx context.Context, tags []device.Tag) error {
+	docs := make(map[string]interface{})
+
+	for i := 0; i < len(tags); i++ {
+		tags[i].Value = nil
+
+		address, err := h.address(tags[i].Address)
+		if err != nil {
+			log.Suger.Warnf("tag: %v(%v): %v", tags[i].Name, tags[i].ID, err)
+			continue
+		}
+
+		doc, ok := docs[address.Resource]
+		if !ok {
+			data, err := h.do(ctx, h.params.Method, h.params.URL+address.Resource, nil)
+			if err != nil {
+				var httpErr *HttpError
+				if errors.As(err, &httpErr) {
+					log.Suger.Warnf("http: %v%v: %v", h.params.URL, address.Resource, err)
+					docs[address.Resource] = nil
+					continue
+				}
+
+				return err
+			}
+
+			if doc, err = decodeJSON(data); err != nil {
+				// 不是 JSON 的响应作为字符串
+				doc = strings.TrimSpace(string(data))
+			}
+
+			docs[address.Resource] = doc
+		}
+
+		if doc == nil {
+			continue
+		}
+
+		v, ok := address.Path.Get(doc)
+		if !ok {
+			continue
+		}
+
+		value, err := valueFromJSON(tags[i].DataType, v)
+		if err != nil {
+			log.Suger.Warnf("tag: %v(%v): %v", tags[i].Name, tags[i].ID, err)
+			continue
+		}
+
+		tags[i].Value = value
+	}
+
+	return nil
+}
+
+func (h *Http) Write(tags []device.Tag) error {
+	return h.WriteContext(context.Background(), tags)
+}
+
+func (h *Http) WriteContext(ctx context.Context, tags []device.Tag) error {
+	errs := make(TagErrors, len(tags))
+
+	for i := 0; i < len(tags); i++ {
+		if tags[i].Value == nil {
+			continue
+		}
+
+		address, err := h.address(tags[i].Address)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		v, err := valueToJSON(tags[i].Value)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		value, err := json.Marshal(v)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		data := httpWriteData{
+			Name:     tags[i].Name,
+			ID:       tags[i].ID,
+			Address:  tags[i].Address,
+			Resource: address.Resource,
+			Path:     address.path,
+			Value:    string(value),
+		}
+
+		var target strings.Builder
+		if err := h.writeURL.Execute(&target, data); err != nil {
+			errs[i] = err
+			continue
+		}
+
+		var body []byte
+		if h.body != nil {
+			var buf bytes.Buffer
+			if err := h.body.Execute(&buf, data); err != nil {
+				errs[i] = err
+				continue
+			}
+			body = buf.Bytes()
+		} else if body, err = json.Marshal(address.Path.Build(v)); err != nil {
+			errs[i] = err
+			continue
+		}
+
+		_, err = h.do(ctx, h.params.WriteMethod, target.String(), bytes.NewReader(body))
+		if err != nil {
+			var httpErr *HttpError
+			if errors.As(err, &httpErr) {
+				errs[i] = err
+				continue
+			}
+
+			return err
+		}
+	}
+
+	return errs.Err()
+}
@@ -0,0 +1,108 @@
+package collect
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/danclive/july/device"
+	"github.com/danclive/nson-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHttp(t *testing.T) {
+	requests := make(map[string]int)
+	writes := make(map[string]string)
+
+	serv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" || r.Header.Get("X-Key") != "abc" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			body, _ := ioutil.ReadAll(r.Body)
+			writes[r.Method+" "+r.URL.Path] = string(body)
+			return
+		}
+
+		requests[r.URL.Path]++
+
+		switch r.URL.Path {
+		case "/api":
+			w.Write([]byte(`{"data":{"temp":21.5,"count":"42"},"items":[{"on":true}]}`))
+		case "/api/status":
+			w.Write([]byte("running\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer serv.Close()
+
+	params := url.Values{}
+	params.Set("url", serv.URL+"/api")
+	params.Set("token", "secret")
+	params.Add("header", "X-Key: abc")
+
+	conn, err := (&Http{}).Connect(device.Slot{Name: "http", Driver: device.DriverHTTP, Params: params.Encode()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tags := []device.Tag{
+		{Name: "temp", Address: "data.temp", DataType: device.TypeF32},
+		{Name: "count", Address: "data.count", DataType: device.TypeU16},
+		{Name: "on", Address: "items[0].on", DataType: device.TypeBool},
+		{Name: "status", Address: "/status", DataType: device.TypeString},
+		{Name: "missing", Address: "/missing#value", DataType: device.TypeF32},
+		{Name: "none", Address: "data.none", DataType: device.TypeF32},
+	}
+
+	assert.Nil(t, conn.Read(tags))
+	assert.Exactly(t, nson.F32(21.5), tags[0].Value)
+	assert.Exactly(t, nson.U32(42), tags[1].Value)
+	assert.Exactly(t, nson.Bool(true), tags[2].Value)
+	assert.Exactly(t, nson.String("running"), tags[3].Value)
+	assert.Nil(t, tags[4].Value)
+	assert.Nil(t, tags[5].Value)
+	assert.Exactly(t, 1, requests["/api"])
+
+	err = conn.Write([]device.Tag{
+		{Name: "setpoint", Address: "/setpoint#value", DataType: device.TypeF32, Value: nson.F32(25)},
+	})
+	assert.Nil(t, err)
+	assert.Exactly(t, `{"value":25}`, writes["POST /api/setpoint"])
+
+	params.Set("write_method", "PUT")
+	params.Set("write_url", serv.URL+"/api/tags/{{.Name}}")
+	params.Set("body", `{"id":"{{.ID}}","value":{{.Value}}}`)
+
+	conn2, err := (&Http{}).Connect(device.Slot{Name: "http", Driver: device.DriverHTTP, Params: params.Encode()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+
+	err = conn2.Write([]device.Tag{
+		{ID: "1", Name: "mode", Address: "mode", DataType: device.TypeString, Value: nson.String("auto")},
+	})
+	assert.Nil(t, err)
+	assert.Exactly(t, `{"id":"1","value":"auto"}`, writes["PUT /api/tags/mode"])
+
+	params.Set("token", "wrong")
+
+	conn3, err := (&Http{}).Connect(device.Slot{Name: "http", Driver: device.DriverHTTP, Params: params.Encode()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn3.Close()
+
+	assert.Nil(t, conn3.Read(tags[:1]))
+	assert.Nil(t, tags[0].Value)
+
+	serv.Close()
+	assert.NotNil(t, conn.Read(tags[:1]))
+}
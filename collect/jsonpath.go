@@ -0,0 +1,214 @@
+package collect
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/danclive/july/device"
+	"github.com/danclive/july/util"
+	"github.com/danclive/nson-go"
+)
+
+// JSON 路径，由对象字段和数组下标组成，例如：data.items[0].value、data.items.0.value，
+// 空路径表示整个文档，字段名中的 . 和 [ 可以用 \ 转义
+type jsonPath []interface{}
+
+func parseJSONPath(path string) (jsonPath, error) {
+	p := make(jsonPath, 0)
+
+	path = strings.TrimPrefix(strings.TrimSpace(path), "$")
+	if path == "" {
+		return p, nil
+	}
+
+	var key []byte
+	hasKey := false
+
+	push := func() {
+		if hasKey {
+			p = append(p, string(key))
+		}
+		key = key[:0]
+		hasKey = false
+	}
+
+	for i := 0; i < len(path); i++ {
+		switch c := path[i]; c {
+		case '\\':
+			if i+1 < len(path) {
+				i++
+				key = append(key, path[i])
+				hasKey = true
+			}
+		case '.':
+			push()
+		case '[':
+			push()
+
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("json path %q: missing ]", path)
+			}
+
+			index, err := strconv.Atoi(path[i+1 : i+end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("json path %q: invalid index %q", path, path[i+1:i+end])
+			}
+
+			p = append(p, index)
+			i += end
+		default:
+			key = append(key, c)
+			hasKey = true
+		}
+	}
+
+	push()
+
+	return p, nil
+}
+
+// 解析 JSON 文档，数字保留为 json.Number，避免 64 位整数丢失精度
+func decodeJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+// 按路径取值，对象字段的数字形式也可以作为数组下标
+func (p jsonPath) Get(doc interface{}) (interface{}, bool) {
+	for _, seg := range p {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			key, ok := seg.(string)
+			if !ok {
+				key = strconv.Itoa(seg.(int))
+			}
+
+			if doc, ok = v[key]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			index, ok := seg.(int)
+			if !ok {
+				var err error
+				if index, err = strconv.Atoi(seg.(string)); err != nil {
+					return nil, false
+				}
+			}
+
+			if index < 0 || index >= len(v) {
+				return nil, false
+			}
+
+			doc = v[index]
+		default:
+			return nil, false
+		}
+	}
+
+	return doc, true
+}
+
+// 构造只包含路径和值的文档，例如 data.value 和 1 构造出 {"data":{"value":1}}
+func (p jsonPath) Build(value interface{}) interface{} {
+	for i := len(p) - 1; i >= 0; i-- {
+		switch seg := p[i].(type) {
+		case string:
+			value = map[string]interface{}{seg: value}
+		case int:
+			array := make([]interface{}, seg+1)
+			array[seg] = value
+			value = array
+		}
+	}
+
+	return value
+}
+
+// 将 JSON 值转换为标签数据类型对应的值，字符串形式的数字和 0/1 形式的布尔值也可以转换
+func valueFromJSON(dataType string, v interface{}) (nson.Value, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, fmt.Errorf("value is null")
+	case json.Number:
+		switch dataType {
+		case device.TypeString:
+			return nson.String(v), nil
+		case device.TypeI64:
+			if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+				return nson.I64(i), nil
+			}
+		case device.TypeU64:
+			if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+				return nson.U64(u), nil
+			}
+		}
+
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+
+		return valueFromFloat64(dataType, f)
+	case float64:
+		return valueFromJSON(dataType, json.Number(strconv.FormatFloat(v, 'g', -1, 64)))
+	case bool:
+		if dataType == device.TypeString {
+			return nson.String(strconv.FormatBool(v)), nil
+		}
+
+		if v {
+			return valueFromFloat64(dataType, 1)
+		}
+
+		return valueFromFloat64(dataType, 0)
+	case string:
+		if dataType == device.TypeString {
+			return nson.String(v), nil
+		}
+
+		if dataType == device.TypeBool {
+			if b, err := strconv.ParseBool(v); err == nil {
+				return nson.Bool(b), nil
+			}
+		}
+
+		return valueFromJSON(dataType, json.Number(strings.TrimSpace(v)))
+	}
+
+	return nil, fmt.Errorf("json value %v can't convert to %v", v, dataType)
+}
+
+// 将标签值转换为 JSON 值
+func valueToJSON(value nson.Value) (interface{}, error) {
+	switch v := value.(type) {
+	case nson.Bool:
+		return bool(v), nil
+	case nson.String:
+		return string(v), nil
+	case nson.I32:
+		return int32(v), nil
+	case nson.U32:
+		return uint32(v), nil
+	case nson.I64:
+		return int64(v), nil
+	case nson.U64:
+		return uint64(v), nil
+	}
+
+	if f, ok := util.NsonValueToFloat64(value); ok {
+		return f, nil
+	}
+
+	return nil, fmt.Errorf("value %v can't convert to json", value)
+}
@@ -0,0 +1,141 @@
+package collect
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type metricWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (m *metricWriter) printf(format string, args ...interface{}) {
+	if m.err != nil {
+		return
+	}
+
+	_, m.err = fmt.Fprintf(m.w, format, args...)
+}
+
+func (m *metricWriter) header(name, typ, help string) {
+	m.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (m *metricWriter) sample(name string, labels string, value float64) {
+	m.printf("%s{%s} %s\n", name, labels, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func slotLabels(stats *WireStats) string {
+	return fmt.Sprintf(`slot_id="%s",slot_name="%s"`,
+		metricLabelEscaper.Replace(stats.SlotID), metricLabelEscaper.Replace(stats.SlotName))
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+func timeMetric(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return float64(t.UnixNano()) / 1e9
+}
+
+func (m *metricWriter) counters(list []WireStats, name, typ, help string, value func(*WireStats) float64) {
+	m.header(name, typ, help)
+	for i := range list {
+		m.sample(name, slotLabels(&list[i]), value(&list[i]))
+	}
+}
+
+func (m *metricWriter) histogram(list []WireStats, name, help string, value func(*WireStats) Histogram) {
+	m.header(name, "histogram", help)
+	for i := range list {
+		labels := slotLabels(&list[i])
+		h := value(&list[i])
+
+		for j, bucket := range h.Buckets {
+			le := strconv.FormatFloat(bucket.Seconds(), 'g', -1, 64)
+			m.sample(name+"_bucket", labels+`,le="`+le+`"`, float64(h.Counts[j]))
+		}
+		m.sample(name+"_bucket", labels+`,le="+Inf"`, float64(h.Count))
+		m.sample(name+"_sum", labels, h.Sum.Seconds())
+		m.sample(name+"_count", labels, float64(h.Count))
+	}
+}
+
+// 以 Prometheus 文本格式输出所有 slot 的读写统计
+func (c *Service) WriteMetrics(w io.Writer) error {
+	list := c.WireStatsList()
+	m := &metricWriter{w: bufio.NewWriter(w)}
+
+	m.counters(list, "july_collect_connected", "gauge", "Whether the slot is connected.",
+		func(s *WireStats) float64 { return boolMetric(s.Connected) })
+	m.counters(list, "july_collect_connects_total", "counter", "Successful connects.",
+		func(s *WireStats) float64 { return float64(s.Connects) })
+	m.counters(list, "july_collect_reconnects_total", "counter", "Connects after the first one.",
+		func(s *WireStats) float64 { return float64(s.Reconnects) })
+	m.counters(list, "july_collect_reads_total", "counter", "Read operations.",
+		func(s *WireStats) float64 { return float64(s.Reads) })
+	m.counters(list, "july_collect_read_tags_total", "counter", "Tags read successfully or with bad quality.",
+		func(s *WireStats) float64 { return float64(s.ReadTags) })
+	m.counters(list, "july_collect_writes_total", "counter", "Write operations.",
+		func(s *WireStats) float64 { return float64(s.Writes) })
+	m.counters(list, "july_collect_write_tags_total", "counter", "Tags written.",
+		func(s *WireStats) float64 { return float64(s.WriteTags) })
+	m.counters(list, "july_collect_bytes_read_total", "counter", "Bytes received, if the driver reports them.",
+		func(s *WireStats) float64 { return float64(s.BytesRead) })
+	m.counters(list, "july_collect_bytes_written_total", "counter", "Bytes sent, if the driver reports them.",
+		func(s *WireStats) float64 { return float64(s.BytesWritten) })
+	m.counters(list, "july_collect_last_read_timestamp_seconds", "gauge", "Time of the last successful read.",
+		func(s *WireStats) float64 { return timeMetric(s.LastRead) })
+
+	m.header("july_collect_errors_total", "counter", "Errors by kind.")
+	for i := range list {
+		kinds := make([]string, 0, len(list[i].Errors))
+		for kind := range list[i].Errors {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+
+		for _, kind := range kinds {
+			labels := slotLabels(&list[i]) + `,kind="` + metricLabelEscaper.Replace(kind) + `"`
+			m.sample("july_collect_errors_total", labels, float64(list[i].Errors[kind]))
+		}
+	}
+
+	m.histogram(list, "july_collect_read_latency_seconds", "Read latency.",
+		func(s *WireStats) Histogram { return s.ReadLatency })
+	m.histogram(list, "july_collect_write_latency_seconds", "Write latency.",
+		func(s *WireStats) Histogram { return s.WriteLatency })
+
+	if m.err != nil {
+		return m.err
+	}
+
+	return m.w.Flush()
+}
+
+// 输出 Prometheus 格式统计的 http.Handler
+func (c *Service) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := c.WriteMetrics(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,568 @@
+package collect
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danclive/july/device"
+	"github.com/danclive/july/log"
+	"github.com/danclive/july/util"
+	"github.com/danclive/nson-go"
+	"github.com/goburrow/modbus"
+)
+
+func init() {
+	RegisterDriver(device.DriverModbusTCP, &ModbusTCP{})
+}
+
+// Modbus 数据区
+const (
+	ModbusCoil            = "C"  // 线圈，0x，读写
+	ModbusDiscreteInput   = "DI" // 离散输入，1x，只读
+	ModbusInputRegister   = "IR" // 输入寄存器，3x，只读
+	ModbusHoldingRegister = "HR" // 保持寄存器，4x，读写
+)
+
+// Slot.Params，例如：host=192.168.1.10&port=502&unit=1&timeout=3s&order=CDAB&gap=0
+type modbusParams struct {
+	Host    string        `cfg:"host"`
+	Port    int           `cfg:"port,default=502"`
+	Unit    uint8         `cfg:"unit,default=1"`
+	Timeout time.Duration `cfg:"timeout,default=5s"`
+	// 多字节数据的字节序，ABCD: 大端，CDAB: 字交换，BADC: 字节交换，DCBA: 小端
+	Order string `cfg:"order,default=ABCD"`
+	// 合并读取，单次请求的最大寄存器数、线圈数，以及允许合并的最大地址空隙
+	MaxRegs int `cfg:"max_regs,default=125"`
+	MaxBits int `cfg:"max_bits,default=2000"`
+	Gap     int `cfg:"gap,default=4"`
+}
+
+// Tag.Address 支持区域 + 偏移（从 0 开始）：C0, DI0, IR100, HR100，
+// 以及 Modicon 编号（从 1 开始）：00001, 10001, 30101, 40101, 400101。
+// 寄存器中的单个位：HR100.3，字符串需要指定字节长度：HR100:16
+type modbusAddress struct {
+	Area   string
+	Offset uint16
+	Bit    int // 寄存器中的位，-1 表示不按位访问
+	Size   int // 字节数
+}
+
+func parseModbusAddress(address string, dataType string) (modbusAddress, error) {
+	addr := modbusAddress{Bit: -1}
+
+	s := strings.ToUpper(strings.TrimSpace(address))
+	if s == "" {
+		return addr, errors.New("modbus: address is empty")
+	}
+
+	if i := strings.Index(s, ":"); i >= 0 {
+		size, err := strconv.Atoi(s[i+1:])
+		if err != nil || size <= 0 {
+			return addr, fmt.Errorf("modbus: invalid length in address %q", address)
+		}
+
+		addr.Size = size
+		s = s[:i]
+	}
+
+	if i := strings.Index(s, "."); i >= 0 {
+		bit, err := strconv.Atoi(s[i+1:])
+		if err != nil || bit < 0 || bit > 15 {
+			return addr, fmt.Errorf("modbus: invalid bit in address %q", address)
+		}
+
+		addr.Bit = bit
+		s = s[:i]
+	}
+
+	var offset uint64
+	var err error
+
+	switch {
+	case strings.HasPrefix(s, ModbusDiscreteInput):
+		addr.Area = ModbusDiscreteInput
+		offset, err = strconv.ParseUint(s[2:], 10, 16)
+	case strings.HasPrefix(s, ModbusInputRegister):
+		addr.Area = ModbusInputRegister
+		offset, err = strconv.ParseUint(s[2:], 10, 16)
+	case strings.HasPrefix(s, ModbusHoldingRegister):
+		addr.Area = ModbusHoldingRegister
+		offset, err = strconv.ParseUint(s[2:], 10, 16)
+	case strings.HasPrefix(s, ModbusCoil):
+		addr.Area = ModbusCoil
+		offset, err = strconv.ParseUint(s[1:], 10, 16)
+	case len(s) == 5 || len(s) == 6:
+		switch s[0] {
+		case '0':
+			addr.Area = ModbusCoil
+		case '1':
+			addr.Area = ModbusDiscreteInput
+		case '3':
+			addr.Area = ModbusInputRegister
+		case '4':
+			addr.Area = ModbusHoldingRegister
+		default:
+			return addr, fmt.Errorf("modbus: unknown area in address %q", address)
+		}
+
+		offset, err = strconv.ParseUint(s[1:], 10, 17)
+		if err == nil {
+			if offset == 0 || offset > 65536 {
+				return addr, fmt.Errorf("modbus: address %q out of range", address)
+			}
+			offset--
+		}
+	default:
+		return addr, fmt.Errorf("modbus: unknown area in address %q", address)
+	}
+
+	if err != nil {
+		return addr, fmt.Errorf("modbus: invalid offset in address %q", address)
+	}
+
+	addr.Offset = uint16(offset)
+
+	if addr.Area == ModbusCoil || addr.Area == ModbusDiscreteInput {
+		if dataType != device.TypeBool {
+			return addr, fmt.Errorf("modbus: area %v only support %v", addr.Area, device.TypeBool)
+		}
+
+		if addr.Bit >= 0 {
+			return addr, fmt.Errorf("modbus: area %v not support bit address", addr.Area)
+		}
+
+		addr.Size = 1
+		return addr, nil
+	}
+
+	switch dataType {
+	case device.TypeString:
+		if addr.Size == 0 {
+			return addr, fmt.Errorf("modbus: string address %q need length, eg: HR100:16", address)
+		}
+	case device.TypeBool:
+		addr.Size = 2
+	default:
+		size := device.TypeSize(dataType)
+		if size == 0 {
+			return addr, fmt.Errorf("modbus: unsupported data type: %v", dataType)
+		}
+
+		if addr.Bit >= 0 {
+			return addr, fmt.Errorf("modbus: bit address only support %v", device.TypeBool)
+		}
+
+		// 8 位数据占用一个寄存器的低字节
+		if size < 2 {
+			size = 2
+		}
+
+		addr.Size = size
+	}
+
+	return addr, nil
+}
+
+// 寄存器数量
+func (a modbusAddress) Quantity() uint16 {
+	if a.Area == ModbusCoil || a.Area == ModbusDiscreteInput {
+		return 1
+	}
+
+	return uint16((a.Size + 1) / 2)
+}
+
+// 按 order 调整多字节数据的字节序，调整是可逆的，读写共用
+func modbusReorder(b []byte, order string) []byte {
+	out := make([]byte, len(b))
+	copy(out, b)
+
+	if len(out) < 2 || len(out)%2 != 0 {
+		return out
+	}
+
+	switch strings.ToUpper(order) {
+	case "BADC":
+		modbusSwapBytes(out)
+	case "CDAB":
+		modbusSwapWords(out)
+	case "DCBA":
+		modbusSwapBytes(out)
+		modbusSwapWords(out)
+	}
+
+	return out
+}
+
+func modbusSwapBytes(b []byte) {
+	for i := 0; i+1 < len(b); i += 2 {
+		b[i], b[i+1] = b[i+1], b[i]
+	}
+}
+
+func modbusSwapWords(b []byte) {
+	for i, j := 0, len(b)-2; i < j; i, j = i+2, j-2 {
+		b[i], b[i+1], b[j], b[j+1] = b[j], b[j+1], b[i], b[i+1]
+	}
+}
+
+// 将读取到的原始数据解码为标签的值
+func modbusDecode(addr modbusAddress, dataType string, raw []byte, order string) (nson.Value, error) {
+	if addr.Area == ModbusCoil || addr.Area == ModbusDiscreteInput {
+		if len(raw) < 1 {
+			return nil, errors.New("modbus: response data is empty")
+		}
+
+		return nson.Bool(raw[0]&0x01 != 0), nil
+	}
+
+	size := int(addr.Quantity()) * 2
+	if len(raw) < size {
+		return nil, fmt.Errorf("modbus: need %v bytes, provide: %v", size, len(raw))
+	}
+
+	raw = raw[:size]
+
+	switch dataType {
+	case device.TypeString:
+		return decodeValue(dataType, raw[:addr.Size])
+	case device.TypeBool:
+		word, err := util.BytesToUInt16(modbusReorder(raw, order), true)
+		if err != nil {
+			return nil, err
+		}
+
+		if addr.Bit >= 0 {
+			return nson.Bool(word&(1<<uint(addr.Bit)) != 0), nil
+		}
+
+		return nson.Bool(word != 0), nil
+	case device.TypeI8, device.TypeU8:
+		return decodeValue(dataType, modbusReorder(raw, order)[1:])
+	}
+
+	return decodeValue(dataType, modbusReorder(raw, order))
+}
+
+// 将标签的值编码为写入寄存器的数据
+func modbusEncode(addr modbusAddress, dataType string, value nson.Value, order string) ([]byte, error) {
+	size := int(addr.Quantity()) * 2
+
+	switch dataType {
+	case device.TypeString:
+		return encodeValue(dataType, value, size)
+	case device.TypeI8, device.TypeU8:
+		b, err := encodeValue(dataType, value, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		return modbusReorder([]byte{0, b[0]}, order), nil
+	}
+
+	b, err := encodeValue(dataType, value, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return modbusReorder(b, order), nil
+}
+
+// 记录 modbus 库收发的帧，跟踪关闭时 Tracer 直接返回，不会复制和格式化帧
+type modbusTraceTransporter struct {
+	modbus.Transporter
+	tracer *Tracer
+}
+
+func (t *modbusTraceTransporter) Send(aduRequest []byte) ([]byte, error) {
+	t.tracer.TX(aduRequest)
+
+	aduResponse, err := t.Transporter.Send(aduRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	t.tracer.RX(aduResponse)
+
+	return aduResponse, nil
+}
+
+type ModbusTCP struct {
+	handler *modbus.TCPClientHandler
+	client  modbus.Client
+	order   string
+	planner BlockPlanner
+}
+
+var _ Driver = &ModbusTCP{}
+
+func (m *ModbusTCP) Connect(slot device.Slot) (Driver, error) {
+	var params modbusParams
+
+	u, err := url.ParseQuery(slot.Params)
+	if err != nil {
+		return nil, err
+	}
+
+	err = util.MapConfig(&params, u)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.Host == "" {
+		return nil, fmt.Errorf("modbus: slot %v params need host", slot.Name)
+	}
+
+	handler := modbus.NewTCPClientHandler(net.JoinHostPort(params.Host, strconv.Itoa(params.Port)))
+	handler.SlaveId = params.Unit
+	handler.Timeout = params.Timeout
+
+	err = handler.Connect()
+	if err != nil {
+		return nil, err
+	}
+
+	client := modbus.NewClient(handler)
+	if tracer := traceFor(slot.ID); tracer != nil {
+		tracer.SetPort(params.Port)
+		client = modbus.NewClient2(handler, &modbusTraceTransporter{Transporter: handler, tracer: tracer})
+	}
+
+	return &ModbusTCP{
+		handler: handler,
+		client:  client,
+		order:   params.Order,
+		planner: BlockPlanner{
+			MaxCount: params.MaxRegs,
+			AreaMaxCount: map[string]int{
+				ModbusCoil:          params.MaxBits,
+				ModbusDiscreteInput: params.MaxBits,
+			},
+			MaxGap: params.Gap,
+		},
+	}, nil
+}
+
+func (m *ModbusTCP) Close() error {
+	if m.handler == nil {
+		return nil
+	}
+
+	return m.handler.Close()
+}
+
+func (m *ModbusTCP) Name() string {
+	return device.DriverModbusTCP
+}
+
+func (m *ModbusTCP) Read(tags []device.Tag) error {
+	addrs := make([]modbusAddress, len(tags))
+	items := make([]BlockItem, 0, len(tags))
+
+	for i := 0; i < len(tags); i++ {
+		tags[i].Value = nil
+
+		addr, err := parseModbusAddress(tags[i].Address, tags[i].DataType)
+		if err != nil {
+			log.Suger.Warnf("tag: %v(%v): %v", tags[i].Name, tags[i].ID, err)
+			continue
+		}
+
+		addrs[i] = addr
+		items = append(items, BlockItem{
+			Index: i,
+			Area:  addr.Area,
+			Start: int(addr.Offset),
+			Count: int(addr.Quantity()),
+		})
+	}
+
+	for _, block := range m.planner.Plan(items) {
+		err := m.readBlock(tags, addrs, block)
+		if err == nil {
+			continue
+		}
+
+		// 设备返回的异常只影响对应的标签，其他错误需要重新连接
+		if _, ok := err.(*modbus.ModbusError); !ok {
+			return err
+		}
+
+		if len(block.Items) == 1 {
+			tag := &tags[block.Items[0].Index]
+			log.Suger.Warnf("tag: %v(%v): %v", tag.Name, tag.ID, err)
+			continue
+		}
+
+		// 合并后的请求可能包含设备不支持的地址，逐个重新读取
+		for _, item := range block.Items {
+			err = m.readBlock(tags, addrs, Block{
+				Area:  item.Area,
+				Start: item.Start,
+				Count: item.Count,
+				Items: []BlockItem{item},
+			})
+
+			if err != nil {
+				if _, ok := err.(*modbus.ModbusError); !ok {
+					return err
+				}
+
+				tag := &tags[item.Index]
+				log.Suger.Warnf("tag: %v(%v): %v", tag.Name, tag.ID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m *ModbusTCP) readBlock(tags []device.Tag, addrs []modbusAddress, block Block) error {
+	raw, err := m.readRaw(block.Area, uint16(block.Start), uint16(block.Count))
+	if err != nil {
+		return err
+	}
+
+	for _, item := range block.Items {
+		tag := &tags[item.Index]
+		addr := addrs[item.Index]
+
+		var data []byte
+
+		if addr.Area == ModbusCoil || addr.Area == ModbusDiscreteInput {
+			bit, ok := block.Bit(raw, item)
+			if ok {
+				data = []byte{0}
+				if bit {
+					data[0] = 1
+				}
+			}
+		} else {
+			data = block.Bytes(raw, item, 2)
+		}
+
+		value, err := modbusDecode(addr, tag.DataType, data, m.order)
+		if err != nil {
+			log.Suger.Warnf("tag: %v(%v): %v", tag.Name, tag.ID, err)
+			continue
+		}
+
+		tag.Value = value
+	}
+
+	return nil
+}
+
+// 地址、只读区域和编码错误在发送前检查，只影响对应的标签，不断开连接
+func (m *ModbusTCP) Write(tags []device.Tag) error {
+	errs := make(TagErrors, len(tags))
+
+	for i := 0; i < len(tags); i++ {
+		addr, data, err := modbusPrepareWrite(&tags[i], m.order)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		err = m.writeTag(addr, tags[i].DataType, data)
+		if err != nil {
+			if _, ok := err.(*modbus.ModbusError); !ok {
+				return err
+			}
+
+			errs[i] = err
+		}
+	}
+
+	return errs.Err()
+}
+
+func (m *ModbusTCP) readRaw(area string, offset uint16, quantity uint16) ([]byte, error) {
+	switch area {
+	case ModbusCoil:
+		return m.client.ReadCoils(offset, quantity)
+	case ModbusDiscreteInput:
+		return m.client.ReadDiscreteInputs(offset, quantity)
+	case ModbusInputRegister:
+		return m.client.ReadInputRegisters(offset, quantity)
+	case ModbusHoldingRegister:
+		return m.client.ReadHoldingRegisters(offset, quantity)
+	}
+
+	return nil, fmt.Errorf("modbus: unknown area %v", area)
+}
+
+// 解析地址并编码要写入的值，不访问设备。
+// 线圈和 Bool 标签的值为一个字节，其他为按字节序排列的寄存器数据
+func modbusPrepareWrite(tag *device.Tag, order string) (modbusAddress, []byte, error) {
+	addr, err := parseModbusAddress(tag.Address, tag.DataType)
+	if err != nil {
+		return addr, nil, err
+	}
+
+	switch addr.Area {
+	case ModbusDiscreteInput, ModbusInputRegister:
+		return addr, nil, fmt.Errorf("modbus: area %v is read only", addr.Area)
+	}
+
+	if addr.Area == ModbusCoil || tag.DataType == device.TypeBool {
+		data, err := encodeValue(device.TypeBool, tag.Value, 0)
+		return addr, data, err
+	}
+
+	data, err := modbusEncode(addr, tag.DataType, tag.Value, order)
+	return addr, data, err
+}
+
+func (m *ModbusTCP) writeTag(addr modbusAddress, dataType string, data []byte) error {
+	if addr.Area == ModbusCoil {
+		value := uint16(0x0000)
+		if data[0] != 0 {
+			value = 0xFF00
+		}
+
+		_, err := m.client.WriteSingleCoil(addr.Offset, value)
+		return err
+	}
+
+	if dataType == device.TypeBool {
+		if addr.Bit < 0 {
+			_, err := m.client.WriteSingleRegister(addr.Offset, uint16(data[0]))
+			return err
+		}
+
+		// 按位写入需要先读出整个寄存器
+		raw, err := m.client.ReadHoldingRegisters(addr.Offset, 1)
+		if err != nil {
+			return err
+		}
+
+		word, err := util.BytesToUInt16(modbusReorder(raw, m.order), true)
+		if err != nil {
+			return err
+		}
+
+		if data[0] != 0 {
+			word |= 1 << uint(addr.Bit)
+		} else {
+			word &^= 1 << uint(addr.Bit)
+		}
+
+		// 按读取时相同的字节序写回
+		word, err = util.BytesToUInt16(modbusReorder(util.UInt16ToBytes(word, true), m.order), true)
+		if err != nil {
+			return err
+		}
+
+		_, err = m.client.WriteSingleRegister(addr.Offset, word)
+		return err
+	}
+
+	_, err := m.client.WriteMultipleRegisters(addr.Offset, addr.Quantity(), data)
+	return err
+}
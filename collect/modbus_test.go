@@ -0,0 +1,226 @@
+package collect
+
+import (
+	"math"
+	"net"
+	"testing"
+
+	"github.com/danclive/july/device"
+	"github.com/danclive/march/consts"
+	"github.com/danclive/nson-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/tbrandon/mbserver"
+)
+
+func newModbusServer(t *testing.T) (*mbserver.Server, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().(*net.TCPAddr)
+	ln.Close()
+
+	serv := mbserver.NewServer()
+	err = serv.ListenTCP(addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return serv, addr.String()
+}
+
+func TestParseModbusAddress(t *testing.T) {
+	addr, err := parseModbusAddress("HR100", device.TypeF32)
+	assert.Nil(t, err)
+	assert.Exactly(t, modbusAddress{Area: ModbusHoldingRegister, Offset: 100, Bit: -1, Size: 4}, addr)
+	assert.Exactly(t, uint16(2), addr.Quantity())
+
+	addr, err = parseModbusAddress("40101", device.TypeU16)
+	assert.Nil(t, err)
+	assert.Exactly(t, modbusAddress{Area: ModbusHoldingRegister, Offset: 100, Bit: -1, Size: 2}, addr)
+
+	addr, err = parseModbusAddress("300001", device.TypeI8)
+	assert.Nil(t, err)
+	assert.Exactly(t, modbusAddress{Area: ModbusInputRegister, Offset: 0, Bit: -1, Size: 2}, addr)
+
+	addr, err = parseModbusAddress("hr10.3", device.TypeBool)
+	assert.Nil(t, err)
+	assert.Exactly(t, modbusAddress{Area: ModbusHoldingRegister, Offset: 10, Bit: 3, Size: 2}, addr)
+
+	addr, err = parseModbusAddress("HR10:5", device.TypeString)
+	assert.Nil(t, err)
+	assert.Exactly(t, uint16(3), addr.Quantity())
+
+	_, err = parseModbusAddress("C1", device.TypeI32)
+	assert.NotNil(t, err)
+	_, err = parseModbusAddress("HR10", device.TypeString)
+	assert.NotNil(t, err)
+	_, err = parseModbusAddress("50001", device.TypeI32)
+	assert.NotNil(t, err)
+	_, err = parseModbusAddress("40000", device.TypeI32)
+	assert.NotNil(t, err)
+}
+
+func TestModbusReorder(t *testing.T) {
+	b := []byte{1, 2, 3, 4}
+
+	assert.Exactly(t, []byte{1, 2, 3, 4}, modbusReorder(b, "ABCD"))
+	assert.Exactly(t, []byte{3, 4, 1, 2}, modbusReorder(b, "CDAB"))
+	assert.Exactly(t, []byte{2, 1, 4, 3}, modbusReorder(b, "BADC"))
+	assert.Exactly(t, []byte{4, 3, 2, 1}, modbusReorder(b, "DCBA"))
+	assert.Exactly(t, b, modbusReorder(modbusReorder(b, "DCBA"), "DCBA"))
+}
+
+func TestModbusTCP(t *testing.T) {
+	serv, address := newModbusServer(t)
+	defer serv.Close()
+
+	host, port, _ := net.SplitHostPort(address)
+
+	serv.Coils[1] = 1
+	serv.DiscreteInputs[2] = 1
+	serv.InputRegisters[0] = 0xFFFE
+	serv.HoldingRegisters[10] = 0x0008
+	// F32 1.5 = 0x3FC00000，CDAB
+	serv.HoldingRegisters[20] = 0x0000
+	serv.HoldingRegisters[21] = 0x3FC0
+	// U64
+	serv.HoldingRegisters[30] = 0x0000
+	serv.HoldingRegisters[31] = 0x0000
+	serv.HoldingRegisters[32] = 0x0001
+	serv.HoldingRegisters[33] = 0x0002
+	// "ab"
+	serv.HoldingRegisters[40] = 0x6162
+
+	conn, err := (&ModbusTCP{}).Connect(device.Slot{
+		Name:   "plc",
+		Driver: device.DriverModbusTCP,
+		Params: "host=" + host + "&port=" + port + "&order=CDAB",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tags := []device.Tag{
+		{Name: "coil", Address: "C1", DataType: device.TypeBool},
+		{Name: "di", Address: "10003", DataType: device.TypeBool},
+		{Name: "ir", Address: "IR0", DataType: device.TypeI16},
+		{Name: "bit", Address: "HR10.3", DataType: device.TypeBool},
+		{Name: "f32", Address: "HR20", DataType: device.TypeF32},
+		{Name: "u64", Address: "HR30", DataType: device.TypeU64},
+		{Name: "str", Address: "HR40:2", DataType: device.TypeString},
+		{Name: "bad", Address: "XX1", DataType: device.TypeI32},
+	}
+
+	err = conn.Read(tags)
+	assert.Nil(t, err)
+
+	assert.Exactly(t, nson.Bool(true), tags[0].Value)
+	assert.Exactly(t, nson.Bool(true), tags[1].Value)
+	assert.Exactly(t, nson.I32(-2), tags[2].Value)
+	assert.Exactly(t, nson.Bool(true), tags[3].Value)
+	assert.Exactly(t, nson.F32(1.5), tags[4].Value)
+	assert.Exactly(t, nson.U64(0x0002000100000000), tags[5].Value)
+	assert.Exactly(t, nson.String("ab"), tags[6].Value)
+	assert.Nil(t, tags[7].Value)
+
+	writes := []device.Tag{
+		{Name: "coil", Address: "C2", DataType: device.TypeBool, Access: consts.ON, Value: nson.Bool(true)},
+		{Name: "bit", Address: "HR10.0", DataType: device.TypeBool, Access: consts.ON, Value: nson.Bool(true)},
+		{Name: "f64", Address: "HR50", DataType: device.TypeF64, Access: consts.ON, Value: nson.F64(math.Pi)},
+		{Name: "i32", Address: "40061", DataType: device.TypeI32, Access: consts.ON, Value: nson.I32(-100)},
+	}
+
+	err = conn.Write(writes)
+	assert.Nil(t, err)
+
+	assert.Exactly(t, byte(1), serv.Coils[2])
+	assert.Exactly(t, uint16(0x0009), serv.HoldingRegisters[10])
+
+	writes[2].Value = nil
+	writes[3].Value = nil
+	err = conn.Read(writes[2:])
+	assert.Nil(t, err)
+	assert.Exactly(t, nson.F64(math.Pi), writes[2].Value)
+	assert.Exactly(t, nson.I32(-100), writes[3].Value)
+}
+
+func TestModbusWriteBitBADC(t *testing.T) {
+	serv, address := newModbusServer(t)
+	defer serv.Close()
+
+	host, port, _ := net.SplitHostPort(address)
+
+	// BADC 时寄存器 0x0100 的值为 0x0001
+	serv.HoldingRegisters[10] = 0x0100
+
+	conn, err := (&ModbusTCP{}).Connect(device.Slot{
+		Name:   "plc",
+		Driver: device.DriverModbusTCP,
+		Params: "host=" + host + "&port=" + port + "&order=BADC",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tags := []device.Tag{{Name: "bit", Address: "HR10.1", DataType: device.TypeBool, Access: consts.ON, Value: nson.Bool(true)}}
+
+	err = conn.Write(tags)
+	assert.Nil(t, err)
+	assert.Exactly(t, uint16(0x0300), serv.HoldingRegisters[10])
+
+	tags[0].Address = "HR10.0"
+	tags[0].Value = nson.Bool(false)
+
+	err = conn.Write(tags)
+	assert.Nil(t, err)
+	assert.Exactly(t, uint16(0x0200), serv.HoldingRegisters[10])
+
+	tags[0].Value = nil
+	err = conn.Read(tags)
+	assert.Nil(t, err)
+	assert.Exactly(t, nson.Bool(false), tags[0].Value)
+}
+
+func TestModbusWriteTagErrors(t *testing.T) {
+	serv, address := newModbusServer(t)
+	defer serv.Close()
+
+	host, port, _ := net.SplitHostPort(address)
+
+	conn, err := (&ModbusTCP{}).Connect(device.Slot{
+		Name:   "plc",
+		Driver: device.DriverModbusTCP,
+		Params: "host=" + host + "&port=" + port,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tags := []device.Tag{
+		{Name: "di", Address: "DI0", DataType: device.TypeBool, Access: consts.ON, Value: nson.Bool(true)},
+		{Name: "ir", Address: "IR0", DataType: device.TypeU16, Access: consts.ON, Value: nson.U32(1)},
+		{Name: "bad", Address: "XX1", DataType: device.TypeI32, Access: consts.ON, Value: nson.I32(1)},
+		{Name: "nil", Address: "HR1", DataType: device.TypeU16, Access: consts.ON},
+		{Name: "hr", Address: "HR0", DataType: device.TypeU16, Access: consts.ON, Value: nson.U32(7)},
+	}
+
+	// 配置错误只影响对应的标签，不断开连接
+	err = conn.Write(tags)
+	errs, ok := err.(TagErrors)
+	assert.True(t, ok)
+	assert.Exactly(t, 5, len(errs))
+	assert.NotNil(t, errs[0])
+	assert.NotNil(t, errs[1])
+	assert.NotNil(t, errs[2])
+	assert.NotNil(t, errs[3])
+	assert.Nil(t, errs[4])
+	assert.Exactly(t, uint16(7), serv.HoldingRegisters[0])
+
+	read := []device.Tag{{Name: "hr", Address: "HR0", DataType: device.TypeU16}}
+	assert.Nil(t, conn.Read(read))
+	assert.Exactly(t, nson.U32(7), read[0].Value)
+}
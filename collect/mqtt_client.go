@@ -0,0 +1,419 @@
+package collect
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danclive/july/device"
+	"github.com/danclive/july/log"
+	"github.com/danclive/july/util"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func init() {
+	RegisterDriver(device.DriverMQTTClient, &MqttClient{})
+}
+
+// Slot.Params，例如：
+// broker=tcp://127.0.0.1:1883&topic=sensors/+/data&topic=status&qos=1&command={topic}/set
+// topic 为订阅的主题，可以有多个，也可以用逗号分隔；
+// command 为写入时发布的主题，{topic}、{path}、{name} 替换为标签的主题、JSON 路径和名称；
+// expire 不为 0 时，超过 expire 没有收到消息的标签值为空。
+type mqttClientParams struct {
+	Broker    string        `cfg:"broker"`
+	ClientID  string        `cfg:"client_id"`
+	User      string        `cfg:"user"`
+	Pass      string        `cfg:"pass"`
+	Topics    []string      `cfg:"topic"`
+	QoS       byte          `cfg:"qos,default=0"`
+	Command   string        `cfg:"command,default={topic}/set"`
+	Retain    bool          `cfg:"retain,default=false"`
+	Timeout   time.Duration `cfg:"timeout,default=5s"`
+	KeepAlive time.Duration `cfg:"keepalive,default=60s"`
+	Expire    time.Duration `cfg:"expire,default=0s"`
+}
+
+// Tag.Address 为主题和 JSON 路径，以 # 分隔，例如：sensors/room1/data#temp、status#items[0].value，
+// 没有路径时为整个消息。主题可以使用 + 通配符，匹配多个主题时取最新的消息。
+type mqttClientAddress struct {
+	Topic string
+	Path  jsonPath
+	path  string
+}
+
+func parseMqttClientAddress(address string) (*mqttClientAddress, error) {
+	topic, path := address, ""
+	if i := strings.Index(address, "#"); i >= 0 {
+		topic, path = address[:i], address[i+1:]
+	}
+
+	topic = strings.TrimSpace(topic)
+	if topic == "" || strings.Contains(topic, "#") {
+		return nil, fmt.Errorf("mqtt client: invalid topic in address %q", address)
+	}
+
+	p, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mqttClientAddress{Topic: topic, Path: p, path: path}, nil
+}
+
+// 主题过滤器是否匹配主题
+func mqttTopicMatch(filter, topic string) bool {
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+
+	for i := 0; i < len(fs); i++ {
+		if fs[i] == "#" {
+			return true
+		}
+
+		if i >= len(ts) {
+			return false
+		}
+
+		if fs[i] != "+" && fs[i] != ts[i] {
+			return false
+		}
+	}
+
+	return len(fs) == len(ts)
+}
+
+type mqttClientMessage struct {
+	payload []byte
+	time    time.Time
+	doc     interface{}
+	decoded bool
+}
+
+// 解析消息，不是 JSON 的消息作为字符串
+func (m *mqttClientMessage) Doc() interface{} {
+	if !m.decoded {
+		doc, err := decodeJSON(m.payload)
+		if err != nil {
+			doc = string(m.payload)
+		}
+
+		m.doc = doc
+		m.decoded = true
+	}
+
+	return m.doc
+}
+
+type MqttClient struct {
+	client    mqtt.Client
+	params    mqttClientParams
+	lock      sync.Mutex
+	messages  map[string]*mqttClientMessage
+	addresses map[string]*mqttClientAddress
+	lost      error
+	tracer    *Tracer
+}
+
+var _ Driver = &MqttClient{}
+
+func (m *MqttClient) Connect(slot device.Slot) (Driver, error) {
+	var params mqttClientParams
+
+	u, err := url.ParseQuery(slot.Params)
+	if err != nil {
+		return nil, err
+	}
+
+	err = util.MapConfig(&params, u)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.Broker == "" {
+		return nil, errors.New("mqtt client: broker is required")
+	}
+
+	if params.QoS > 2 {
+		return nil, fmt.Errorf("mqtt client: invalid qos %v", params.QoS)
+	}
+
+	topics := make(map[string]byte)
+	for _, t := range params.Topics {
+		for _, topic := range strings.Split(t, ",") {
+			if topic = strings.TrimSpace(topic); topic != "" {
+				topics[topic] = params.QoS
+			}
+		}
+	}
+
+	if len(topics) == 0 {
+		return nil, errors.New("mqtt client: topic is required")
+	}
+
+	if params.ClientID == "" {
+		params.ClientID = "july-" + util.RandomID()
+	}
+
+	conn := &MqttClient{
+		params:    params,
+		messages:  make(map[string]*mqttClientMessage),
+		addresses: make(map[string]*mqttClientAddress),
+		tracer:    traceFor(slot.ID),
+	}
+
+	conn.tracer.SetPort(mqttBrokerPort(params.Broker))
+
+	options := mqtt.NewClientOptions()
+	options.AddBroker(params.Broker)
+	options.SetClientID(params.ClientID)
+	options.SetUsername(params.User)
+	options.SetPassword(params.Pass)
+	options.SetCleanSession(true)
+	options.SetAutoReconnect(false)
+	options.SetConnectTimeout(params.Timeout)
+	options.SetKeepAlive(params.KeepAlive)
+	options.SetWriteTimeout(params.Timeout)
+	options.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		conn.lock.Lock()
+		conn.lost = err
+		conn.lock.Unlock()
+	})
+
+	conn.client = mqtt.NewClient(options)
+
+	token := conn.client.Connect()
+	if !token.WaitTimeout(params.Timeout) {
+		conn.client.Disconnect(0)
+		return nil, fmt.Errorf("mqtt client: connect %v timeout", params.Broker)
+	}
+
+	if err := token.Error(); err != nil {
+		return nil, err
+	}
+
+	token = conn.client.SubscribeMultiple(topics, conn.onMessage)
+	if !token.WaitTimeout(params.Timeout) {
+		conn.client.Disconnect(0)
+		return nil, errors.New("mqtt client: subscribe timeout")
+	}
+
+	if err := token.Error(); err != nil {
+		conn.client.Disconnect(0)
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (m *MqttClient) onMessage(_ mqtt.Client, msg mqtt.Message) {
+	m.trace(false, msg.Topic(), msg.Qos(), msg.Retained(), msg.MessageID(), msg.Payload())
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.messages[msg.Topic()] = &mqttClientMessage{
+		payload: msg.Payload(),
+		time:    time.Now(),
+	}
+}
+
+// paho 没有暴露底层连接，只把收发的消息按 PUBLISH 报文记录，
+// 不包括 CONNECT、SUBSCRIBE、PINGREQ 等控制报文，发送的报文标识为 0
+func (m *MqttClient) trace(tx bool, topic string, qos byte, retain bool, id uint16, payload []byte) {
+	if !m.tracer.Enabled() {
+		return
+	}
+
+	packet := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	packet.Qos = qos
+	packet.Retain = retain
+	packet.TopicName = topic
+	packet.MessageID = id
+	packet.Payload = payload
+
+	var buf bytes.Buffer
+	if err := packet.Write(&buf); err != nil {
+		return
+	}
+
+	if tx {
+		m.tracer.TX(buf.Bytes())
+	} else {
+		m.tracer.RX(buf.Bytes())
+	}
+}
+
+func mqttBrokerPort(broker string) int {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return 0
+	}
+
+	if port, err := strconv.Atoi(u.Port()); err == nil {
+		return port
+	}
+
+	switch u.Scheme {
+	case "ssl", "tls", "tcps", "mqtts":
+		return 8883
+	case "ws":
+		return 80
+	case "wss":
+		return 443
+	}
+
+	return 1883
+}
+
+func (m *MqttClient) Close() error {
+	m.client.Disconnect(250)
+	return nil
+}
+
+func (m *MqttClient) Name() string {
+	return device.DriverMQTTClient
+}
+
+func (m *MqttClient) address(address string) (*mqttClientAddress, error) {
+	if a, ok := m.addresses[address]; ok {
+		return a, nil
+	}
+
+	a, err := parseMqttClientAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	m.addresses[address] = a
+
+	return a, nil
+}
+
+// 查找主题最新的消息，调用时需持有锁
+func (m *MqttClient) message(topic string) *mqttClientMessage {
+	if !strings.Contains(topic, "+") {
+		return m.messages[topic]
+	}
+
+	var latest *mqttClientMessage
+	for t, msg := range m.messages {
+		if mqttTopicMatch(topic, t) && (latest == nil || msg.time.After(latest.time)) {
+			latest = msg
+		}
+	}
+
+	return latest
+}
+
+func (m *MqttClient) Read(tags []device.Tag) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.lost != nil {
+		return m.lost
+	}
+
+	if !m.client.IsConnectionOpen() {
+		return errors.New("mqtt client: connection closed")
+	}
+
+	for i := 0; i < len(tags); i++ {
+		tags[i].Value = nil
+
+		address, err := m.address(tags[i].Address)
+		if err != nil {
+			log.Suger.Warnf("tag: %v(%v): %v", tags[i].Name, tags[i].ID, err)
+			continue
+		}
+
+		msg := m.message(address.Topic)
+		if msg == nil {
+			continue
+		}
+
+		if m.params.Expire > 0 && time.Since(msg.time) > m.params.Expire {
+			continue
+		}
+
+		v, ok := address.Path.Get(msg.Doc())
+		if !ok {
+			continue
+		}
+
+		value, err := valueFromJSON(tags[i].DataType, v)
+		if err != nil {
+			log.Suger.Warnf("tag: %v(%v): %v", tags[i].Name, tags[i].ID, err)
+			continue
+		}
+
+		tags[i].Value = value
+	}
+
+	return nil
+}
+
+func (m *MqttClient) Write(tags []device.Tag) error {
+	errs := make(TagErrors, len(tags))
+
+	m.lock.Lock()
+	lost := m.lost
+	m.lock.Unlock()
+
+	if lost != nil {
+		return lost
+	}
+
+	for i := 0; i < len(tags); i++ {
+		if tags[i].Value == nil {
+			continue
+		}
+
+		m.lock.Lock()
+		address, err := m.address(tags[i].Address)
+		m.lock.Unlock()
+
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		v, err := valueToJSON(tags[i].Value)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		payload, err := json.Marshal(address.Path.Build(v))
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		topic := strings.NewReplacer(
+			"{topic}", address.Topic,
+			"{path}", address.path,
+			"{name}", tags[i].Name,
+		).Replace(m.params.Command)
+
+		m.trace(true, topic, m.params.QoS, m.params.Retain, 0, payload)
+
+		token := m.client.Publish(topic, m.params.QoS, m.params.Retain, payload)
+		if !token.WaitTimeout(m.params.Timeout) {
+			return fmt.Errorf("mqtt client: publish %v timeout", topic)
+		}
+
+		if err := token.Error(); err != nil {
+			return err
+		}
+	}
+
+	return errs.Err()
+}
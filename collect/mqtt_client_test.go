@@ -0,0 +1,143 @@
+package collect
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/danclive/july/device"
+	"github.com/danclive/july/log"
+	"github.com/danclive/mqtt"
+	"github.com/danclive/mqtt/packets"
+	"github.com/danclive/nson-go"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseJSONPath(t *testing.T) {
+	p, err := parseJSONPath("data.items[1].value")
+	assert.Nil(t, err)
+	assert.Exactly(t, jsonPath{"data", "items", 1, "value"}, p)
+
+	p, err = parseJSONPath(`$.a\.b[0]`)
+	assert.Nil(t, err)
+	assert.Exactly(t, jsonPath{"a.b", 0}, p)
+
+	p, err = parseJSONPath("")
+	assert.Nil(t, err)
+	assert.Exactly(t, jsonPath{}, p)
+
+	_, err = parseJSONPath("a[x]")
+	assert.NotNil(t, err)
+
+	doc, err := decodeJSON([]byte(`{"data":{"items":[{"value":1},{"value":18446744073709551615}]}}`))
+	assert.Nil(t, err)
+
+	v, ok := jsonPath{"data", "items", 1, "value"}.Get(doc)
+	assert.True(t, ok)
+	value, err := valueFromJSON(device.TypeU64, v)
+	assert.Nil(t, err)
+	assert.Exactly(t, nson.U64(18446744073709551615), value)
+
+	v, ok = jsonPath{"data", "items", "0", "value"}.Get(doc)
+	assert.True(t, ok)
+	value, err = valueFromJSON(device.TypeF32, v)
+	assert.Nil(t, err)
+	assert.Exactly(t, nson.F32(1), value)
+
+	_, ok = jsonPath{"data", "items", 2}.Get(doc)
+	assert.False(t, ok)
+
+	assert.Exactly(t, map[string]interface{}{"a": []interface{}{nil, true}}, jsonPath{"a", 1}.Build(true))
+}
+
+func TestMqttTopicMatch(t *testing.T) {
+	assert.True(t, mqttTopicMatch("a/b", "a/b"))
+	assert.True(t, mqttTopicMatch("a/+/c", "a/b/c"))
+	assert.True(t, mqttTopicMatch("a/#", "a/b/c"))
+	assert.False(t, mqttTopicMatch("a/+", "a/b/c"))
+	assert.False(t, mqttTopicMatch("a/b/c", "a/b"))
+}
+
+func TestMqttClient(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commands := make(chan packets.Message, 10)
+
+	server := mqtt.NewServer(
+		mqtt.WithTCPListener(ln),
+		mqtt.WithLogger(log.Logger),
+		mqtt.WithHook(mqtt.Hooks{
+			OnMsgArrived: func(client mqtt.Client, msg packets.Message) bool {
+				if client.OptionsReader().ClientID() == "july-test" {
+					commands <- msg
+				}
+				return true
+			},
+		}),
+	)
+	server.Run()
+	defer server.Stop(context.Background())
+
+	broker := "tcp://" + ln.Addr().String()
+
+	conn, err := (&MqttClient{}).Connect(device.Slot{
+		Name:   "mqtt",
+		Driver: device.DriverMQTTClient,
+		Params: "broker=" + broker + "&client_id=july-test&topic=sensors/%2B/data,status&command=cmd/{topic}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	options := paho.NewClientOptions()
+	options.AddBroker(broker)
+	options.SetClientID("publisher")
+	publisher := paho.NewClient(options)
+	token := publisher.Connect()
+	token.Wait()
+	assert.Nil(t, token.Error())
+	defer publisher.Disconnect(0)
+
+	publisher.Publish("sensors/room1/data", 1, false, `{"temp":21.5,"items":[{"ok":true}]}`).Wait()
+	publisher.Publish("status", 1, false, `running`).Wait()
+
+	tags := []device.Tag{
+		{Name: "temp", Address: "sensors/room1/data#temp", DataType: device.TypeF32},
+		{Name: "ok", Address: "sensors/room1/data#items[0].ok", DataType: device.TypeBool},
+		{Name: "any", Address: "sensors/+/data#temp", DataType: device.TypeI32},
+		{Name: "status", Address: "status", DataType: device.TypeString},
+		{Name: "missing", Address: "sensors/room1/data#hum", DataType: device.TypeF32},
+		{Name: "nodata", Address: "sensors/room2/data#temp", DataType: device.TypeF32},
+	}
+
+	assert.Eventually(t, func() bool {
+		assert.Nil(t, conn.Read(tags))
+		return tags[3].Value != nil
+	}, time.Second*5, time.Millisecond*20)
+
+	assert.Exactly(t, nson.F32(21.5), tags[0].Value)
+	assert.Exactly(t, nson.Bool(true), tags[1].Value)
+	assert.Exactly(t, nson.I32(22), tags[2].Value)
+	assert.Exactly(t, nson.String("running"), tags[3].Value)
+	assert.Nil(t, tags[4].Value)
+	assert.Nil(t, tags[5].Value)
+
+	err = conn.Write([]device.Tag{
+		{Name: "temp", Address: "sensors/room1/data#setpoint.temp", DataType: device.TypeF32, Value: nson.F32(25)},
+	})
+	assert.Nil(t, err)
+
+	select {
+	case msg := <-commands:
+		assert.Exactly(t, "cmd/sensors/room1/data", msg.Topic())
+		assert.Exactly(t, `{"setpoint":{"temp":25}}`, string(msg.Payload()))
+	case <-time.After(time.Second * 5):
+		t.Fatal("command timeout")
+	}
+}
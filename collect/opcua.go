@@ -0,0 +1,514 @@
+package collect
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/danclive/july/device"
+	"github.com/danclive/july/log"
+	"github.com/danclive/july/util"
+	"github.com/danclive/nson-go"
+	"github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/ua"
+)
+
+func init() {
+	RegisterDriver(device.DriverOPCUA, &OpcUA{})
+}
+
+// OPC UA 返回的状态码，只影响对应的标签
+type OpcUAError struct {
+	Code ua.StatusCode
+}
+
+func (e *OpcUAError) Error() string {
+	return fmt.Sprintf("opcua: status 0x%08X (%v)", uint32(e.Code), e.Code)
+}
+
+func uaIsBad(code ua.StatusCode) bool {
+	return code&ua.StatusBad != 0
+}
+
+// Slot.Params，例如：endpoint=opc.tcp://192.168.1.10:4840&mode=SignAndEncrypt&policy=Basic256Sha256&cert=client.der&key=client.pem&user=admin&pass=123456
+// mode 为安全模式，None、Sign 或 SignAndEncrypt；
+// policy 为安全策略，例如 Basic256Sha256，为空时选择服务端支持 mode 的安全等级最高的策略；
+// mode 不为 None 时需要 cert 和 key，为客户端证书（DER 或 PEM）和 RSA 私钥（DER 或 PEM）文件，
+// 服务端需要信任此证书；
+// user 为空时使用匿名登录，否则使用用户名密码。
+type opcuaParams struct {
+	Endpoint string        `cfg:"endpoint"`
+	Mode     string        `cfg:"mode,default=None"`
+	Policy   string        `cfg:"policy"`
+	Cert     string        `cfg:"cert"`
+	Key      string        `cfg:"key"`
+	User     string        `cfg:"user"`
+	Pass     string        `cfg:"pass"`
+	Timeout  time.Duration `cfg:"timeout,default=5s"`
+	Session  time.Duration `cfg:"session,default=60s"`
+	Lifetime time.Duration `cfg:"lifetime,default=1h"`
+	MaxNodes int           `cfg:"max_nodes,default=200"`
+}
+
+// Tag.Address 为 NodeId，例如：ns=2;s=Channel1.Device1.Tag1。
+// 协议由 gopcua 实现，连接断开后由 Wire 重新连接，不使用 gopcua 的自动重连
+type OpcUA struct {
+	client   *opcua.Client
+	timeout  time.Duration
+	maxNodes int
+
+	nodes map[string]*ua.NodeID
+}
+
+var _ Driver = &OpcUA{}
+var _ ContextDriver = &OpcUA{}
+
+func parseOpcuaParams(slot device.Slot) (opcuaParams, ua.MessageSecurityMode, error) {
+	var params opcuaParams
+
+	u, err := url.ParseQuery(slot.Params)
+	if err != nil {
+		return params, ua.MessageSecurityModeInvalid, err
+	}
+
+	err = util.MapConfig(&params, u)
+	if err != nil {
+		return params, ua.MessageSecurityModeInvalid, err
+	}
+
+	endpoint, err := url.Parse(params.Endpoint)
+	if err != nil || endpoint.Scheme != "opc.tcp" {
+		return params, ua.MessageSecurityModeInvalid, fmt.Errorf("opcua: slot %v params need endpoint, eg: opc.tcp://127.0.0.1:4840", slot.Name)
+	}
+
+	var mode ua.MessageSecurityMode
+	switch strings.ToLower(params.Mode) {
+	case "none":
+		mode = ua.MessageSecurityModeNone
+	case "sign":
+		mode = ua.MessageSecurityModeSign
+	case "signandencrypt":
+		mode = ua.MessageSecurityModeSignAndEncrypt
+	default:
+		return params, ua.MessageSecurityModeInvalid, fmt.Errorf("opcua: security mode %v not supported", params.Mode)
+	}
+
+	if mode != ua.MessageSecurityModeNone && (params.Cert == "" || params.Key == "") {
+		return params, mode, fmt.Errorf("opcua: security mode %v need cert and key", params.Mode)
+	}
+
+	if mode == ua.MessageSecurityModeNone && params.Policy != "" && !strings.EqualFold(params.Policy, "None") {
+		return params, mode, fmt.Errorf("opcua: security policy %v need mode Sign or SignAndEncrypt", params.Policy)
+	}
+
+	if params.MaxNodes <= 0 {
+		params.MaxNodes = 200
+	}
+
+	return params, mode, nil
+}
+
+// 证书和私钥在这里加载，gopcua 的 CertificateFile、PrivateKeyFile 出错时会退出进程
+func loadUaCertificate(certFile, keyFile string) ([]byte, *rsa.PrivateKey, error) {
+	cert, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if block, _ := pem.Decode(cert); block != nil {
+		cert = block.Bytes
+	}
+
+	if _, err := x509.ParseCertificate(cert); err != nil {
+		return nil, nil, fmt.Errorf("opcua: cert %v: %v", certFile, err)
+	}
+
+	der, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if block, _ := pem.Decode(der); block != nil {
+		der = block.Bytes
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return cert, key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opcua: key %v: %v", keyFile, err)
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("opcua: key %v is not RSA", keyFile)
+	}
+
+	return cert, rsaKey, nil
+}
+
+func (o *OpcUA) Connect(slot device.Slot) (Driver, error) {
+	params, mode, err := parseOpcuaParams(slot)
+	if err != nil {
+		return nil, err
+	}
+
+	// gopcua 没有暴露底层连接，不能跟踪收发的帧
+	traceFor(slot.ID).SetUnsupported()
+
+	ctx, cancel := context.WithTimeout(context.Background(), params.Timeout)
+	defer cancel()
+
+	endpoints, err := opcua.GetEndpoints(ctx, params.Endpoint, opcua.DialTimeout(params.Timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	policy := params.Policy
+	if strings.EqualFold(policy, "None") {
+		policy = ua.SecurityPolicyURINone
+	}
+
+	endpoint := opcua.SelectEndpoint(endpoints, policy, mode)
+	if endpoint == nil {
+		return nil, fmt.Errorf("opcua: endpoint with mode %v and policy %v not found", params.Mode, params.Policy)
+	}
+
+	authType := ua.UserTokenTypeAnonymous
+	auth := opcua.AuthAnonymous()
+	if params.User != "" {
+		authType = ua.UserTokenTypeUserName
+		auth = opcua.AuthUsername(params.User, params.Pass)
+	}
+
+	opts := []opcua.Option{
+		opcua.AutoReconnect(false),
+		opcua.DialTimeout(params.Timeout),
+		opcua.RequestTimeout(params.Timeout),
+		opcua.SessionTimeout(params.Session),
+		opcua.Lifetime(params.Lifetime),
+		opcua.SessionName(slot.Name),
+		auth,
+		opcua.SecurityFromEndpoint(endpoint, authType),
+	}
+
+	if mode != ua.MessageSecurityModeNone {
+		cert, key, err := loadUaCertificate(params.Cert, params.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		opts = append(opts, opcua.Certificate(cert), opcua.PrivateKey(key))
+	}
+
+	client := opcua.NewClient(params.Endpoint, opts...)
+	if err := client.Connect(ctx); err != nil {
+		return nil, err
+	}
+
+	return &OpcUA{
+		client:   client,
+		timeout:  params.Timeout,
+		maxNodes: params.MaxNodes,
+		nodes:    make(map[string]*ua.NodeID),
+	}, nil
+}
+
+func (o *OpcUA) Close() error {
+	if o.client == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+	defer cancel()
+
+	return o.client.CloseWithContext(ctx)
+}
+
+func (o *OpcUA) Name() string {
+	return device.DriverOPCUA
+}
+
+func (o *OpcUA) nodeId(address string) (*ua.NodeID, error) {
+	if node, ok := o.nodes[address]; ok {
+		return node, nil
+	}
+
+	node, err := ua.ParseNodeID(address)
+	if err != nil {
+		return nil, err
+	}
+
+	o.nodes[address] = node
+	return node, nil
+}
+
+func (o *OpcUA) Read(tags []device.Tag) error {
+	return o.ReadContext(context.Background(), tags)
+}
+
+func (o *OpcUA) ReadContext(ctx context.Context, tags []device.Tag) error {
+	index := make([]int, 0, len(tags))
+	nodes := make([]*ua.ReadValueID, 0, len(tags))
+
+	for i := 0; i < len(tags); i++ {
+		tags[i].Value = nil
+
+		node, err := o.nodeId(tags[i].Address)
+		if err != nil {
+			log.Suger.Warnf("tag: %v(%v): %v", tags[i].Name, tags[i].ID, err)
+			continue
+		}
+
+		index = append(index, i)
+		nodes = append(nodes, &ua.ReadValueID{NodeID: node, AttributeID: ua.AttributeIDValue})
+	}
+
+	for start := 0; start < len(nodes); start += o.maxNodes {
+		end := start + o.maxNodes
+		if end > len(nodes) {
+			end = len(nodes)
+		}
+
+		res, err := o.client.ReadWithContext(ctx, &ua.ReadRequest{
+			TimestampsToReturn: ua.TimestampsToReturnSource,
+			NodesToRead:        nodes[start:end],
+		})
+		if err != nil {
+			return err
+		}
+
+		for i, dv := range res.Results {
+			if start+i >= end {
+				break
+			}
+
+			tag := &tags[index[start+i]]
+
+			value, err := uaToValue(tag.DataType, dv)
+			if err != nil {
+				log.Suger.Warnf("tag: %v(%v): %v", tag.Name, tag.ID, err)
+				continue
+			}
+
+			tag.Value = value
+			tag.SourceTime = dv.SourceTimestamp
+		}
+	}
+
+	return nil
+}
+
+func (o *OpcUA) Write(tags []device.Tag) error {
+	return o.WriteContext(context.Background(), tags)
+}
+
+func (o *OpcUA) WriteContext(ctx context.Context, tags []device.Tag) error {
+	errs := make(TagErrors, len(tags))
+
+	index := make([]int, 0, len(tags))
+	nodes := make([]*ua.WriteValue, 0, len(tags))
+
+	for i := 0; i < len(tags); i++ {
+		node, err := o.nodeId(tags[i].Address)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		variant, err := uaFromValue(tags[i].DataType, tags[i].Value)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		index = append(index, i)
+		nodes = append(nodes, &ua.WriteValue{
+			NodeID:      node,
+			AttributeID: ua.AttributeIDValue,
+			Value:       &ua.DataValue{EncodingMask: ua.DataValueValue, Value: variant},
+		})
+	}
+
+	if len(nodes) == 0 {
+		return errs.Err()
+	}
+
+	res, err := o.client.WriteWithContext(ctx, &ua.WriteRequest{NodesToWrite: nodes})
+	if err != nil {
+		return err
+	}
+
+	for i, code := range res.Results {
+		if i < len(index) && uaIsBad(code) {
+			errs[index[i]] = &OpcUAError{Code: code}
+		}
+	}
+
+	return errs.Err()
+}
+
+// 将 OPC UA 的值转换为标签数据类型对应的值
+func uaToValue(dataType string, dv *ua.DataValue) (nson.Value, error) {
+	if dv == nil {
+		return nil, errors.New("opcua: value is null")
+	}
+
+	if uaIsBad(dv.Status) {
+		return nil, &OpcUAError{Code: dv.Status}
+	}
+
+	if dv.Value == nil || dv.Value.Type() == ua.TypeIDNull {
+		return nil, errors.New("opcua: value is null")
+	}
+
+	if dv.Value.Has(ua.VariantArrayValues) {
+		return nil, errors.New("opcua: array value not supported")
+	}
+
+	var f float64
+
+	switch v := dv.Value.Value().(type) {
+	case bool:
+		if dataType == device.TypeString {
+			return nson.String(fmt.Sprint(v)), nil
+		}
+
+		if v {
+			f = 1
+		}
+	case int8:
+		f = float64(v)
+	case uint8:
+		f = float64(v)
+	case int16:
+		f = float64(v)
+	case uint16:
+		f = float64(v)
+	case int32:
+		f = float64(v)
+	case uint32:
+		f = float64(v)
+	case int64:
+		switch dataType {
+		case device.TypeI64:
+			return nson.I64(v), nil
+		case device.TypeU64:
+			return nson.U64(v), nil
+		}
+
+		f = float64(v)
+	case uint64:
+		switch dataType {
+		case device.TypeI64:
+			return nson.I64(v), nil
+		case device.TypeU64:
+			return nson.U64(v), nil
+		}
+
+		f = float64(v)
+	case float32:
+		f = float64(v)
+	case float64:
+		f = v
+	case string:
+		if dataType == device.TypeString {
+			return nson.String(v), nil
+		}
+
+		return nil, fmt.Errorf("opcua: variant type %v can't convert to %v", dv.Value.Type(), dataType)
+	case []byte:
+		if dataType == device.TypeString {
+			return nson.String(v), nil
+		}
+
+		return nil, fmt.Errorf("opcua: variant type %v can't convert to %v", dv.Value.Type(), dataType)
+	case time.Time:
+		switch dataType {
+		case device.TypeString:
+			return nson.String(v.Format(time.RFC3339Nano)), nil
+		case device.TypeI64:
+			return nson.I64(v.UnixNano() / int64(time.Millisecond)), nil
+		case device.TypeU64:
+			return nson.U64(v.UnixNano() / int64(time.Millisecond)), nil
+		}
+
+		return nil, fmt.Errorf("opcua: variant type %v can't convert to %v", dv.Value.Type(), dataType)
+	default:
+		return nil, fmt.Errorf("opcua: variant type %v can't convert to %v", dv.Value.Type(), dataType)
+	}
+
+	if dataType == device.TypeString {
+		return nson.String(fmt.Sprint(dv.Value.Value())), nil
+	}
+
+	return valueFromFloat64(dataType, f)
+}
+
+// 将标签的值转换为 OPC UA 的值，类型由标签数据类型决定
+func uaFromValue(dataType string, value nson.Value) (*ua.Variant, error) {
+	if value == nil {
+		return nil, errors.New("opcua: value is nil")
+	}
+
+	if dataType == device.TypeString {
+		if s, ok := value.(nson.String); ok {
+			return ua.NewVariant(string(s))
+		}
+
+		return nil, fmt.Errorf("data type not match, expect: %v, provide: %v", nson.TAG_STRING, value.Tag())
+	}
+
+	f, ok := util.NsonValueToFloat64(value)
+	if !ok {
+		return nil, fmt.Errorf("value %v can't convert to %v", value, dataType)
+	}
+
+	var v interface{}
+
+	switch dataType {
+	case device.TypeBool:
+		v = f != 0
+	case device.TypeI8:
+		v = int8(f)
+	case device.TypeU8:
+		v = uint8(f)
+	case device.TypeI16:
+		v = int16(f)
+	case device.TypeU16:
+		v = uint16(f)
+	case device.TypeI32:
+		v = int32(f)
+	case device.TypeU32:
+		v = uint32(f)
+	case device.TypeI64:
+		if i, ok := value.(nson.I64); ok {
+			v = int64(i)
+		} else {
+			v = int64(f)
+		}
+	case device.TypeU64:
+		if u, ok := value.(nson.U64); ok {
+			v = uint64(u)
+		} else {
+			v = uint64(f)
+		}
+	case device.TypeF32:
+		v = float32(f)
+	case device.TypeF64:
+		v = f
+	default:
+		return nil, fmt.Errorf("unsupported data type: %v", dataType)
+	}
+
+	return ua.NewVariant(v)
+}
@@ -0,0 +1,180 @@
+package collect
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/danclive/july/device"
+	"github.com/danclive/nson-go"
+	"github.com/gopcua/opcua/ua"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseOpcuaParams(t *testing.T) {
+	slot := device.Slot{Name: "ua", Params: "endpoint=opc.tcp://127.0.0.1:4840"}
+	params, mode, err := parseOpcuaParams(slot)
+	assert.Nil(t, err)
+	assert.Exactly(t, ua.MessageSecurityModeNone, mode)
+	assert.Exactly(t, 200, params.MaxNodes)
+
+	slot.Params = "endpoint=opc.tcp://127.0.0.1:4840&mode=SignAndEncrypt&policy=Basic256Sha256&cert=a.der&key=a.pem"
+	_, mode, err = parseOpcuaParams(slot)
+	assert.Nil(t, err)
+	assert.Exactly(t, ua.MessageSecurityModeSignAndEncrypt, mode)
+
+	// 签名需要证书和私钥
+	slot.Params = "endpoint=opc.tcp://127.0.0.1:4840&mode=Sign"
+	_, _, err = parseOpcuaParams(slot)
+	assert.NotNil(t, err)
+
+	slot.Params = "endpoint=opc.tcp://127.0.0.1:4840&policy=Basic256Sha256"
+	_, _, err = parseOpcuaParams(slot)
+	assert.NotNil(t, err)
+
+	slot.Params = "endpoint=opc.tcp://127.0.0.1:4840&mode=Encrypt"
+	_, _, err = parseOpcuaParams(slot)
+	assert.NotNil(t, err)
+
+	slot.Params = "endpoint=http://127.0.0.1:4840"
+	_, _, err = parseOpcuaParams(slot)
+	assert.NotNil(t, err)
+}
+
+func TestLoadUaCertificate(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "july"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	pkcs1File := filepath.Join(dir, "key.der")
+	pkcs8File := filepath.Join(dir, "key.pem")
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0600))
+	assert.Nil(t, ioutil.WriteFile(pkcs1File, x509.MarshalPKCS1PrivateKey(key), 0600))
+	assert.Nil(t, ioutil.WriteFile(pkcs8File, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), 0600))
+
+	der, loaded, err := loadUaCertificate(certFile, pkcs1File)
+	assert.Nil(t, err)
+	assert.Exactly(t, cert, der)
+	assert.Exactly(t, key.N, loaded.N)
+
+	_, loaded, err = loadUaCertificate(certFile, pkcs8File)
+	assert.Nil(t, err)
+	assert.Exactly(t, key.N, loaded.N)
+
+	// 出错时返回错误，不退出进程
+	_, _, err = loadUaCertificate(pkcs1File, pkcs1File)
+	assert.NotNil(t, err)
+	_, _, err = loadUaCertificate(filepath.Join(dir, "none"), pkcs1File)
+	assert.NotNil(t, err)
+}
+
+func TestUaToValue(t *testing.T) {
+	dv := func(v interface{}) *ua.DataValue {
+		return &ua.DataValue{Value: ua.MustVariant(v)}
+	}
+
+	value, err := uaToValue(device.TypeBool, dv(true))
+	assert.Nil(t, err)
+	assert.Exactly(t, nson.Bool(true), value)
+
+	value, err = uaToValue(device.TypeI16, dv(int16(-5)))
+	assert.Nil(t, err)
+	assert.Exactly(t, nson.I32(-5), value)
+
+	value, err = uaToValue(device.TypeU64, dv(uint64(1<<63)))
+	assert.Nil(t, err)
+	assert.Exactly(t, nson.U64(1<<63), value)
+
+	value, err = uaToValue(device.TypeF32, dv(1.25))
+	assert.Nil(t, err)
+	assert.Exactly(t, nson.F32(1.25), value)
+
+	value, err = uaToValue(device.TypeString, dv("hello"))
+	assert.Nil(t, err)
+	assert.Exactly(t, nson.String("hello"), value)
+
+	value, err = uaToValue(device.TypeString, dv(int32(7)))
+	assert.Nil(t, err)
+	assert.Exactly(t, nson.String("7"), value)
+
+	_, err = uaToValue(device.TypeI32, dv("hello"))
+	assert.NotNil(t, err)
+
+	_, err = uaToValue(device.TypeI32, dv([]int32{1, 2}))
+	assert.NotNil(t, err)
+
+	_, err = uaToValue(device.TypeI32, &ua.DataValue{Status: ua.StatusBadNodeIDUnknown})
+	assert.Exactly(t, &OpcUAError{Code: ua.StatusBadNodeIDUnknown}, err)
+
+	_, err = uaToValue(device.TypeI32, &ua.DataValue{})
+	assert.NotNil(t, err)
+}
+
+func TestUaFromValue(t *testing.T) {
+	v, err := uaFromValue(device.TypeI16, nson.I32(300))
+	assert.Nil(t, err)
+	assert.Exactly(t, ua.TypeIDInt16, v.Type())
+	assert.Exactly(t, int16(300), v.Value())
+
+	v, err = uaFromValue(device.TypeU64, nson.U64(1<<63))
+	assert.Nil(t, err)
+	assert.Exactly(t, uint64(1<<63), v.Value())
+
+	v, err = uaFromValue(device.TypeF32, nson.F32(1.5))
+	assert.Nil(t, err)
+	assert.Exactly(t, float32(1.5), v.Value())
+
+	v, err = uaFromValue(device.TypeString, nson.String("world"))
+	assert.Nil(t, err)
+	assert.Exactly(t, "world", v.Value())
+
+	_, err = uaFromValue(device.TypeString, nson.I32(1))
+	assert.NotNil(t, err)
+	_, err = uaFromValue(device.TypeI32, nil)
+	assert.NotNil(t, err)
+}
+
+func TestOpcUAConnectError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := ln.Addr().String()
+	ln.Close()
+
+	_, err = (&OpcUA{}).Connect(device.Slot{
+		Name:   "ua",
+		Driver: device.DriverOPCUA,
+		Params: "endpoint=opc.tcp://" + address + "&timeout=1s",
+	})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,119 @@
+package collect
+
+import (
+	"sort"
+)
+
+// 寄存器类驱动的读请求规划：
+// 将同一区域内连续或相近的地址合并为一个请求，读取后再按标签拆分。
+// 地址和长度的单位由驱动决定，例如 Modbus 的寄存器/线圈，S7 的字节。
+
+type BlockItem struct {
+	Index int    // 标签在 Read 参数中的位置
+	Area  string // 区域，不同区域不会合并
+	Start int    // 起始地址
+	Count int    // 长度
+}
+
+func (i BlockItem) End() int {
+	return i.Start + i.Count
+}
+
+type Block struct {
+	Area  string
+	Start int
+	Count int
+	Items []BlockItem
+}
+
+func (b Block) End() int {
+	return b.Start + b.Count
+}
+
+// 按字节单位拆分读取到的数据，unitSize 为每个地址的字节数
+func (b Block) Bytes(data []byte, item BlockItem, unitSize int) []byte {
+	start := (item.Start - b.Start) * unitSize
+	end := start + item.Count*unitSize
+
+	if start < 0 || end > len(data) {
+		return nil
+	}
+
+	return data[start:end]
+}
+
+// 按位拆分读取到的数据，数据为低位在前的位序列，例如 Modbus 线圈
+func (b Block) Bit(data []byte, item BlockItem) (bool, bool) {
+	offset := item.Start - b.Start
+	if offset < 0 || offset/8 >= len(data) {
+		return false, false
+	}
+
+	return data[offset/8]&(1<<uint(offset%8)) != 0, true
+}
+
+type BlockPlanner struct {
+	MaxCount     int            // 单个请求的最大长度
+	AreaMaxCount map[string]int // 按区域设置的最大长度，优先于 MaxCount
+	MaxGap       int            // 允许合并的最大空隙，空隙中的地址也会被读取
+}
+
+func (p BlockPlanner) maxCount(area string) int {
+	if n, ok := p.AreaMaxCount[area]; ok && n > 0 {
+		return n
+	}
+
+	if p.MaxCount > 0 {
+		return p.MaxCount
+	}
+
+	return 1
+}
+
+// 生成读请求，超过最大长度的单个标签独占一个请求
+func (p BlockPlanner) Plan(items []BlockItem) []Block {
+	sorted := make([]BlockItem, len(items))
+	copy(sorted, items)
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Area != sorted[j].Area {
+			return sorted[i].Area < sorted[j].Area
+		}
+
+		if sorted[i].Start != sorted[j].Start {
+			return sorted[i].Start < sorted[j].Start
+		}
+
+		return sorted[i].Count > sorted[j].Count
+	})
+
+	blocks := make([]Block, 0)
+
+	for _, item := range sorted {
+		if n := len(blocks); n > 0 {
+			last := &blocks[n-1]
+
+			if last.Area == item.Area && item.Start <= last.End()+p.MaxGap {
+				end := last.End()
+				if item.End() > end {
+					end = item.End()
+				}
+
+				if end-last.Start <= p.maxCount(item.Area) {
+					last.Count = end - last.Start
+					last.Items = append(last.Items, item)
+					continue
+				}
+			}
+		}
+
+		blocks = append(blocks, Block{
+			Area:  item.Area,
+			Start: item.Start,
+			Count: item.Count,
+			Items: []BlockItem{item},
+		})
+	}
+
+	return blocks
+}
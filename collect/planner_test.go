@@ -0,0 +1,64 @@
+package collect
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockPlanner(t *testing.T) {
+	planner := BlockPlanner{
+		MaxCount:     10,
+		AreaMaxCount: map[string]int{"C": 100},
+		MaxGap:       2,
+	}
+
+	items := []BlockItem{
+		{Index: 0, Area: "HR", Start: 12, Count: 2},
+		{Index: 1, Area: "HR", Start: 0, Count: 2},
+		{Index: 2, Area: "HR", Start: 2, Count: 1},
+		{Index: 3, Area: "HR", Start: 5, Count: 4}, // 空隙为 2，合并
+		{Index: 4, Area: "HR", Start: 14, Count: 1},
+		{Index: 5, Area: "HR", Start: 20, Count: 20}, // 超过最大长度，独占
+		{Index: 6, Area: "C", Start: 0, Count: 1},
+		{Index: 7, Area: "C", Start: 50, Count: 1},
+		{Index: 8, Area: "C", Start: 52, Count: 1},
+		{Index: 9, Area: "HR", Start: 2, Count: 1}, // 重叠
+	}
+
+	blocks := planner.Plan(items)
+
+	assert.Equal(t, 5, len(blocks))
+
+	assert.Equal(t, "C", blocks[0].Area)
+	assert.Equal(t, 0, blocks[0].Start)
+	assert.Equal(t, 1, blocks[0].Count)
+
+	assert.Equal(t, "C", blocks[1].Area)
+	assert.Equal(t, 50, blocks[1].Start)
+	assert.Equal(t, 3, blocks[1].Count)
+
+	assert.Equal(t, "HR", blocks[2].Area)
+	assert.Equal(t, 0, blocks[2].Start)
+	assert.Equal(t, 9, blocks[2].Count)
+	assert.Equal(t, 4, len(blocks[2].Items))
+
+	assert.Equal(t, 12, blocks[3].Start)
+	assert.Equal(t, 3, blocks[3].Count)
+
+	assert.Equal(t, 20, blocks[4].Start)
+	assert.Equal(t, 20, blocks[4].Count)
+
+	data := []byte{0, 1, 0, 2, 0, 3, 0, 0, 0, 0, 0xA, 0xB, 0xC, 0xD, 0xE, 0xF, 0, 0}
+	assert.Exactly(t, []byte{0, 3}, blocks[2].Bytes(data, items[2], 2))
+	assert.Exactly(t, []byte{0xA, 0xB, 0xC, 0xD, 0xE, 0xF, 0, 0}, blocks[2].Bytes(data, items[3], 2))
+	assert.Nil(t, blocks[2].Bytes(data[:4], items[3], 2))
+
+	bit, ok := blocks[1].Bit([]byte{0x04}, items[8])
+	assert.True(t, ok)
+	assert.True(t, bit)
+
+	bit, ok = blocks[1].Bit([]byte{0x04}, items[7])
+	assert.True(t, ok)
+	assert.False(t, bit)
+}
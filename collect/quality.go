@@ -0,0 +1,88 @@
+package collect
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/danclive/july/device"
+	"github.com/danclive/july/util"
+	"github.com/danclive/march/consts"
+	"github.com/danclive/nson-go"
+)
+
+// 数据质量，高两位表示好、不确定、坏，低位为原因
+type Quality uint16
+
+const (
+	QualityGood Quality = 0x0000
+
+	QualityUncertain           Quality = 0x4000
+	QualityUncertainOutOfRange Quality = 0x4001 // 超出量程
+	QualityUncertainRestored   Quality = 0x4002 // 重启后恢复的值，尚未读取
+
+	QualityBad              Quality = 0x8000
+	QualityBadNotYetRead    Quality = 0x8001 // 尚未读取
+	QualityBadCommFailure   Quality = 0x8002 // 通信中断
+	QualityBadDeviceFailure Quality = 0x8003 // 读取失败
+)
+
+const qualityMask Quality = 0xC000
+
+func (q Quality) IsGood() bool {
+	return q&qualityMask == QualityGood
+}
+
+func (q Quality) IsUncertain() bool {
+	return q&qualityMask == QualityUncertain
+}
+
+func (q Quality) IsBad() bool {
+	return q&qualityMask == QualityBad
+}
+
+func (q Quality) String() string {
+	switch q {
+	case QualityGood:
+		return "good"
+	case QualityUncertain:
+		return "uncertain"
+	case QualityUncertainOutOfRange:
+		return "uncertain: out of range"
+	case QualityUncertainRestored:
+		return "uncertain: restored"
+	case QualityBad:
+		return "bad"
+	case QualityBadNotYetRead:
+		return "bad: not yet read"
+	case QualityBadCommFailure:
+		return "bad: comm failure"
+	case QualityBadDeviceFailure:
+		return "bad: device failure"
+	}
+
+	return fmt.Sprintf("quality(0x%04X)", uint16(q))
+}
+
+// 缓存的标签值
+// Value 为最后一次读取的值，质量为坏时也会保留；
+// SourceTime 为数据源时间，驱动没有提供时为读取时间；RecvTime 为写入缓存的时间。
+type Record struct {
+	Value      nson.Value `json:"value"`
+	Quality    Quality    `json:"quality"`
+	SourceTime time.Time  `json:"source_time"`
+	RecvTime   time.Time  `json:"recv_time"`
+}
+
+// 启用量程转换时，原始值是否超出 LLimit~HLimit
+func outOfRange(tag *device.Tag, value nson.Value) bool {
+	if tag.Convert != consts.ON || tag.HLimit <= tag.LLimit {
+		return false
+	}
+
+	f, ok := util.NsonValueToFloat64(value)
+	if !ok {
+		return false
+	}
+
+	return f < tag.LLimit || f > tag.HLimit
+}
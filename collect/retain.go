@@ -0,0 +1,275 @@
+package collect
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"time"
+
+	"github.com/danclive/july/bolt"
+	"github.com/danclive/july/device"
+	"github.com/danclive/july/log"
+	"github.com/danclive/nson-go"
+	"go.etcd.io/bbolt"
+)
+
+// 保存标签最后值的默认周期
+const DefaultPersistInterval = time.Minute
+
+// 启用 retain 的 slot 的配置
+func retainConfigs() (map[string]device.SlotConfig, error) {
+	slots, err := device.GetService().ListSlot()
+	if err != nil {
+		return nil, err
+	}
+
+	configs := make(map[string]device.SlotConfig, len(slots))
+	for _, slot := range slots {
+		config, err := slot.ParseConfig()
+		if err != nil {
+			log.Suger.Warnf("slot: %v(%v) config: %v", slot.Name, slot.ID, err)
+			continue
+		}
+
+		if config.Retain {
+			configs[slot.ID] = config
+		}
+	}
+
+	return configs, nil
+}
+
+// 只保存值和数据源时间，质量在恢复时设置
+func encodeRetained(slotID string, record Record) ([]byte, error) {
+	msg := nson.Message{
+		"slot":        nson.String(slotID),
+		"value":       record.Value,
+		"source_time": nson.I64(record.SourceTime.UnixNano()),
+	}
+
+	buffer := new(bytes.Buffer)
+	if err := msg.Encode(buffer); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func decodeRetained(data []byte) (string, Record, error) {
+	var record Record
+
+	value, err := nson.Message{}.Decode(bytes.NewBuffer(data))
+	if err != nil {
+		return "", record, err
+	}
+
+	msg := value.(nson.Message)
+
+	slotID, err := msg.GetString("slot")
+	if err != nil {
+		return "", record, err
+	}
+
+	var ok bool
+	if record.Value, ok = msg.Get("value"); !ok {
+		return "", record, errors.New("value not present")
+	}
+
+	sourceTime, err := msg.GetI64("source_time")
+	if err != nil {
+		return "", record, err
+	}
+	record.SourceTime = time.Unix(0, sourceTime)
+
+	return slotID, record, nil
+}
+
+// 保存启用 retain 的 slot 的标签最后值，只写入变化的值，删除不再保存的标签。没有打开 bolt 时不做处理
+func (c *Service) SaveCache() error {
+	_, err := c.saveCache()
+	return err
+}
+
+// 返回写入和删除的标签数量
+func (c *Service) saveCache() (int, error) {
+	db := bolt.GetBoltDB()
+	if db == nil {
+		return 0, nil
+	}
+
+	configs, err := retainConfigs()
+	if err != nil {
+		return 0, err
+	}
+
+	type entry struct {
+		slotID string
+		record Record
+	}
+
+	entries := make(map[string]entry)
+
+	_rwlock.RLock()
+	for key, record := range _cache {
+		if record.Value == nil {
+			continue
+		}
+
+		slotID := _meta[key].SlotID
+		if _, ok := configs[slotID]; !ok {
+			continue
+		}
+
+		entries[key] = entry{slotID: slotID, record: record}
+	}
+	_rwlock.RUnlock()
+
+	count := 0
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(bolt.IO_BUCKET)
+		if err != nil {
+			return err
+		}
+
+		deleted := make([][]byte, 0)
+		err = bucket.ForEach(func(k, v []byte) error {
+			entry, ok := entries[string(k)]
+			if !ok {
+				deleted = append(deleted, append([]byte{}, k...))
+				return nil
+			}
+
+			// nson 编码的字段顺序不固定，解码后比较
+			slotID, record, err := decodeRetained(v)
+			if err == nil && slotID == entry.slotID && record.SourceTime.Equal(entry.record.SourceTime) &&
+				reflect.DeepEqual(record.Value, entry.record.Value) {
+				delete(entries, string(k))
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range deleted {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		count = len(deleted)
+
+		for key, entry := range entries {
+			data, err := encodeRetained(entry.slotID, entry.record)
+			if err != nil {
+				log.Suger.Warnf("tag: %v retain: %v", key, err)
+				continue
+			}
+
+			if err := bucket.Put([]byte(key), data); err != nil {
+				return err
+			}
+
+			count++
+		}
+
+		return nil
+	})
+
+	return count, err
+}
+
+// 恢复保存的标签值，质量为 QualityUncertainRestored，直到第一次读取。
+// 只恢复仍然存在、数据类型没有变化，并且 slot 启用 retain 的标签
+func (c *Service) restoreCache() (int, error) {
+	db := bolt.GetBoltDB()
+	if db == nil || device.GetService() == nil {
+		return 0, nil
+	}
+
+	configs, err := retainConfigs()
+	if err != nil {
+		return 0, err
+	}
+
+	tags := make(map[string]device.Tag)
+	for slotID := range configs {
+		list, err := device.GetService().ListTagStatusOnAndTypeIO(slotID)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, tag := range list {
+			tags[tag.ID] = tag
+		}
+	}
+
+	now := time.Now()
+	count := 0
+
+	_rwlock.Lock()
+	defer _rwlock.Unlock()
+
+	err = db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(bolt.IO_BUCKET)
+		if bucket == nil {
+			return nil
+		}
+
+		return bucket.ForEach(func(k, v []byte) error {
+			key := string(k)
+
+			tag, ok := tags[key]
+			if !ok {
+				return nil
+			}
+
+			slotID, record, err := decodeRetained(v)
+			if err != nil {
+				log.Suger.Warnf("tag: %v(%v) restore: %v", tag.Name, tag.ID, err)
+				return nil
+			}
+
+			if slotID != tag.SlotID || record.Value.Tag() != tag.DefaultValue().Tag() {
+				return nil
+			}
+
+			config := configs[tag.SlotID]
+			if config.RetainMaxAge > 0 && now.Sub(record.SourceTime) > config.RetainMaxAge {
+				return nil
+			}
+
+			record.Quality = QualityUncertainRestored
+			record.RecvTime = now
+
+			_cache[key] = record
+			_meta[key] = tagMeta{SlotID: tag.SlotID, Name: tag.Name}
+			count++
+
+			return nil
+		})
+	})
+
+	return count, err
+}
+
+// 定期保存标签最后值
+func (c *Service) persist(closeCh chan struct{}) {
+	defer c.routines.Done()
+
+	ticker := time.NewTicker(c.persistInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closeCh:
+			return
+		case <-ticker.C:
+			if err := c.SaveCache(); err != nil {
+				log.Suger.Error("save cache: ", err)
+			}
+		}
+	}
+}
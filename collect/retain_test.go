@@ -0,0 +1,122 @@
+package collect
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/danclive/july/bolt"
+	"github.com/danclive/july/device"
+	"github.com/danclive/july/sqlite"
+	"github.com/danclive/march/consts"
+	"github.com/danclive/nson-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func setConfig(t *testing.T, slotID string, config string) {
+	slot, err := device.GetService().GetSlot(slotID)
+	assert.Nil(t, err)
+
+	slot.Config = config
+	_, err = device.GetService().UpdateSlot(slot)
+	assert.Nil(t, err)
+}
+
+func TestRetain(t *testing.T) {
+	bolt.Connect(filepath.Join(t.TempDir(), "july.bolt"))
+	defer bolt.Close()
+
+	initTestService(t)
+	defer sqlite.Close()
+	defer delete(_drivers, "FAKE")
+
+	slot := &device.Slot{Name: "fake", Driver: "FAKE", Status: consts.ON, Config: "scan=10ms&retain=true"}
+	_, err := device.GetService().CreateSlot(slot)
+	assert.Nil(t, err)
+
+	tag := &device.Tag{SlotID: slot.ID, Name: "a", Type: device.TypeIO, DataType: device.TypeI32, Status: consts.ON}
+	_, err = device.GetService().CreateTag(tag)
+	assert.Nil(t, err)
+
+	service := GetService()
+
+	assert.Nil(t, service.Start(context.Background()))
+	assert.True(t, waitSlotState(slot.ID, StateConnected))
+	time.Sleep(time.Millisecond * 50)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	assert.Nil(t, service.Stop(ctx))
+	cancel()
+
+	last, _ := CacheGetRecord(tag.ID)
+	assert.NotNil(t, last.Value)
+
+	// 重启
+	initCache()
+	count, err := service.restoreCache()
+	assert.Nil(t, err)
+	assert.Exactly(t, 1, count)
+
+	record, ok := CacheGetRecord(tag.ID)
+	assert.True(t, ok)
+	assert.Exactly(t, QualityUncertainRestored, record.Quality)
+	assert.Exactly(t, last.Value, record.Value)
+	assert.True(t, last.SourceTime.Equal(record.SourceTime))
+
+	// 数据类型变化时不恢复
+	CacheSetTag(tag, Record{Value: nson.String("a")})
+	assert.Nil(t, service.SaveCache())
+	initCache()
+	count, _ = service.restoreCache()
+	assert.Exactly(t, 0, count)
+
+	// 超过 retain_max_age
+	CacheSetTag(tag, Record{Value: nson.I32(1), SourceTime: time.Now().Add(-time.Hour)})
+	assert.Nil(t, service.SaveCache())
+
+	setConfig(t, slot.ID, "scan=10ms&retain=true&retain_max_age=1m")
+
+	initCache()
+	count, _ = service.restoreCache()
+	assert.Exactly(t, 0, count)
+
+	// 关闭 retain 后不再保存
+	setConfig(t, slot.ID, "scan=10ms&retain=false")
+
+	CacheSetTag(tag, Record{Value: nson.I32(1)})
+	assert.Nil(t, service.SaveCache())
+
+	setConfig(t, slot.ID, "scan=10ms&retain=true")
+
+	initCache()
+	count, _ = service.restoreCache()
+	assert.Exactly(t, 0, count)
+
+	// 默认不保存
+	setConfig(t, slot.ID, "scan=10ms")
+
+	CacheSetTag(tag, Record{Value: nson.I32(1)})
+	assert.Nil(t, service.SaveCache())
+
+	setConfig(t, slot.ID, "scan=10ms&retain=true")
+
+	initCache()
+	count, _ = service.restoreCache()
+	assert.Exactly(t, 0, count)
+
+	// 只写入变化的值
+	CacheSetTag(tag, Record{Value: nson.I32(2)})
+	count, err = service.saveCache()
+	assert.Nil(t, err)
+	assert.Exactly(t, 1, count)
+	count, err = service.saveCache()
+	assert.Nil(t, err)
+	assert.Exactly(t, 0, count)
+
+	// 删除不再保存的标签
+	CacheDel(tag.ID)
+	count, err = service.saveCache()
+	assert.Nil(t, err)
+	assert.Exactly(t, 1, count)
+}
@@ -0,0 +1,794 @@
+package collect
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danclive/july/device"
+	"github.com/danclive/july/log"
+	"github.com/danclive/july/util"
+	"github.com/danclive/nson-go"
+)
+
+func init() {
+	RegisterDriver(device.DriverS7TCP, &S7TCP{})
+}
+
+// S7 数据区
+const (
+	S7AreaI  = 0x81 // 输入，I/E
+	S7AreaQ  = 0x82 // 输出，Q/A
+	S7AreaM  = 0x83 // 位存储区，M
+	S7AreaDB = 0x84 // 数据块，DB
+)
+
+const (
+	s7TransportBit  = 0x01
+	s7TransportByte = 0x02
+
+	s7ReturnBit   = 0x03
+	s7ReturnByte  = 0x04
+	s7ReturnInt   = 0x05
+	s7ReturnReal  = 0x07
+	s7ReturnOctet = 0x09
+
+	s7FuncSetup = 0xF0
+	s7FuncRead  = 0x04
+	s7FuncWrite = 0x05
+
+	s7ROSCTRJob     = 0x01
+	s7ROSCTRAckData = 0x03
+
+	s7Success = 0xFF
+
+	// TPKT 4 字节 + COTP DT 3 字节
+	s7IsoHeaderSize = 7
+)
+
+// Slot.Params，例如：host=192.168.0.1&rack=0&slot=1&timeout=3s&gap=8
+type s7Params struct {
+	Host    string        `cfg:"host"`
+	Port    int           `cfg:"port,default=102"`
+	Rack    int           `cfg:"rack,default=0"`
+	Slot    int           `cfg:"slot,default=1"`
+	Type    int           `cfg:"type,default=1"` // 连接类型，1: PG，2: OP，3: S7 Basic
+	Timeout time.Duration `cfg:"timeout,default=5s"`
+	PDU     int           `cfg:"pdu,default=480"`
+	// 合并读取时允许合并的最大字节空隙，单次请求的最大字节数由 PDU 大小决定
+	Gap int `cfg:"gap,default=8"`
+}
+
+// S7 返回的错误，只影响对应的标签
+type S7Error struct {
+	Code byte
+}
+
+func (e *S7Error) Error() string {
+	var name string
+	switch e.Code {
+	case 0x01:
+		name = "hardware fault"
+	case 0x03:
+		name = "accessing the object not allowed"
+	case 0x05:
+		name = "address out of range"
+	case 0x06:
+		name = "data type not supported"
+	case 0x07:
+		name = "data type inconsistent"
+	case 0x0A:
+		name = "object does not exist"
+	default:
+		name = "unknown"
+	}
+
+	return fmt.Sprintf("s7: exception '%v' (%s)", e.Code, name)
+}
+
+// Tag.Address 使用西门子的写法：
+// DB1.DBX0.0, DB1.DBB2, DB1.DBW4, DB1.DBD8,
+// M10.1, MB10, MW10, MD10, I0.0, IB0, Q0.0, QW2（E/A 同 I/Q），
+// 字符串为 S7 STRING，需要指定最大长度：DB1.DBB10:20
+type s7Address struct {
+	Area   byte
+	DB     uint16
+	Offset int // 字节偏移
+	Bit    int // -1 表示不按位访问
+	Size   int // 读写的字节数
+}
+
+func parseS7Address(address string, dataType string) (s7Address, error) {
+	addr := s7Address{Bit: -1}
+
+	s := strings.ToUpper(strings.TrimSpace(address))
+	if s == "" {
+		return addr, errors.New("s7: address is empty")
+	}
+
+	strLen := 0
+	if i := strings.Index(s, ":"); i >= 0 {
+		n, err := strconv.Atoi(s[i+1:])
+		if err != nil || n <= 0 || n > 254 {
+			return addr, fmt.Errorf("s7: invalid string length in address %q", address)
+		}
+
+		strLen = n
+		s = s[:i]
+	}
+
+	if strings.HasPrefix(s, "DB") {
+		i := strings.Index(s, ".")
+		if i < 0 {
+			return addr, fmt.Errorf("s7: invalid address %q", address)
+		}
+
+		db, err := strconv.ParseUint(s[2:i], 10, 16)
+		if err != nil {
+			return addr, fmt.Errorf("s7: invalid db number in address %q", address)
+		}
+
+		addr.Area = S7AreaDB
+		addr.DB = uint16(db)
+		s = s[i+1:]
+
+		if !strings.HasPrefix(s, "DB") {
+			return addr, fmt.Errorf("s7: invalid address %q", address)
+		}
+
+		s = s[2:]
+	} else {
+		switch s[0] {
+		case 'I', 'E':
+			addr.Area = S7AreaI
+		case 'Q', 'A':
+			addr.Area = S7AreaQ
+		case 'M':
+			addr.Area = S7AreaM
+		default:
+			return addr, fmt.Errorf("s7: unknown area in address %q", address)
+		}
+
+		s = s[1:]
+	}
+
+	// 宽度标识，X: 位，B: 字节，W: 字，D: 双字，省略时为位
+	width := byte('X')
+	if len(s) > 0 && (s[0] < '0' || s[0] > '9') {
+		width = s[0]
+		s = s[1:]
+	}
+
+	switch width {
+	case 'X', 'B', 'W', 'D':
+	default:
+		return addr, fmt.Errorf("s7: invalid width in address %q", address)
+	}
+
+	if i := strings.Index(s, "."); i >= 0 {
+		bit, err := strconv.Atoi(s[i+1:])
+		if err != nil || bit < 0 || bit > 7 {
+			return addr, fmt.Errorf("s7: invalid bit in address %q", address)
+		}
+
+		addr.Bit = bit
+		s = s[:i]
+	}
+
+	offset, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return addr, fmt.Errorf("s7: invalid offset in address %q", address)
+	}
+
+	addr.Offset = int(offset)
+
+	switch dataType {
+	case device.TypeBool:
+		if addr.Bit < 0 {
+			if width != 'X' {
+				// 按字节读取，非 0 为 true
+				addr.Size = 1
+				return addr, nil
+			}
+
+			return addr, fmt.Errorf("s7: bool address %q need bit, eg: M10.1", address)
+		}
+
+		addr.Size = 1
+	case device.TypeString:
+		if strLen == 0 {
+			return addr, fmt.Errorf("s7: string address %q need length, eg: DB1.DBB10:20", address)
+		}
+
+		addr.Size = strLen + 2
+	default:
+		size := device.TypeSize(dataType)
+		if size == 0 {
+			return addr, fmt.Errorf("s7: unsupported data type: %v", dataType)
+		}
+
+		if addr.Bit >= 0 {
+			return addr, fmt.Errorf("s7: bit address only support %v", device.TypeBool)
+		}
+
+		addr.Size = size
+	}
+
+	return addr, nil
+}
+
+// 将读取到的原始数据解码为标签的值
+func s7Decode(addr s7Address, dataType string, raw []byte) (nson.Value, error) {
+	if len(raw) < addr.Size {
+		return nil, fmt.Errorf("s7: need %v bytes, provide: %v", addr.Size, len(raw))
+	}
+
+	if dataType == device.TypeString {
+		// S7 STRING：最大长度，实际长度，字符
+		n := int(raw[1])
+		if n > len(raw)-2 {
+			n = len(raw) - 2
+		}
+
+		return nson.String(raw[2 : 2+n]), nil
+	}
+
+	return decodeValue(dataType, raw[:addr.Size])
+}
+
+// 将标签的值编码为写入的数据
+func s7Encode(addr s7Address, dataType string, value nson.Value) ([]byte, error) {
+	if dataType == device.TypeString {
+		s, err := encodeValue(dataType, value, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		max := addr.Size - 2
+		if len(s) > max {
+			s = s[:max]
+		}
+
+		b := make([]byte, addr.Size)
+		b[0] = byte(max)
+		b[1] = byte(len(s))
+		copy(b[2:], s)
+		return b, nil
+	}
+
+	return encodeValue(dataType, value, 0)
+}
+
+type S7TCP struct {
+	conn    net.Conn
+	tracer  *Tracer
+	timeout time.Duration
+	pduSize int
+	pduRef  uint16
+	planner BlockPlanner
+}
+
+var _ Driver = &S7TCP{}
+var _ ByteCounter = &S7TCP{}
+
+func (s *S7TCP) Connect(slot device.Slot) (Driver, error) {
+	var params s7Params
+
+	u, err := url.ParseQuery(slot.Params)
+	if err != nil {
+		return nil, err
+	}
+
+	err = util.MapConfig(&params, u)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.Host == "" {
+		return nil, fmt.Errorf("s7: slot %v params need host", slot.Name)
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(params.Host, strconv.Itoa(params.Port)), params.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn = newCountingConn(conn)
+
+	tracer := traceFor(slot.ID)
+	tracer.SetPort(params.Port)
+
+	s7 := &S7TCP{
+		conn:    conn,
+		tracer:  tracer,
+		timeout: params.Timeout,
+		pduSize: params.PDU,
+	}
+
+	err = s7.isoConnect(byte(params.Type), byte(params.Rack*0x20+params.Slot))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	err = s7.negotiate()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// 读响应头部：参数 2 字节 + 数据项头部 4 字节 + S7 头部 12 字节
+	s7.planner = BlockPlanner{MaxCount: s7.pduSize - 18, MaxGap: params.Gap}
+
+	return s7, nil
+}
+
+// 收发的字节数
+func (s *S7TCP) Bytes() (uint64, uint64) {
+	if c, ok := s.conn.(ByteCounter); ok {
+		return c.Bytes()
+	}
+
+	return 0, 0
+}
+
+func (s *S7TCP) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+
+	return s.conn.Close()
+}
+
+func (s *S7TCP) Name() string {
+	return device.DriverS7TCP
+}
+
+// 同一数据区、同一数据块中相近的地址合并为一个请求
+func (s *S7TCP) Read(tags []device.Tag) error {
+	addrs := make([]s7Address, len(tags))
+	items := make([]BlockItem, 0, len(tags))
+
+	for i := 0; i < len(tags); i++ {
+		tags[i].Value = nil
+
+		addr, err := parseS7Address(tags[i].Address, tags[i].DataType)
+		if err != nil {
+			log.Suger.Warnf("tag: %v(%v): %v", tags[i].Name, tags[i].ID, err)
+			continue
+		}
+
+		addrs[i] = addr
+		items = append(items, BlockItem{
+			Index: i,
+			Area:  fmt.Sprintf("%02X.%v", addr.Area, addr.DB),
+			Start: addr.Offset,
+			Count: addr.Size,
+		})
+	}
+
+	for _, block := range s.planner.Plan(items) {
+		err := s.readBlock(tags, addrs, block)
+		if err == nil {
+			continue
+		}
+
+		// 设备返回的错误只影响对应的标签，其他错误需要重新连接
+		if _, ok := err.(*S7Error); !ok {
+			return err
+		}
+
+		if len(block.Items) == 1 {
+			tag := &tags[block.Items[0].Index]
+			log.Suger.Warnf("tag: %v(%v): %v", tag.Name, tag.ID, err)
+			continue
+		}
+
+		// 合并后的请求可能包含超出范围的地址，逐个重新读取
+		for _, item := range block.Items {
+			err = s.readBlock(tags, addrs, Block{
+				Area:  item.Area,
+				Start: item.Start,
+				Count: item.Count,
+				Items: []BlockItem{item},
+			})
+
+			if err != nil {
+				if _, ok := err.(*S7Error); !ok {
+					return err
+				}
+
+				tag := &tags[item.Index]
+				log.Suger.Warnf("tag: %v(%v): %v", tag.Name, tag.ID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *S7TCP) readBlock(tags []device.Tag, addrs []s7Address, block Block) error {
+	first := addrs[block.Items[0].Index]
+
+	raw, err := s.readArea(s7Address{
+		Area:   first.Area,
+		DB:     first.DB,
+		Offset: block.Start,
+		Bit:    -1,
+		Size:   block.Count,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, item := range block.Items {
+		tag := &tags[item.Index]
+		addr := addrs[item.Index]
+
+		data := block.Bytes(raw, item, 1)
+		if addr.Bit >= 0 && len(data) > 0 {
+			data = []byte{data[0] >> uint(addr.Bit) & 0x01}
+		}
+
+		value, err := s7Decode(addr, tag.DataType, data)
+		if err != nil {
+			log.Suger.Warnf("tag: %v(%v): %v", tag.Name, tag.ID, err)
+			continue
+		}
+
+		tag.Value = value
+	}
+
+	return nil
+}
+
+// 地址和编码错误在发送前检查，只影响对应的标签，不断开连接
+func (s *S7TCP) Write(tags []device.Tag) error {
+	errs := make(TagErrors, len(tags))
+
+	for i := 0; i < len(tags); i++ {
+		addr, err := parseS7Address(tags[i].Address, tags[i].DataType)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		data, err := s7Encode(addr, tags[i].DataType, tags[i].Value)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		err = s.writeArea(addr, data)
+		if err != nil {
+			if _, ok := err.(*S7Error); !ok {
+				return err
+			}
+
+			errs[i] = err
+		}
+	}
+
+	return errs.Err()
+}
+
+// 建立 ISO 连接（COTP CR/CC）
+func (s *S7TCP) isoConnect(connType byte, rackSlot byte) error {
+	cr := []byte{
+		0x03, 0x00, 0x00, 0x16, // TPKT
+		0x11,       // COTP 长度
+		0xE0,       // CR
+		0x00, 0x00, // 目的引用
+		0x00, 0x01, // 源引用
+		0x00,             // class 0
+		0xC0, 0x01, 0x0A, // TPDU 大小 1024
+		0xC1, 0x02, 0x01, 0x00, // 本地 TSAP
+		0xC2, 0x02, connType, rackSlot, // 远端 TSAP
+	}
+
+	resp, err := s.roundTrip(cr)
+	if err != nil {
+		return err
+	}
+
+	if len(resp) < 6 || resp[5] != 0xD0 {
+		return errors.New("s7: iso connect refused")
+	}
+
+	return nil
+}
+
+// 协商 PDU 大小
+func (s *S7TCP) negotiate() error {
+	param := []byte{s7FuncSetup, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00}
+	binary.BigEndian.PutUint16(param[6:], uint16(s.pduSize))
+
+	resp, err := s.request(param, nil)
+	if err != nil {
+		return err
+	}
+
+	if len(resp) < 8 || resp[0] != s7FuncSetup {
+		return errors.New("s7: invalid setup communication response")
+	}
+
+	s.pduSize = int(binary.BigEndian.Uint16(resp[6:]))
+	if s.pduSize < 64 {
+		return fmt.Errorf("s7: pdu size %v too small", s.pduSize)
+	}
+
+	return nil
+}
+
+func (s *S7TCP) readArea(addr s7Address) ([]byte, error) {
+	transport := byte(s7TransportByte)
+	start := addr.Offset * 8
+	if addr.Bit >= 0 {
+		transport = s7TransportBit
+		start += addr.Bit
+	}
+
+	// 读响应头部：参数 2 字节 + 数据项头部 4 字节 + S7 头部 12 字节
+	max := s.pduSize - 18
+	data := make([]byte, 0, addr.Size)
+
+	for len(data) < addr.Size {
+		n := addr.Size - len(data)
+		if n > max {
+			n = max
+		}
+
+		param := []byte{s7FuncRead, 0x01}
+		param = append(param, s7Item(transport, uint16(n), addr.DB, addr.Area, start+len(data)*8)...)
+
+		resp, err := s.request(param, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		items, err := s7ParseReadResponse(resp, 1)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(items[0]) < n {
+			return nil, fmt.Errorf("s7: need %v bytes, provide: %v", n, len(items[0]))
+		}
+
+		data = append(data, items[0][:n]...)
+	}
+
+	return data, nil
+}
+
+func (s *S7TCP) writeArea(addr s7Address, data []byte) error {
+	if addr.Bit >= 0 {
+		param := []byte{s7FuncWrite, 0x01}
+		param = append(param, s7Item(s7TransportBit, 1, addr.DB, addr.Area, addr.Offset*8+addr.Bit)...)
+
+		value := []byte{0x00, s7ReturnBit, 0x00, 0x01, data[0]}
+
+		resp, err := s.request(param, value)
+		if err != nil {
+			return err
+		}
+
+		return s7ParseWriteResponse(resp, 1)
+	}
+
+	// 写请求头部：S7 头部 10 字节 + 参数 14 字节 + 数据项头部 4 字节
+	max := s.pduSize - 28
+
+	for sent := 0; sent < len(data); {
+		n := len(data) - sent
+		if n > max {
+			n = max
+		}
+
+		param := []byte{s7FuncWrite, 0x01}
+		param = append(param, s7Item(s7TransportByte, uint16(n), addr.DB, addr.Area, (addr.Offset+sent)*8)...)
+
+		value := []byte{0x00, s7ReturnByte, 0x00, 0x00}
+		binary.BigEndian.PutUint16(value[2:], uint16(n*8))
+		value = append(value, data[sent:sent+n]...)
+
+		resp, err := s.request(param, value)
+		if err != nil {
+			return err
+		}
+
+		err = s7ParseWriteResponse(resp, 1)
+		if err != nil {
+			return err
+		}
+
+		sent += n
+	}
+
+	return nil
+}
+
+// 读写请求中的变量描述
+func s7Item(transport byte, length uint16, db uint16, area byte, start int) []byte {
+	item := []byte{
+		0x12, 0x0A, 0x10,
+		transport,
+		0x00, 0x00, // 长度
+		0x00, 0x00, // DB 号
+		area,
+		byte(start >> 16), byte(start >> 8), byte(start),
+	}
+
+	binary.BigEndian.PutUint16(item[4:], length)
+	if area == S7AreaDB {
+		binary.BigEndian.PutUint16(item[6:], db)
+	}
+
+	return item
+}
+
+// 解析读响应，返回的第一个字节为参数
+func s7ParseReadResponse(resp []byte, count int) ([][]byte, error) {
+	if len(resp) < 2 || resp[0] != s7FuncRead || int(resp[1]) != count {
+		return nil, errors.New("s7: invalid read response")
+	}
+
+	data := resp[2:]
+	items := make([][]byte, 0, count)
+
+	for i := 0; i < count; i++ {
+		if len(data) < 4 {
+			return nil, errors.New("s7: read response too short")
+		}
+
+		if data[0] != s7Success {
+			return nil, &S7Error{Code: data[0]}
+		}
+
+		size := int(binary.BigEndian.Uint16(data[2:]))
+		switch data[1] {
+		case s7ReturnByte, s7ReturnInt:
+			size = size / 8
+		case s7ReturnBit, s7ReturnReal, s7ReturnOctet:
+		default:
+			return nil, fmt.Errorf("s7: unknown transport size %v", data[1])
+		}
+
+		if len(data) < 4+size {
+			return nil, errors.New("s7: read response too short")
+		}
+
+		items = append(items, data[4:4+size])
+
+		next := 4 + size
+		if size%2 != 0 && i < count-1 {
+			next++
+		}
+
+		if next > len(data) {
+			next = len(data)
+		}
+
+		data = data[next:]
+	}
+
+	return items, nil
+}
+
+func s7ParseWriteResponse(resp []byte, count int) error {
+	if len(resp) < 2+count || resp[0] != s7FuncWrite || int(resp[1]) != count {
+		return errors.New("s7: invalid write response")
+	}
+
+	for i := 0; i < count; i++ {
+		if resp[2+i] != s7Success {
+			return &S7Error{Code: resp[2+i]}
+		}
+	}
+
+	return nil
+}
+
+// 发送 S7 Job，返回 Ack_Data 中的参数和数据
+func (s *S7TCP) request(param []byte, data []byte) ([]byte, error) {
+	s.pduRef++
+
+	pdu := make([]byte, 0, s7IsoHeaderSize+10+len(param)+len(data))
+	pdu = append(pdu, 0x03, 0x00, 0x00, 0x00, 0x02, 0xF0, 0x80)
+	pdu = append(pdu, 0x32, s7ROSCTRJob, 0x00, 0x00)
+	pdu = append(pdu, byte(s.pduRef>>8), byte(s.pduRef))
+	pdu = append(pdu, byte(len(param)>>8), byte(len(param)))
+	pdu = append(pdu, byte(len(data)>>8), byte(len(data)))
+	pdu = append(pdu, param...)
+	pdu = append(pdu, data...)
+
+	binary.BigEndian.PutUint16(pdu[2:], uint16(len(pdu)))
+
+	resp, err := s.roundTrip(pdu)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp) < s7IsoHeaderSize+12 || resp[5] != 0xF0 {
+		return nil, errors.New("s7: invalid response")
+	}
+
+	resp = resp[s7IsoHeaderSize:]
+
+	if resp[0] != 0x32 || resp[1] != s7ROSCTRAckData {
+		return nil, errors.New("s7: invalid response header")
+	}
+
+	if binary.BigEndian.Uint16(resp[4:]) != s.pduRef {
+		return nil, errors.New("s7: pdu reference mismatch")
+	}
+
+	if resp[10] != 0 || resp[11] != 0 {
+		return nil, fmt.Errorf("s7: error class '%v', code '%v'", resp[10], resp[11])
+	}
+
+	size := 12 + int(binary.BigEndian.Uint16(resp[6:])) + int(binary.BigEndian.Uint16(resp[8:]))
+	if len(resp) < size {
+		return nil, errors.New("s7: response too short")
+	}
+
+	return resp[12:size], nil
+}
+
+// 发送一个 TPKT 报文并读取响应
+func (s *S7TCP) roundTrip(packet []byte) ([]byte, error) {
+	err := s.conn.SetDeadline(time.Now().Add(s.timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	s.tracer.TX(packet)
+
+	_, err = s.conn.Write(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s7ReadTPKT(s.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	s.tracer.RX(resp)
+
+	return resp, nil
+}
+
+func s7ReadTPKT(r io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if header[0] != 0x03 {
+		return nil, errors.New("s7: invalid tpkt version")
+	}
+
+	size := int(binary.BigEndian.Uint16(header[2:]))
+	if size < 7 {
+		return nil, errors.New("s7: invalid tpkt length")
+	}
+
+	packet := make([]byte, size)
+	copy(packet, header)
+
+	_, err = io.ReadFull(r, packet[4:])
+	if err != nil {
+		return nil, err
+	}
+
+	return packet, nil
+}
@@ -0,0 +1,367 @@
+package collect
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/danclive/july/device"
+	"github.com/danclive/nson-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// 用于测试的 S7 服务端，支持建立连接、PDU 协商和读写变量
+type fakeS7Server struct {
+	ln    net.Listener
+	lock  sync.Mutex
+	areas map[uint32][]byte
+	reads int // 读请求的数量
+}
+
+func newFakeS7Server(t *testing.T) *fakeS7Server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeS7Server{
+		ln:    ln,
+		areas: make(map[uint32][]byte),
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go f.serve(conn)
+		}
+	}()
+
+	return f
+}
+
+func (f *fakeS7Server) Close() {
+	f.ln.Close()
+}
+
+func (f *fakeS7Server) Mem(area byte, db uint16) []byte {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	key := uint32(area)<<16 | uint32(db)
+	if _, ok := f.areas[key]; !ok {
+		f.areas[key] = make([]byte, 1024)
+	}
+
+	return f.areas[key]
+}
+
+func (f *fakeS7Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		packet, err := s7ReadTPKT(conn)
+		if err != nil {
+			return
+		}
+
+		// COTP CR
+		if packet[5] == 0xE0 {
+			cc := make([]byte, len(packet))
+			copy(cc, packet)
+			cc[5] = 0xD0
+			conn.Write(cc)
+			continue
+		}
+
+		job := packet[s7IsoHeaderSize:]
+		ref := job[4:6]
+		plen := int(binary.BigEndian.Uint16(job[6:]))
+		dlen := int(binary.BigEndian.Uint16(job[8:]))
+		param := job[10 : 10+plen]
+		data := job[10+plen : 10+plen+dlen]
+
+		var rparam, rdata []byte
+
+		switch param[0] {
+		case s7FuncSetup:
+			rparam = param
+		case s7FuncRead:
+			f.lock.Lock()
+			f.reads++
+			f.lock.Unlock()
+
+			rparam = param[:2]
+			for i := 0; i < int(param[1]); i++ {
+				item := param[2+i*12 : 14+i*12]
+				mem, start, length := f.item(item)
+
+				if start+length > len(mem) {
+					rdata = append(rdata, 0x05, 0x00, 0x00, 0x00)
+					continue
+				}
+
+				if item[3] == s7TransportBit {
+					b := byte(0)
+					if mem[start/8]&(1<<uint(start%8)) != 0 {
+						b = 1
+					}
+					rdata = append(rdata, s7Success, s7ReturnBit, 0x00, 0x01, b)
+				} else {
+					rdata = append(rdata, s7Success, s7ReturnByte, byte(length*8>>8), byte(length*8))
+					rdata = append(rdata, mem[start/8:start/8+length]...)
+				}
+
+				if len(rdata)%2 != 0 && i < int(param[1])-1 {
+					rdata = append(rdata, 0x00)
+				}
+			}
+		case s7FuncWrite:
+			rparam = param[:2]
+			for i := 0; i < int(param[1]); i++ {
+				item := param[2+i*12 : 14+i*12]
+				mem, start, length := f.item(item)
+
+				size := int(binary.BigEndian.Uint16(data[2:]))
+				if data[1] == s7ReturnByte {
+					size = size / 8
+				}
+
+				if start/8+size > len(mem) {
+					rdata = append(rdata, 0x05)
+				} else {
+					f.lock.Lock()
+					if item[3] == s7TransportBit {
+						if data[4] != 0 {
+							mem[start/8] |= 1 << uint(start%8)
+						} else {
+							mem[start/8] &^= 1 << uint(start%8)
+						}
+					} else {
+						copy(mem[start/8:start/8+length], data[4:4+size])
+					}
+					f.lock.Unlock()
+
+					rdata = append(rdata, s7Success)
+				}
+
+				next := 4 + size
+				if size%2 != 0 {
+					next++
+				}
+				if next > len(data) {
+					next = len(data)
+				}
+				data = data[next:]
+			}
+		}
+
+		resp := []byte{0x03, 0x00, 0x00, 0x00, 0x02, 0xF0, 0x80, 0x32, s7ROSCTRAckData, 0x00, 0x00}
+		resp = append(resp, ref...)
+		resp = append(resp, byte(len(rparam)>>8), byte(len(rparam)), byte(len(rdata)>>8), byte(len(rdata)), 0x00, 0x00)
+		resp = append(resp, rparam...)
+		resp = append(resp, rdata...)
+		binary.BigEndian.PutUint16(resp[2:], uint16(len(resp)))
+
+		conn.Write(resp)
+	}
+}
+
+func (f *fakeS7Server) item(item []byte) ([]byte, int, int) {
+	length := int(binary.BigEndian.Uint16(item[4:]))
+	db := binary.BigEndian.Uint16(item[6:])
+	start := int(item[9])<<16 | int(item[10])<<8 | int(item[11])
+
+	return f.Mem(item[8], db), start, length
+}
+
+func TestParseS7Address(t *testing.T) {
+	addr, err := parseS7Address("DB1.DBX0.3", device.TypeBool)
+	assert.Nil(t, err)
+	assert.Exactly(t, s7Address{Area: S7AreaDB, DB: 1, Offset: 0, Bit: 3, Size: 1}, addr)
+
+	addr, err = parseS7Address("db10.dbd8", device.TypeF32)
+	assert.Nil(t, err)
+	assert.Exactly(t, s7Address{Area: S7AreaDB, DB: 10, Offset: 8, Bit: -1, Size: 4}, addr)
+
+	addr, err = parseS7Address("MW10", device.TypeI16)
+	assert.Nil(t, err)
+	assert.Exactly(t, s7Address{Area: S7AreaM, Offset: 10, Bit: -1, Size: 2}, addr)
+
+	addr, err = parseS7Address("E1.7", device.TypeBool)
+	assert.Nil(t, err)
+	assert.Exactly(t, s7Address{Area: S7AreaI, Offset: 1, Bit: 7, Size: 1}, addr)
+
+	addr, err = parseS7Address("DB2.DBB10:20", device.TypeString)
+	assert.Nil(t, err)
+	assert.Exactly(t, 22, addr.Size)
+
+	_, err = parseS7Address("M10", device.TypeBool)
+	assert.NotNil(t, err)
+	_, err = parseS7Address("DB1.DBB0", device.TypeString)
+	assert.NotNil(t, err)
+	_, err = parseS7Address("MW10.1", device.TypeI16)
+	assert.NotNil(t, err)
+	_, err = parseS7Address("X10", device.TypeI16)
+	assert.NotNil(t, err)
+}
+
+func TestS7TCP(t *testing.T) {
+	serv := newFakeS7Server(t)
+	defer serv.Close()
+
+	host, port, _ := net.SplitHostPort(serv.ln.Addr().String())
+
+	db1 := serv.Mem(S7AreaDB, 1)
+	db1[0] = 0x08
+	binary.BigEndian.PutUint32(db1[4:], 0x3FC00000)
+	binary.BigEndian.PutUint64(db1[8:], 0xFFFFFFFFFFFFFFFE)
+	copy(db1[20:], []byte{10, 5, 'h', 'e', 'l', 'l', 'o'})
+
+	m := serv.Mem(S7AreaM, 0)
+	binary.BigEndian.PutUint16(m[10:], 0xFF38)
+
+	conn, err := (&S7TCP{}).Connect(device.Slot{
+		Name:   "plc",
+		Driver: device.DriverS7TCP,
+		Params: "host=" + host + "&port=" + port + "&rack=0&slot=1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tags := []device.Tag{
+		{Name: "bit", Address: "DB1.DBX0.3", DataType: device.TypeBool},
+		{Name: "f32", Address: "DB1.DBD4", DataType: device.TypeF32},
+		{Name: "i64", Address: "DB1.DBB8", DataType: device.TypeI64},
+		{Name: "str", Address: "DB1.DBB20:10", DataType: device.TypeString},
+		{Name: "mw", Address: "MW10", DataType: device.TypeI16},
+		{Name: "out", Address: "DB1.DBD2000", DataType: device.TypeU32},
+	}
+
+	err = conn.Read(tags)
+	assert.Nil(t, err)
+
+	assert.Exactly(t, nson.Bool(true), tags[0].Value)
+	assert.Exactly(t, nson.F32(1.5), tags[1].Value)
+	assert.Exactly(t, nson.I64(-2), tags[2].Value)
+	assert.Exactly(t, nson.String("hello"), tags[3].Value)
+	assert.Exactly(t, nson.I32(-200), tags[4].Value)
+	assert.Nil(t, tags[5].Value)
+
+	writes := []device.Tag{
+		{Name: "bit", Address: "DB1.DBX0.3", DataType: device.TypeBool, Value: nson.Bool(false)},
+		{Name: "q", Address: "Q0.1", DataType: device.TypeBool, Value: nson.Bool(true)},
+		{Name: "f64", Address: "DB1.DBB40", DataType: device.TypeF64, Value: nson.F64(-1.25)},
+		{Name: "u16", Address: "MW20", DataType: device.TypeU16, Value: nson.U32(513)},
+		{Name: "str", Address: "DB1.DBB20:10", DataType: device.TypeString, Value: nson.String("world!")},
+	}
+
+	err = conn.Write(writes)
+	assert.Nil(t, err)
+
+	assert.Exactly(t, byte(0x00), db1[0])
+	assert.Exactly(t, byte(0x02), serv.Mem(S7AreaQ, 0)[0])
+	assert.Exactly(t, []byte{0x02, 0x01}, m[20:22])
+
+	for i := range writes {
+		writes[i].Value = nil
+	}
+
+	err = conn.Read(writes)
+	assert.Nil(t, err)
+	assert.Exactly(t, nson.F64(-1.25), writes[2].Value)
+	assert.Exactly(t, nson.U32(513), writes[3].Value)
+	assert.Exactly(t, nson.String("world!"), writes[4].Value)
+}
+
+func TestS7TCPMergeReads(t *testing.T) {
+	serv := newFakeS7Server(t)
+	defer serv.Close()
+
+	host, port, _ := net.SplitHostPort(serv.ln.Addr().String())
+
+	db1 := serv.Mem(S7AreaDB, 1)
+	db1[0] = 0x02
+	binary.BigEndian.PutUint16(db1[2:], 100)
+	binary.BigEndian.PutUint32(db1[4:], 0x3FC00000)
+
+	db2 := serv.Mem(S7AreaDB, 2)
+	binary.BigEndian.PutUint16(db2[2:], 200)
+
+	conn, err := (&S7TCP{}).Connect(device.Slot{
+		Name:   "plc",
+		Driver: device.DriverS7TCP,
+		Params: "host=" + host + "&port=" + port,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tags := []device.Tag{
+		{Name: "bit", Address: "DB1.DBX0.1", DataType: device.TypeBool},
+		{Name: "w", Address: "DB1.DBW2", DataType: device.TypeI16},
+		{Name: "f32", Address: "DB1.DBD4", DataType: device.TypeF32},
+		{Name: "other", Address: "DB2.DBW2", DataType: device.TypeI16},
+		{Name: "m", Address: "MW2", DataType: device.TypeI16},
+	}
+
+	err = conn.Read(tags)
+	assert.Nil(t, err)
+
+	assert.Exactly(t, nson.Bool(true), tags[0].Value)
+	assert.Exactly(t, nson.I32(100), tags[1].Value)
+	assert.Exactly(t, nson.F32(1.5), tags[2].Value)
+	assert.Exactly(t, nson.I32(200), tags[3].Value)
+	assert.Exactly(t, nson.I32(0), tags[4].Value)
+
+	// DB1 的相邻标签合并为一个请求，不同数据块和数据区分开
+	serv.lock.Lock()
+	assert.Exactly(t, 3, serv.reads)
+	serv.lock.Unlock()
+}
+
+func TestS7TCPWriteTagErrors(t *testing.T) {
+	serv := newFakeS7Server(t)
+	defer serv.Close()
+
+	host, port, _ := net.SplitHostPort(serv.ln.Addr().String())
+
+	conn, err := (&S7TCP{}).Connect(device.Slot{
+		Name:   "plc",
+		Driver: device.DriverS7TCP,
+		Params: "host=" + host + "&port=" + port + "&rack=0&slot=1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tags := []device.Tag{
+		{Name: "bad", Address: "XX1", DataType: device.TypeI16, Value: nson.I32(1)},
+		{Name: "encode", Address: "MW0", DataType: device.TypeI16, Value: nson.String("a")},
+		{Name: "out", Address: "DB1.DBD2000", DataType: device.TypeU32, Value: nson.U32(1)},
+		{Name: "mw", Address: "MW10", DataType: device.TypeU16, Value: nson.U32(513)},
+	}
+
+	// 地址和编码错误只影响对应的标签，不断开连接
+	err = conn.Write(tags)
+	errs, ok := err.(TagErrors)
+	assert.True(t, ok)
+	assert.Exactly(t, 4, len(errs))
+	assert.NotNil(t, errs[0])
+	assert.NotNil(t, errs[1])
+	assert.IsType(t, &S7Error{}, errs[2])
+	assert.Nil(t, errs[3])
+	assert.Exactly(t, []byte{0x02, 0x01}, serv.Mem(S7AreaM, 0)[10:12])
+
+	read := []device.Tag{{Name: "mw", Address: "MW10", DataType: device.TypeU16}}
+	assert.Nil(t, conn.Read(read))
+	assert.Exactly(t, nson.U32(513), read[0].Value)
+}
@@ -0,0 +1,134 @@
+package collect
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/danclive/july/device"
+	"github.com/danclive/july/log"
+)
+
+const DefaultScanClass = "default"
+
+// 扫描类统计，读取时间超过扫描周期时记为超时
+type ScanStats struct {
+	Name         string        `json:"name"`
+	Interval     time.Duration `json:"interval"`
+	Tags         int           `json:"tags"`
+	Bad          int           `json:"bad"` // 最近一次读取质量为坏的标签数量
+	Reads        uint64        `json:"reads"`
+	Overruns     uint64        `json:"overruns"`
+	LastDuration time.Duration `json:"last_duration"`
+	MaxDuration  time.Duration `json:"max_duration"`
+	LastRead     time.Time     `json:"last_read"`
+	LastOverrun  time.Time     `json:"last_overrun"`
+}
+
+// 同一扫描周期的标签，作为一个批次读取
+type scanClass struct {
+	name     string
+	interval time.Duration
+	tags     []device.Tag
+	lock     sync.Mutex
+	stats    ScanStats
+}
+
+// 记录一次读取，返回是否超时
+func (s *scanClass) record(start time.Time, duration time.Duration, bad int) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.stats.Reads++
+	s.stats.Bad = bad
+	s.stats.LastRead = start
+	s.stats.LastDuration = duration
+	if duration > s.stats.MaxDuration {
+		s.stats.MaxDuration = duration
+	}
+
+	if duration > s.interval {
+		s.stats.Overruns++
+		s.stats.LastOverrun = start
+		return true
+	}
+
+	return false
+}
+
+func (s *scanClass) Stats() ScanStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stats := s.stats
+	stats.Name = s.name
+	stats.Interval = s.interval
+	stats.Tags = len(s.tags)
+
+	return stats
+}
+
+// 按扫描类对标签分组，标签的扫描类可以是 slot 定义的名称或周期，无效时使用默认扫描周期
+func buildScanClasses(slot device.Slot, tags []device.Tag, readInterval time.Duration) []*scanClass {
+	defaultInterval := readInterval
+
+	slotConfig, err := slot.ParseConfig()
+	if err != nil {
+		log.Suger.Warnf("slot: %v(%v) config: %v", slot.Name, slot.ID, err)
+	}
+
+	if slotConfig.Scan > 0 {
+		defaultInterval = slotConfig.Scan
+	}
+
+	named := slotConfig.ScanClasses()
+
+	classes := make(map[string]*scanClass)
+
+	for i := 0; i < len(tags); i++ {
+		name, interval := DefaultScanClass, defaultInterval
+
+		tagConfig, err := tags[i].ParseConfig()
+		if err != nil {
+			log.Suger.Warnf("tag: %v(%v) config: %v", tags[i].Name, tags[i].ID, err)
+		}
+
+		if tagConfig.Scan != "" {
+			if v, ok := named[tagConfig.Scan]; ok {
+				name, interval = tagConfig.Scan, v
+			} else if v, err := time.ParseDuration(tagConfig.Scan); err == nil && v > 0 {
+				name, interval = v.String(), v
+			} else {
+				log.Suger.Warnf("tag: %v(%v) unknown scan class %q", tags[i].Name, tags[i].ID, tagConfig.Scan)
+			}
+		}
+
+		class, ok := classes[name]
+		if !ok {
+			class = &scanClass{name: name, interval: interval}
+			classes[name] = class
+		}
+
+		class.tags = append(class.tags, tags[i])
+	}
+
+	// 没有标签时也保留默认扫描类，读取空列表用于检测连接
+	if len(classes) == 0 {
+		classes[DefaultScanClass] = &scanClass{name: DefaultScanClass, interval: defaultInterval}
+	}
+
+	list := make([]*scanClass, 0, len(classes))
+	for _, class := range classes {
+		list = append(list, class)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].interval != list[j].interval {
+			return list[i].interval < list[j].interval
+		}
+
+		return list[i].name < list[j].name
+	})
+
+	return list
+}
@@ -0,0 +1,125 @@
+package collect
+
+import (
+	"testing"
+	"time"
+
+	"github.com/danclive/july/device"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildScanClasses(t *testing.T) {
+	// 格式错误的扫描类不影响其他扫描类
+	slot := device.Slot{ID: "1", Config: "scan=2s&class=fast:100ms&class=bad&class=slow:1h&class=zero:0s"}
+	tags := []device.Tag{
+		{Name: "a", Config: "scan=fast"},
+		{Name: "b"},
+		{Name: "c", Config: "scan=slow"},
+		{Name: "d", Config: "scan=500ms"},
+		{Name: "e", Config: "scan=fast"},
+		{Name: "f", Config: "scan=unknown"},
+	}
+
+	classes := buildScanClasses(slot, tags, time.Second)
+	assert.Exactly(t, 4, len(classes))
+
+	names := func(class *scanClass) []string {
+		list := make([]string, 0)
+		for _, tag := range class.tags {
+			list = append(list, tag.Name)
+		}
+		return list
+	}
+
+	assert.Exactly(t, "fast", classes[0].name)
+	assert.Exactly(t, time.Millisecond*100, classes[0].interval)
+	assert.Exactly(t, []string{"a", "e"}, names(classes[0]))
+	assert.Exactly(t, "500ms", classes[1].name)
+	assert.Exactly(t, []string{"d"}, names(classes[1]))
+	assert.Exactly(t, DefaultScanClass, classes[2].name)
+	assert.Exactly(t, time.Second*2, classes[2].interval)
+	assert.Exactly(t, []string{"b", "f"}, names(classes[2]))
+	assert.Exactly(t, "slow", classes[3].name)
+
+	classes = buildScanClasses(device.Slot{}, nil, time.Second)
+	assert.Exactly(t, 1, len(classes))
+	assert.Exactly(t, time.Second, classes[0].interval)
+}
+
+func TestWireScanClasses(t *testing.T) {
+	initCache()
+
+	driver := &fakeDriver{delay: time.Millisecond * 30, reads: make(map[string]int)}
+
+	slot := device.Slot{ID: "1", Config: "class=fast:20ms&class=slow:200ms"}
+	tags := []device.Tag{
+		{ID: "a", Name: "a", Config: "scan=fast"},
+		{ID: "b", Name: "b", Config: "scan=slow"},
+	}
+
+	wire := NewWire(driver, slot, tags, time.Minute, time.Second)
+	go wire.Run()
+
+	time.Sleep(time.Millisecond * 500)
+	<-wire.Close()
+
+	assert.True(t, driver.Reads("a") > driver.Reads("b"))
+	assert.True(t, driver.Reads("b") >= 1)
+	assert.NotNil(t, CacheGet("a"))
+
+	stats := wire.ScanStats()
+	assert.Exactly(t, 2, len(stats))
+	assert.Exactly(t, "fast", stats[0].Name)
+	assert.True(t, stats[0].Reads > 0)
+	assert.Exactly(t, stats[0].Reads, stats[0].Overruns)
+	assert.Exactly(t, "slow", stats[1].Name)
+	assert.Exactly(t, uint64(0), stats[1].Overruns)
+}
+
+func TestWireReload(t *testing.T) {
+	initCache()
+
+	driver := &fakeDriver{reads: make(map[string]int)}
+	slot := device.Slot{ID: "1", Config: "class=fast:10ms"}
+	tags := []device.Tag{
+		{ID: "a", Name: "a", Config: "scan=fast"},
+		{ID: "b", Name: "b", Config: "scan=fast"},
+	}
+
+	wire := NewWire(driver, slot, tags, time.Minute, time.Hour)
+	go wire.Run()
+
+	time.Sleep(time.Millisecond * 50)
+	assert.True(t, driver.Reads("a") > 0)
+	assert.Exactly(t, 0, driver.Reads("c"))
+
+	// 删除 b，添加 c
+	err := wire.Reload([]device.Tag{
+		{ID: "a", Name: "a", Config: "scan=fast"},
+		{ID: "c", Name: "c", Config: "scan=fast"},
+	})
+	assert.Nil(t, err)
+
+	_, ok := CacheGetRecord("b")
+	assert.False(t, ok)
+
+	reads := driver.Reads("b")
+	time.Sleep(time.Millisecond * 50)
+	assert.True(t, driver.Reads("c") > 0)
+	assert.Exactly(t, reads, driver.Reads("b"))
+
+	// 连接没有断开，统计保留
+	select {
+	case <-wire.closeComplete:
+		t.Fatal("wire closed")
+	default:
+	}
+
+	stats := wire.ScanStats()
+	assert.Exactly(t, 1, len(stats))
+	assert.Exactly(t, "fast", stats[0].Name)
+	assert.True(t, stats[0].Reads > uint64(driver.Reads("c")))
+
+	<-wire.Close()
+	assert.Exactly(t, ErrSlotOffline, wire.Reload(tags))
+}
@@ -0,0 +1,297 @@
+package collect
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danclive/july/device"
+	"github.com/danclive/july/log"
+	"github.com/danclive/july/util"
+	"github.com/danclive/nson-go"
+)
+
+func init() {
+	RegisterDriver(device.DriverSimulator, &Simulator{})
+}
+
+// 波形
+const (
+	WaveSine     = "sine"     // 正弦：offset + amplitude * sin(2π(t/period + phase))
+	WaveRamp     = "ramp"     // 锯齿：在一个周期内从 min 线性增加到 max
+	WaveSquare   = "square"   // 方波：周期内前 duty 比例为 max，其余为 min
+	WaveRandom   = "random"   // 随机游走：从 offset 开始，每次读取变化不超过 step，限制在 min~max
+	WaveConstant = "constant" // 常量：value
+	WaveCounter  = "counter"  // 计数器：从 offset 开始，每次读取增加 step，limit 不为 0 时超过后回到 offset
+)
+
+// Slot.Params，例如：seed=1&scale=10&step=1s
+// seed 为随机数种子，0 表示使用当前时间；
+// scale 为时间倍率；
+// step 不为 0 时，每次读取时间前进 step，不再使用系统时间，便于测试。
+type simulatorParams struct {
+	Seed  int64         `cfg:"seed,default=0"`
+	Scale float64       `cfg:"scale,default=1"`
+	Step  time.Duration `cfg:"step,default=0s"`
+}
+
+// Tag.Address 为波形和参数，例如：
+// sine?period=60s&amplitude=10&offset=20
+// ramp?period=10s&min=0&max=100
+// square?period=2s&duty=0.5&min=0&max=1
+// random?offset=50&step=0.5&min=0&max=100
+// constant?value=hello
+// counter?offset=0&step=1&limit=1000
+type simulatorWave struct {
+	Kind      string        `cfg:"-"`
+	Period    time.Duration `cfg:"period,default=60s"`
+	Amplitude float64       `cfg:"amplitude,default=1"`
+	Offset    float64       `cfg:"offset,default=0"`
+	Phase     float64       `cfg:"phase,default=0"`
+	Min       float64       `cfg:"min,default=0"`
+	Max       float64       `cfg:"max,default=100"`
+	Duty      float64       `cfg:"duty,default=0.5"`
+	Step      float64       `cfg:"step,default=1"`
+	Limit     float64       `cfg:"limit,default=0"`
+	Value     string        `cfg:"value"`
+}
+
+func parseSimulatorWave(address string) (*simulatorWave, error) {
+	kind, query := address, ""
+	if i := strings.Index(address, "?"); i >= 0 {
+		kind, query = address[:i], address[i+1:]
+	}
+
+	wave := &simulatorWave{Kind: strings.ToLower(strings.TrimSpace(kind))}
+
+	switch wave.Kind {
+	case WaveSine, WaveRamp, WaveSquare, WaveRandom, WaveConstant, WaveCounter:
+	default:
+		return nil, fmt.Errorf("simulator: unknown wave %q", kind)
+	}
+
+	u, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	err = util.MapConfig(wave, u)
+	if err != nil {
+		return nil, err
+	}
+
+	if wave.Period <= 0 {
+		return nil, fmt.Errorf("simulator: invalid period in address %q", address)
+	}
+
+	return wave, nil
+}
+
+// 计算 t 时刻的值
+func (w *simulatorWave) At(t time.Duration) float64 {
+	cycle := float64(t)/float64(w.Period) + w.Phase
+	frac := cycle - math.Floor(cycle)
+
+	switch w.Kind {
+	case WaveSine:
+		return w.Offset + w.Amplitude*math.Sin(2*math.Pi*cycle)
+	case WaveRamp:
+		return w.Min + (w.Max-w.Min)*frac
+	case WaveSquare:
+		if frac < w.Duty {
+			return w.Max
+		}
+
+		return w.Min
+	case WaveConstant:
+		f, _ := strconv.ParseFloat(w.Value, 64)
+		return f
+	}
+
+	return 0
+}
+
+type simulatorState struct {
+	wave    *simulatorWave
+	address string
+	value   float64    // 随机游走和计数器的当前值
+	written nson.Value // 写入的值，不为 nil 时代替波形
+}
+
+type Simulator struct {
+	rand   *rand.Rand
+	scale  float64
+	step   time.Duration
+	start  time.Time
+	reads  int64
+	states map[string]*simulatorState
+}
+
+var _ Driver = &Simulator{}
+
+func (s *Simulator) Connect(slot device.Slot) (Driver, error) {
+	var params simulatorParams
+
+	u, err := url.ParseQuery(slot.Params)
+	if err != nil {
+		return nil, err
+	}
+
+	err = util.MapConfig(&params, u)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.Seed == 0 {
+		params.Seed = time.Now().UnixNano()
+	}
+
+	return &Simulator{
+		rand:   rand.New(rand.NewSource(params.Seed)),
+		scale:  params.Scale,
+		step:   params.Step,
+		start:  time.Now(),
+		states: make(map[string]*simulatorState),
+	}, nil
+}
+
+func (s *Simulator) Close() error {
+	return nil
+}
+
+func (s *Simulator) Name() string {
+	return device.DriverSimulator
+}
+
+// 模拟时间
+func (s *Simulator) now() time.Duration {
+	var elapsed time.Duration
+
+	if s.step > 0 {
+		elapsed = time.Duration(s.reads) * s.step
+	} else {
+		elapsed = time.Since(s.start)
+	}
+
+	return time.Duration(float64(elapsed) * s.scale)
+}
+
+func (s *Simulator) state(tag *device.Tag) (*simulatorState, error) {
+	key := tag.ID
+	if key == "" {
+		key = tag.Name
+	}
+
+	if state, ok := s.states[key]; ok && state.address == tag.Address {
+		return state, nil
+	}
+
+	wave, err := parseSimulatorWave(tag.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &simulatorState{
+		wave:    wave,
+		address: tag.Address,
+		value:   wave.Offset,
+	}
+
+	if wave.Kind == WaveCounter {
+		// 第一次读取时为 offset
+		state.value -= wave.Step
+	}
+
+	s.states[key] = state
+
+	return state, nil
+}
+
+func (s *Simulator) Read(tags []device.Tag) error {
+	t := s.now()
+	s.reads++
+
+	for i := 0; i < len(tags); i++ {
+		tags[i].Value = nil
+
+		state, err := s.state(&tags[i])
+		if err != nil {
+			log.Suger.Warnf("tag: %v(%v): %v", tags[i].Name, tags[i].ID, err)
+			continue
+		}
+
+		if state.written != nil {
+			tags[i].Value = state.written
+			continue
+		}
+
+		wave := state.wave
+
+		if wave.Kind == WaveConstant && tags[i].DataType == device.TypeString {
+			tags[i].Value = nson.String(wave.Value)
+			continue
+		}
+
+		var f float64
+
+		switch wave.Kind {
+		case WaveRandom:
+			state.value += (s.rand.Float64()*2 - 1) * wave.Step
+			state.value = math.Max(wave.Min, math.Min(wave.Max, state.value))
+			f = state.value
+		case WaveCounter:
+			state.value += wave.Step
+			if wave.Limit != 0 && state.value > wave.Limit {
+				state.value = wave.Offset
+			}
+			f = state.value
+		default:
+			f = wave.At(t)
+		}
+
+		value, err := valueFromFloat64(tags[i].DataType, f)
+		if err != nil {
+			log.Suger.Warnf("tag: %v(%v): %v", tags[i].Name, tags[i].ID, err)
+			continue
+		}
+
+		tags[i].Value = value
+	}
+
+	return nil
+}
+
+func (s *Simulator) Write(tags []device.Tag) error {
+	errs := make(TagErrors, len(tags))
+
+	for i := 0; i < len(tags); i++ {
+		if tags[i].Value == nil {
+			continue
+		}
+
+		state, err := s.state(&tags[i])
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		// 随机游走和计数器从写入的值继续变化，其他波形保持写入的值
+		if state.wave.Kind == WaveRandom || state.wave.Kind == WaveCounter {
+			if f, ok := util.NsonValueToFloat64(tags[i].Value); ok {
+				state.value = f
+				if state.wave.Kind == WaveCounter {
+					state.value -= state.wave.Step
+				}
+				continue
+			}
+		}
+
+		state.written = tags[i].Value
+	}
+
+	return errs.Err()
+}
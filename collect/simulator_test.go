@@ -0,0 +1,86 @@
+package collect
+
+import (
+	"testing"
+
+	"github.com/danclive/july/device"
+	"github.com/danclive/nson-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSimulator(t *testing.T) {
+	slot := device.Slot{
+		Name:   "sim",
+		Driver: device.DriverSimulator,
+		Params: "seed=1&scale=1&step=250ms",
+	}
+
+	conn, err := (&Simulator{}).Connect(slot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tags := []device.Tag{
+		{ID: "1", Address: "sine?period=1s&amplitude=10&offset=5", DataType: device.TypeF64},
+		{ID: "2", Address: "ramp?period=1s&min=0&max=100", DataType: device.TypeI32},
+		{ID: "3", Address: "square?period=1s&duty=0.5&max=1", DataType: device.TypeBool},
+		{ID: "4", Address: "counter?offset=10&step=2&limit=14", DataType: device.TypeU16},
+		{ID: "5", Address: "constant?value=hello", DataType: device.TypeString},
+		{ID: "6", Address: "random?offset=50&step=1&min=0&max=100", DataType: device.TypeF32},
+		{ID: "7", Address: "unknown", DataType: device.TypeF32},
+	}
+
+	expect := [][]nson.Value{
+		{nson.F64(5), nson.I32(0), nson.Bool(true), nson.U32(10), nson.String("hello")},
+		{nson.F64(15), nson.I32(25), nson.Bool(true), nson.U32(12), nson.String("hello")},
+		{nson.F64(5), nson.I32(50), nson.Bool(false), nson.U32(14), nson.String("hello")},
+		{nson.F64(-5), nson.I32(75), nson.Bool(false), nson.U32(10), nson.String("hello")},
+	}
+
+	walk := make([]nson.Value, 0)
+
+	for i := 0; i < len(expect); i++ {
+		err = conn.Read(tags)
+		assert.Nil(t, err)
+
+		for j := 0; j < len(expect[i]); j++ {
+			if f, ok := tags[j].Value.(nson.F64); ok {
+				assert.InDelta(t, float64(expect[i][j].(nson.F64)), float64(f), 1e-9)
+			} else {
+				assert.Exactly(t, expect[i][j], tags[j].Value)
+			}
+		}
+
+		assert.Nil(t, tags[6].Value)
+
+		f := float32(tags[5].Value.(nson.F32))
+		assert.True(t, f >= 46 && f <= 54)
+		walk = append(walk, tags[5].Value)
+	}
+
+	// 相同种子的结果相同
+	conn2, _ := (&Simulator{}).Connect(slot)
+	for i := 0; i < len(walk); i++ {
+		conn2.Read(tags)
+		assert.Exactly(t, walk[i], tags[5].Value)
+	}
+
+	writes := []device.Tag{
+		{ID: "1", Address: tags[0].Address, DataType: device.TypeF64, Value: nson.F64(123)},
+		{ID: "4", Address: tags[3].Address, DataType: device.TypeU16, Value: nson.U32(12)},
+	}
+
+	err = conn.Write(writes)
+	assert.Nil(t, err)
+
+	err = conn.Read(tags)
+	assert.Nil(t, err)
+	assert.Exactly(t, nson.F64(123), tags[0].Value)
+	assert.Exactly(t, nson.U32(12), tags[3].Value)
+
+	err = conn.Read(tags)
+	assert.Nil(t, err)
+	assert.Exactly(t, nson.F64(123), tags[0].Value)
+	assert.Exactly(t, nson.U32(14), tags[3].Value)
+}
@@ -0,0 +1,191 @@
+package collect
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// slot 的连接状态
+type ConnState string
+
+const (
+	StateDisconnected ConnState = "disconnected"
+	StateConnecting   ConnState = "connecting"
+	StateConnected    ConnState = "connected"
+	StateBackoff      ConnState = "backoff"
+)
+
+// 连接失败后最长的等待时间
+const DefaultMaxBackoff = time.Minute * 5
+
+// 退避时间的随机抖动比例，避免多个设备同时重连
+const backoffJitter = 0.2
+
+// slot 的连接状态，可以用于查看设备连接不上的原因
+type SlotState struct {
+	SlotID        string    `json:"slot_id"`
+	State         ConnState `json:"state"`
+	Attempts      int       `json:"attempts"` // 连续失败次数，连接成功后清零
+	LastError     string    `json:"last_error"`
+	LastErrorTime time.Time `json:"last_error_time"`
+	LastAttempt   time.Time `json:"last_attempt"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	NextAttempt   time.Time `json:"next_attempt"` // 退避结束的时间
+}
+
+// 第 attempts 次连续失败后的等待时间，从 min 开始翻倍，最长为 max，并加入随机抖动
+func backoffDelay(min, max time.Duration, attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	delay := float64(min) * math.Pow(2, float64(attempts-1))
+	if delay > float64(max) {
+		delay = float64(max)
+	}
+
+	delay *= 1 - backoffJitter + 2*backoffJitter*rand.Float64()
+
+	return time.Duration(delay)
+}
+
+// 所有 slot 的连接状态机：
+// disconnected/backoff -> connecting -> connected -> disconnected/backoff，
+// connecting 失败时进入 backoff。
+type connStates struct {
+	lock   sync.Mutex
+	min    time.Duration
+	max    time.Duration
+	states map[string]*SlotState
+}
+
+func newConnStates(min, max time.Duration) *connStates {
+	if max < min {
+		max = min
+	}
+
+	return &connStates{
+		min:    min,
+		max:    max,
+		states: make(map[string]*SlotState),
+	}
+}
+
+func (s *connStates) state(slotID string) *SlotState {
+	state, ok := s.states[slotID]
+	if !ok {
+		state = &SlotState{SlotID: slotID, State: StateDisconnected}
+		s.states[slotID] = state
+	}
+
+	return state
+}
+
+// 是否可以开始连接，可以时进入 connecting 状态
+func (s *connStates) begin(slotID string, now time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	state := s.state(slotID)
+
+	switch state.State {
+	case StateConnecting, StateConnected:
+		return false
+	case StateBackoff:
+		if now.Before(state.NextAttempt) {
+			return false
+		}
+	}
+
+	state.State = StateConnecting
+	state.LastAttempt = now
+
+	return true
+}
+
+func (s *connStates) connected(slotID string, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	state := s.state(slotID)
+	state.State = StateConnected
+	state.Attempts = 0
+	state.ConnectedAt = now
+	state.NextAttempt = time.Time{}
+}
+
+// 连接失败或者异常断开，进入 backoff 状态，返回等待时间
+func (s *connStates) failed(slotID string, err error, now time.Time) time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	state := s.state(slotID)
+	state.Attempts++
+	state.LastError = err.Error()
+	state.LastErrorTime = now
+
+	delay := backoffDelay(s.min, s.max, state.Attempts)
+	state.State = StateBackoff
+	state.NextAttempt = now.Add(delay)
+
+	return delay
+}
+
+// 主动断开，下次可以立即连接
+func (s *connStates) disconnected(slotID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	state := s.state(slotID)
+	state.State = StateDisconnected
+	state.Attempts = 0
+	state.NextAttempt = time.Time{}
+}
+
+// 删除不再启用的 slot 的状态，正在连接和已连接的除外
+func (s *connStates) retain(slotIDs map[string]struct{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for id, state := range s.states {
+		if _, ok := slotIDs[id]; ok {
+			continue
+		}
+
+		if state.State == StateConnecting || state.State == StateConnected {
+			continue
+		}
+
+		delete(s.states, id)
+	}
+}
+
+func (s *connStates) get(slotID string) (SlotState, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if state, ok := s.states[slotID]; ok {
+		return *state, true
+	}
+
+	return SlotState{}, false
+}
+
+func (s *connStates) list() []SlotState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	list := make([]SlotState, 0, len(s.states))
+	for _, state := range s.states {
+		list = append(list, *state)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].SlotID < list[j].SlotID
+	})
+
+	return list
+}
@@ -0,0 +1,71 @@
+package collect
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	within := func(d, expected time.Duration) bool {
+		return d >= time.Duration(float64(expected)*(1-backoffJitter)) &&
+			d <= time.Duration(float64(expected)*(1+backoffJitter))
+	}
+
+	for i := 0; i < 100; i++ {
+		assert.True(t, within(backoffDelay(time.Second, time.Minute, 0), time.Second))
+		assert.True(t, within(backoffDelay(time.Second, time.Minute, 1), time.Second))
+		assert.True(t, within(backoffDelay(time.Second, time.Minute, 3), time.Second*4))
+		assert.True(t, within(backoffDelay(time.Second, time.Minute, 10), time.Minute))
+		assert.True(t, within(backoffDelay(time.Second, time.Minute, 1000), time.Minute))
+	}
+}
+
+func TestConnStates(t *testing.T) {
+	states := newConnStates(time.Second, time.Minute)
+	now := time.Now()
+
+	_, ok := states.get("1")
+	assert.False(t, ok)
+
+	assert.True(t, states.begin("1", now))
+	assert.False(t, states.begin("1", now))
+
+	state, ok := states.get("1")
+	assert.True(t, ok)
+	assert.Exactly(t, StateConnecting, state.State)
+	assert.Exactly(t, now, state.LastAttempt)
+
+	delay := states.failed("1", errors.New("refused"), now)
+	state, _ = states.get("1")
+	assert.Exactly(t, StateBackoff, state.State)
+	assert.Exactly(t, 1, state.Attempts)
+	assert.Exactly(t, "refused", state.LastError)
+	assert.Exactly(t, now.Add(delay), state.NextAttempt)
+
+	// 退避结束前不能连接
+	assert.False(t, states.begin("1", now))
+	assert.True(t, states.begin("1", state.NextAttempt))
+
+	states.failed("1", errors.New("timeout"), now)
+	state, _ = states.get("1")
+	assert.Exactly(t, 2, state.Attempts)
+	assert.Exactly(t, "timeout", state.LastError)
+
+	assert.True(t, states.begin("1", now.Add(time.Minute*2)))
+	states.connected("1", now)
+	state, _ = states.get("1")
+	assert.Exactly(t, StateConnected, state.State)
+	assert.Exactly(t, 0, state.Attempts)
+	assert.Exactly(t, "timeout", state.LastError)
+
+	states.disconnected("1")
+	assert.True(t, states.begin("2", now))
+	states.failed("2", errors.New("refused"), now)
+
+	states.retain(map[string]struct{}{"1": {}})
+	assert.Exactly(t, 1, len(states.list()))
+	assert.Exactly(t, StateDisconnected, states.list()[0].State)
+}
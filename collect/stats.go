@@ -0,0 +1,317 @@
+package collect
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 错误的分类
+const (
+	ErrorKindConnect  = "connect"  // 连接失败
+	ErrorKindTimeout  = "timeout"  // 读写超时
+	ErrorKindCanceled = "canceled" // 连接关闭时取消的读写
+	ErrorKindTag      = "tag"      // 单个标签读写失败
+	ErrorKindIO       = "io"       // 其他读写错误
+)
+
+// 读写延迟直方图的上限
+var LatencyBuckets = []time.Duration{
+	time.Millisecond,
+	time.Millisecond * 5,
+	time.Millisecond * 10,
+	time.Millisecond * 50,
+	time.Millisecond * 100,
+	time.Millisecond * 500,
+	time.Second,
+	time.Second * 5,
+}
+
+// 驱动可以实现此接口报告收发的字节数
+type ByteCounter interface {
+	Bytes() (read uint64, written uint64)
+}
+
+func errorKind(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrorKindTimeout
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return ErrorKindCanceled
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrorKindTimeout
+	}
+
+	return ErrorKindIO
+}
+
+// 延迟直方图，Counts[i] 为不超过 Buckets[i] 的数量（累计），Count 为总数
+type Histogram struct {
+	Buckets []time.Duration `json:"buckets"`
+	Counts  []uint64        `json:"counts"`
+	Count   uint64          `json:"count"`
+	Sum     time.Duration   `json:"sum"`
+}
+
+func newHistogram() Histogram {
+	return Histogram{
+		Buckets: LatencyBuckets,
+		Counts:  make([]uint64, len(LatencyBuckets)),
+	}
+}
+
+func (h *Histogram) observe(d time.Duration) {
+	h.Count++
+	h.Sum += d
+
+	for i := len(h.Buckets) - 1; i >= 0 && d <= h.Buckets[i]; i-- {
+		h.Counts[i]++
+	}
+}
+
+func (h Histogram) clone() Histogram {
+	h.Counts = append([]uint64{}, h.Counts...)
+	return h
+}
+
+// slot 的读写统计，重新连接时保留
+type WireStats struct {
+	SlotID        string            `json:"slot_id"`
+	SlotName      string            `json:"slot_name"`
+	Connected     bool              `json:"connected"`
+	Connects      uint64            `json:"connects"`
+	Reconnects    uint64            `json:"reconnects"`
+	ConnectedAt   time.Time         `json:"connected_at"`
+	Reads         uint64            `json:"reads"`
+	ReadTags      uint64            `json:"read_tags"`
+	Writes        uint64            `json:"writes"`
+	WriteTags     uint64            `json:"write_tags"`
+	Errors        map[string]uint64 `json:"errors"`
+	LastRead      time.Time         `json:"last_read"` // 最近一次成功的读取
+	LastWrite     time.Time         `json:"last_write"`
+	LastError     string            `json:"last_error"`
+	LastErrorTime time.Time         `json:"last_error_time"`
+	ReadLatency   Histogram         `json:"read_latency"`
+	WriteLatency  Histogram         `json:"write_latency"`
+	BytesRead     uint64            `json:"bytes_read"`
+	BytesWritten  uint64            `json:"bytes_written"`
+}
+
+type wireStats struct {
+	lock    sync.Mutex
+	stats   WireStats
+	counter ByteCounter // 当前连接的字节统计
+}
+
+func newWireStats(slotID, slotName string) *wireStats {
+	return &wireStats{
+		stats: WireStats{
+			SlotID:       slotID,
+			SlotName:     slotName,
+			Errors:       make(map[string]uint64),
+			ReadLatency:  newHistogram(),
+			WriteLatency: newHistogram(),
+		},
+	}
+}
+
+func (s *wireStats) errorLocked(kind string, count uint64, err error, now time.Time) {
+	s.stats.Errors[kind] += count
+	s.stats.LastError = err.Error()
+	s.stats.LastErrorTime = now
+}
+
+// 连接成功，counter 为驱动的字节统计，驱动不支持时为 nil
+func (s *wireStats) connected(counter ByteCounter, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.stats.Connects > 0 {
+		s.stats.Reconnects++
+	}
+
+	s.stats.Connects++
+	s.stats.Connected = true
+	s.stats.ConnectedAt = now
+	s.counter = counter
+}
+
+// 连接断开，累计当前连接的字节数
+func (s *wireStats) disconnected() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.counter != nil {
+		read, written := s.counter.Bytes()
+		s.stats.BytesRead += read
+		s.stats.BytesWritten += written
+		s.counter = nil
+	}
+
+	s.stats.Connected = false
+}
+
+func (s *wireStats) connectFailed(err error, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.errorLocked(ErrorKindConnect, 1, err, now)
+}
+
+// 记录一次读取，bad 为读取失败的标签数量
+func (s *wireStats) read(tags int, bad int, d time.Duration, err error, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.stats.Reads++
+	s.stats.ReadLatency.observe(d)
+
+	if err != nil {
+		s.errorLocked(errorKind(err), 1, err, now)
+		return
+	}
+
+	s.stats.ReadTags += uint64(tags)
+	s.stats.LastRead = now
+
+	if bad > 0 {
+		s.errorLocked(ErrorKindTag, uint64(bad), errors.New("bad quality"), now)
+	}
+}
+
+// 记录一次写入
+func (s *wireStats) write(tags int, d time.Duration, err error, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.stats.Writes++
+	s.stats.WriteTags += uint64(tags)
+	s.stats.WriteLatency.observe(d)
+
+	if errs, ok := err.(TagErrors); ok {
+		failed := 0
+		for _, e := range errs {
+			if e != nil {
+				failed++
+			}
+		}
+
+		s.errorLocked(ErrorKindTag, uint64(failed), err, now)
+		s.stats.LastWrite = now
+		return
+	}
+
+	if err != nil {
+		s.errorLocked(errorKind(err), 1, err, now)
+		return
+	}
+
+	s.stats.LastWrite = now
+}
+
+func (s *wireStats) Stats() WireStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stats := s.stats
+	stats.ReadLatency = stats.ReadLatency.clone()
+	stats.WriteLatency = stats.WriteLatency.clone()
+
+	stats.Errors = make(map[string]uint64, len(s.stats.Errors))
+	for k, v := range s.stats.Errors {
+		stats.Errors[k] = v
+	}
+
+	if s.counter != nil {
+		read, written := s.counter.Bytes()
+		stats.BytesRead += read
+		stats.BytesWritten += written
+	}
+
+	return stats
+}
+
+// slot 的统计，不存在时创建
+func (c *Service) slotStats(slotID, slotName string) *wireStats {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+
+	stats, ok := c.stats[slotID]
+	if !ok {
+		stats = newWireStats(slotID, slotName)
+		c.stats[slotID] = stats
+	}
+
+	return stats
+}
+
+// slot 的读写统计，slot 没有连接过时返回 false
+func (c *Service) WireStats(slotId string) (WireStats, bool) {
+	c.statsLock.Lock()
+	stats, ok := c.stats[slotId]
+	c.statsLock.Unlock()
+
+	if !ok {
+		return WireStats{}, false
+	}
+
+	return stats.Stats(), true
+}
+
+// 所有 slot 的读写统计
+func (c *Service) WireStatsList() []WireStats {
+	c.statsLock.Lock()
+	list := make([]*wireStats, 0, len(c.stats))
+	for _, stats := range c.stats {
+		list = append(list, stats)
+	}
+	c.statsLock.Unlock()
+
+	result := make([]WireStats, 0, len(list))
+	for _, stats := range list {
+		result = append(result, stats.Stats())
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].SlotID < result[j].SlotID
+	})
+
+	return result
+}
+
+// 统计收发字节数的 net.Conn
+type countingConn struct {
+	net.Conn
+	read    uint64
+	written uint64
+}
+
+var _ ByteCounter = &countingConn{}
+
+func newCountingConn(conn net.Conn) *countingConn {
+	return &countingConn{Conn: conn}
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.read, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.written, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Bytes() (uint64, uint64) {
+	return atomic.LoadUint64(&c.read), atomic.LoadUint64(&c.written)
+}
@@ -0,0 +1,120 @@
+package collect
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/danclive/july/device"
+	"github.com/danclive/nson-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram()
+	h.observe(time.Millisecond)
+	h.observe(time.Millisecond * 7)
+	h.observe(time.Minute)
+
+	assert.Exactly(t, []uint64{1, 1, 2, 2, 2, 2, 2, 2}, h.Counts)
+	assert.Exactly(t, uint64(3), h.Count)
+	assert.Exactly(t, time.Minute+time.Millisecond*8, h.Sum)
+}
+
+func TestErrorKind(t *testing.T) {
+	assert.Exactly(t, ErrorKindTimeout, errorKind(context.DeadlineExceeded))
+	assert.Exactly(t, ErrorKindCanceled, errorKind(context.Canceled))
+	assert.Exactly(t, ErrorKindTimeout, errorKind(&net.OpError{Op: "read", Err: timeoutError{}}))
+	assert.Exactly(t, ErrorKindIO, errorKind(errors.New("eof")))
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestCountingConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	conn := newCountingConn(a)
+	defer conn.Close()
+
+	go func() {
+		buf := make([]byte, 5)
+		b.Read(buf)
+		b.Write([]byte("abc"))
+	}()
+
+	conn.Write([]byte("hello"))
+	conn.Read(make([]byte, 3))
+
+	read, written := conn.Bytes()
+	assert.Exactly(t, uint64(3), read)
+	assert.Exactly(t, uint64(5), written)
+}
+
+func TestWireStats(t *testing.T) {
+	initCache()
+
+	driver := &fakeDriver{reads: make(map[string]int), writes: make(map[string]nson.Value)}
+	tags := []device.Tag{
+		{ID: "a", Name: "a"},
+		{ID: "b", Name: "b", Address: "fail"},
+	}
+
+	service := &Service{stats: make(map[string]*wireStats)}
+	stats := service.slotStats("1", "plc")
+
+	for i := 0; i < 2; i++ {
+		wire := NewWire(driver, device.Slot{ID: "1", Name: "plc"}, tags, time.Minute, time.Millisecond*10)
+		wire.stats = stats
+		go wire.Run()
+
+		time.Sleep(time.Millisecond * 50)
+
+		err := wire.SendContext(context.Background(), []device.Tag{
+			{Name: "a", Value: nson.I32(1)},
+			{Name: "b", Address: "fail", Value: nson.I32(1)},
+		})
+		assert.NotNil(t, err)
+
+		<-wire.Close()
+	}
+
+	s, ok := service.WireStats("1")
+	assert.True(t, ok)
+	assert.False(t, s.Connected)
+	assert.Exactly(t, uint64(2), s.Connects)
+	assert.Exactly(t, uint64(1), s.Reconnects)
+	assert.True(t, s.Reads > 0)
+
+	// 关闭时可能取消正在进行的读取
+	reads := s.Reads - s.Errors[ErrorKindCanceled]
+	assert.Exactly(t, reads*2, s.ReadTags)
+	assert.Exactly(t, uint64(2), s.Writes)
+	assert.Exactly(t, uint64(4), s.WriteTags)
+	assert.Exactly(t, reads+2, s.Errors[ErrorKindTag])
+	assert.Exactly(t, s.Reads, s.ReadLatency.Count)
+	assert.False(t, s.LastRead.IsZero())
+
+	stats.connectFailed(errors.New("refused"), time.Now())
+	assert.Exactly(t, uint64(1), service.WireStatsList()[0].Errors[ErrorKindConnect])
+
+	_, ok = service.WireStats("2")
+	assert.False(t, ok)
+
+	var buf bytes.Buffer
+	assert.Nil(t, service.WriteMetrics(&buf))
+
+	metrics := buf.String()
+	assert.Contains(t, metrics, "# TYPE july_collect_reads_total counter\n")
+	assert.Contains(t, metrics, `july_collect_connects_total{slot_id="1",slot_name="plc"} 2`+"\n")
+	assert.Contains(t, metrics, `july_collect_errors_total{slot_id="1",slot_name="plc",kind="connect"} 1`+"\n")
+	assert.Contains(t, metrics, `july_collect_read_latency_seconds_bucket{slot_id="1",slot_name="plc",le="+Inf"}`)
+	assert.Contains(t, metrics, `july_collect_write_latency_seconds_count{slot_id="1",slot_name="plc"} 2`+"\n")
+}
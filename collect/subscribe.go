@@ -0,0 +1,185 @@
+package collect
+
+import (
+	"path"
+	"sync"
+	"sync/atomic"
+)
+
+// 订阅的缓冲区满时的处理方式
+type OverflowPolicy int
+
+const (
+	OverflowDropNewest OverflowPolicy = iota // 丢弃新的事件
+	OverflowDropOldest                       // 丢弃缓冲区中最旧的事件
+	OverflowClose                            // 关闭订阅
+)
+
+const DefaultSubscribeBuffer = 256
+
+// 标签值变化事件
+type Event struct {
+	TagID  string `json:"tag_id"`
+	SlotID string `json:"slot_id"`
+	Name   string `json:"name"`
+	Record
+}
+
+// 订阅条件，TagIDs、SlotIDs、Names 满足任意一个即可，都为空时订阅所有标签；
+// Names 为标签名称的通配符，例如 temp*，语法与 path.Match 相同。
+type SubscribeOptions struct {
+	TagIDs   []string
+	SlotIDs  []string
+	Names    []string
+	Buffer   int
+	Overflow OverflowPolicy
+}
+
+type Subscription struct {
+	id       uint64
+	c        chan Event
+	tagIDs   map[string]struct{}
+	slotIDs  map[string]struct{}
+	names    []string
+	overflow OverflowPolicy
+	lock     sync.Mutex
+	closed   bool
+	dropped  uint64
+}
+
+var _subs = struct {
+	lock sync.RWMutex
+	next uint64
+	list map[uint64]*Subscription
+}{list: make(map[uint64]*Subscription)}
+
+func Subscribe(opts SubscribeOptions) *Subscription {
+	if opts.Buffer <= 0 {
+		opts.Buffer = DefaultSubscribeBuffer
+	}
+
+	sub := &Subscription{
+		c:        make(chan Event, opts.Buffer),
+		tagIDs:   make(map[string]struct{}),
+		slotIDs:  make(map[string]struct{}),
+		names:    opts.Names,
+		overflow: opts.Overflow,
+	}
+
+	for _, id := range opts.TagIDs {
+		sub.tagIDs[id] = struct{}{}
+	}
+
+	for _, id := range opts.SlotIDs {
+		sub.slotIDs[id] = struct{}{}
+	}
+
+	_subs.lock.Lock()
+	_subs.next++
+	sub.id = _subs.next
+	_subs.list[sub.id] = sub
+	_subs.lock.Unlock()
+
+	return sub
+}
+
+// 事件通道，订阅关闭后通道关闭
+func (s *Subscription) C() <-chan Event {
+	return s.c
+}
+
+// 因缓冲区满丢弃的事件数
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *Subscription) Close() {
+	_subs.lock.Lock()
+	delete(_subs.list, s.id)
+	_subs.lock.Unlock()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		close(s.c)
+	}
+}
+
+func (s *Subscription) match(ev *Event) bool {
+	if len(s.tagIDs) == 0 && len(s.slotIDs) == 0 && len(s.names) == 0 {
+		return true
+	}
+
+	if _, ok := s.tagIDs[ev.TagID]; ok {
+		return true
+	}
+
+	if _, ok := s.slotIDs[ev.SlotID]; ok {
+		return true
+	}
+
+	for _, pattern := range s.names {
+		if ok, _ := path.Match(pattern, ev.Name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// 发送事件，返回 false 表示需要关闭订阅
+func (s *Subscription) push(ev Event) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return true
+	}
+
+	select {
+	case s.c <- ev:
+		return true
+	default:
+	}
+
+	switch s.overflow {
+	case OverflowDropOldest:
+		for {
+			select {
+			case <-s.c:
+				atomic.AddUint64(&s.dropped, 1)
+			default:
+			}
+
+			select {
+			case s.c <- ev:
+				return true
+			default:
+			}
+		}
+	case OverflowClose:
+		atomic.AddUint64(&s.dropped, 1)
+		return false
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+		return true
+	}
+}
+
+func publish(ev Event) {
+	var closing []*Subscription
+
+	_subs.lock.RLock()
+	for _, sub := range _subs.list {
+		if sub.match(&ev) && !sub.push(ev) {
+			closing = append(closing, sub)
+		}
+	}
+	_subs.lock.RUnlock()
+
+	for _, sub := range closing {
+		sub.Close()
+	}
+}
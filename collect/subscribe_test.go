@@ -0,0 +1,96 @@
+package collect
+
+import (
+	"testing"
+
+	"github.com/danclive/july/device"
+	"github.com/danclive/nson-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscribe(t *testing.T) {
+	initCache()
+
+	a := &device.Tag{ID: "a", SlotID: "s1", Name: "temp1"}
+	b := &device.Tag{ID: "b", SlotID: "s2", Name: "temp2"}
+	c := &device.Tag{ID: "c", SlotID: "s2", Name: "pressure"}
+
+	all := Subscribe(SubscribeOptions{})
+	defer all.Close()
+
+	byTag := Subscribe(SubscribeOptions{TagIDs: []string{"a"}})
+	defer byTag.Close()
+
+	bySlot := Subscribe(SubscribeOptions{SlotIDs: []string{"s2"}})
+	defer bySlot.Close()
+
+	byName := Subscribe(SubscribeOptions{Names: []string{"temp*"}})
+	defer byName.Close()
+
+	CacheSetTag(a, Record{Value: nson.I32(1)})
+	CacheSetTag(b, Record{Value: nson.I32(2)})
+	CacheSetTag(c, Record{Value: nson.I32(3)})
+
+	// 已知标签的 slot 和名称
+	CacheSet("a", nson.I32(4))
+	CacheSetQuality("c", QualityBadCommFailure)
+	CacheSetQuality("c", QualityBadCommFailure)
+
+	ids := func(sub *Subscription) []string {
+		list := make([]string, 0)
+		for {
+			select {
+			case ev := <-sub.C():
+				list = append(list, ev.TagID)
+			default:
+				return list
+			}
+		}
+	}
+
+	assert.Exactly(t, []string{"a", "b", "c", "a", "c"}, ids(all))
+	assert.Exactly(t, []string{"a", "a"}, ids(byTag))
+	assert.Exactly(t, []string{"b", "c", "c"}, ids(bySlot))
+	assert.Exactly(t, []string{"a", "b", "a"}, ids(byName))
+}
+
+func TestSubscribeOverflow(t *testing.T) {
+	initCache()
+
+	newest := Subscribe(SubscribeOptions{Buffer: 2, Overflow: OverflowDropNewest})
+	defer newest.Close()
+
+	oldest := Subscribe(SubscribeOptions{Buffer: 2, Overflow: OverflowDropOldest})
+	defer oldest.Close()
+
+	closing := Subscribe(SubscribeOptions{Buffer: 2, Overflow: OverflowClose})
+
+	for i := 0; i < 4; i++ {
+		CacheSet("a", nson.I32(i))
+	}
+
+	values := func(sub *Subscription) []nson.Value {
+		list := make([]nson.Value, 0)
+		for {
+			select {
+			case ev, ok := <-sub.C():
+				if !ok {
+					return list
+				}
+				list = append(list, ev.Value)
+			default:
+				return list
+			}
+		}
+	}
+
+	assert.Exactly(t, []nson.Value{nson.I32(0), nson.I32(1)}, values(newest))
+	assert.Exactly(t, uint64(2), newest.Dropped())
+	assert.Exactly(t, []nson.Value{nson.I32(2), nson.I32(3)}, values(oldest))
+	assert.Exactly(t, uint64(2), oldest.Dropped())
+	assert.Exactly(t, []nson.Value{nson.I32(0), nson.I32(1)}, values(closing))
+
+	_, ok := <-closing.C()
+	assert.False(t, ok)
+	closing.Close()
+}
@@ -0,0 +1,327 @@
+package collect
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 帧的方向
+type FrameDir string
+
+const (
+	FrameTX FrameDir = "TX" // 发送到设备
+	FrameRX FrameDir = "RX" // 从设备接收
+)
+
+// 跟踪缓冲区的默认大小
+const DefaultTraceFrames = 1000
+
+// 驱动收发的一帧数据
+type Frame struct {
+	Time time.Time `json:"time"`
+	Dir  FrameDir  `json:"dir"`
+	Data []byte    `json:"data"`
+}
+
+// slot 的收发帧跟踪，默认关闭，开启后保存最近的帧。
+// 驱动在 Connect 时通过 traceFor 获取，可以在运行时开启和关闭，不需要重新连接。
+// 所有方法都可以用 nil 调用。
+type Tracer struct {
+	enabled     int32
+	port        uint32
+	unsupported int32
+
+	lock    sync.Mutex
+	frames  []Frame
+	next    int
+	full    bool
+	dropped uint64
+}
+
+// 开启跟踪，capacity 为保存的帧数，小于等于 0 时使用 DefaultTraceFrames，
+// 大小变化时清空缓冲区
+func (t *Tracer) Enable(capacity int) {
+	if t == nil {
+		return
+	}
+
+	if capacity <= 0 {
+		capacity = DefaultTraceFrames
+	}
+
+	t.lock.Lock()
+	if len(t.frames) != capacity {
+		t.frames = make([]Frame, capacity)
+		t.next = 0
+		t.full = false
+		t.dropped = 0
+	}
+	t.lock.Unlock()
+
+	atomic.StoreInt32(&t.enabled, 1)
+}
+
+// 关闭跟踪，保留已经记录的帧
+func (t *Tracer) Disable() {
+	if t == nil {
+		return
+	}
+
+	atomic.StoreInt32(&t.enabled, 0)
+}
+
+func (t *Tracer) Enabled() bool {
+	return t != nil && atomic.LoadInt32(&t.enabled) == 1
+}
+
+// 驱动不能跟踪收发的帧时在 Connect 中调用，例如底层库没有暴露连接
+func (t *Tracer) SetUnsupported() {
+	if t == nil {
+		return
+	}
+
+	atomic.StoreInt32(&t.unsupported, 1)
+}
+
+// slot 的驱动是否支持跟踪，驱动连接后才能确定，开启不支持的跟踪不会记录任何帧
+func (t *Tracer) Supported() bool {
+	return t != nil && atomic.LoadInt32(&t.unsupported) == 0
+}
+
+// 清空记录的帧
+func (t *Tracer) Clear() {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.next = 0
+	t.full = false
+	t.dropped = 0
+}
+
+// 设备的端口，用于导出 pcap
+func (t *Tracer) SetPort(port int) {
+	if t == nil {
+		return
+	}
+
+	atomic.StoreUint32(&t.port, uint32(port))
+}
+
+func (t *Tracer) TX(data []byte) {
+	t.add(FrameTX, data)
+}
+
+func (t *Tracer) RX(data []byte) {
+	t.add(FrameRX, data)
+}
+
+func (t *Tracer) add(dir FrameDir, data []byte) {
+	if !t.Enabled() {
+		return
+	}
+
+	frame := Frame{Time: time.Now(), Dir: dir, Data: append([]byte{}, data...)}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if len(t.frames) == 0 {
+		return
+	}
+
+	if t.full {
+		t.dropped++
+	}
+
+	t.frames[t.next] = frame
+	t.next++
+	if t.next == len(t.frames) {
+		t.next = 0
+		t.full = true
+	}
+}
+
+// 记录的帧，按时间顺序
+func (t *Tracer) Frames() []Frame {
+	if t == nil {
+		return nil
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if !t.full {
+		return append([]Frame{}, t.frames[:t.next]...)
+	}
+
+	list := make([]Frame, 0, len(t.frames))
+	list = append(list, t.frames[t.next:]...)
+	list = append(list, t.frames[:t.next]...)
+
+	return list
+}
+
+// 缓冲区满后被覆盖的帧数
+func (t *Tracer) Dropped() uint64 {
+	if t == nil {
+		return 0
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.dropped
+}
+
+// 以十六进制输出记录的帧
+func (t *Tracer) WriteHex(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	for _, frame := range t.Frames() {
+		_, err := fmt.Fprintf(bw, "%s %s %d bytes\n%s\n",
+			frame.Time.Format(time.RFC3339Nano), frame.Dir, len(frame.Data), hex.Dump(frame.Data))
+		if err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+const (
+	pcapLinkTypeRaw = 101 // 原始 IPv4
+	pcapSnapLen     = 65535
+	pcapHeaderLen   = 40 // IPv4 + TCP
+	pcapLocalPort   = 50000
+)
+
+var (
+	pcapLocalAddr  = []byte{127, 0, 0, 1}
+	pcapDeviceAddr = []byte{127, 0, 0, 2}
+)
+
+// 以 pcap 格式输出记录的帧。每一帧封装为 127.0.0.1:50000 与 127.0.0.2:端口 之间的 TCP 报文，
+// 端口为驱动设置的设备端口，Wireshark 等工具可以按协议解析。
+func (t *Tracer) WritePcap(w io.Writer) error {
+	port := uint16(1)
+	if t != nil {
+		if p := atomic.LoadUint32(&t.port); p > 0 && p <= 0xffff {
+			port = uint16(p)
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkTypeRaw)
+
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+
+	var txSeq, rxSeq uint32 = 1, 1
+
+	for _, frame := range t.Frames() {
+		data := frame.Data
+		if len(data) > pcapSnapLen-pcapHeaderLen {
+			data = data[:pcapSnapLen-pcapHeaderLen]
+		}
+
+		var packet []byte
+		if frame.Dir == FrameTX {
+			packet = pcapPacket(pcapLocalAddr, pcapDeviceAddr, pcapLocalPort, port, txSeq, rxSeq, data)
+			txSeq += uint32(len(data))
+		} else {
+			packet = pcapPacket(pcapDeviceAddr, pcapLocalAddr, port, pcapLocalPort, rxSeq, txSeq, data)
+			rxSeq += uint32(len(data))
+		}
+
+		record := make([]byte, 16)
+		binary.LittleEndian.PutUint32(record[0:], uint32(frame.Time.Unix()))
+		binary.LittleEndian.PutUint32(record[4:], uint32(frame.Time.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+		binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+
+		if _, err := bw.Write(record); err != nil {
+			return err
+		}
+
+		if _, err := bw.Write(packet); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// 构造 IPv4 + TCP 报文，TCP 校验和为 0
+func pcapPacket(src, dst []byte, srcPort, dstPort uint16, seq, ack uint32, data []byte) []byte {
+	packet := make([]byte, pcapHeaderLen+len(data))
+
+	ip := packet[:20]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(packet)))
+	ip[8] = 64 // TTL
+	ip[9] = 6  // TCP
+	copy(ip[12:], src)
+	copy(ip[16:], dst)
+
+	var sum uint32
+	for i := 0; i < 20; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(ip[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	binary.BigEndian.PutUint16(ip[10:], ^uint16(sum))
+
+	tcp := packet[20:40]
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4 // 数据偏移
+	tcp[13] = 0x18   // PSH, ACK
+	binary.BigEndian.PutUint16(tcp[14:], 0xffff)
+
+	copy(packet[40:], data)
+
+	return packet
+}
+
+// slot 的跟踪，不存在时创建
+func (c *Service) Tracer(slotId string) *Tracer {
+	c.traceLock.Lock()
+	defer c.traceLock.Unlock()
+
+	tracer, ok := c.tracers[slotId]
+	if !ok {
+		tracer = &Tracer{}
+		c.tracers[slotId] = tracer
+	}
+
+	return tracer
+}
+
+// 驱动连接时获取 slot 的跟踪，采集服务没有初始化时返回 nil
+func traceFor(slotId string) *Tracer {
+	if _service == nil {
+		return nil
+	}
+
+	return _service.Tracer(slotId)
+}
@@ -0,0 +1,261 @@
+package collect
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/danclive/july/device"
+	"github.com/danclive/july/log"
+	"github.com/danclive/mqtt"
+	"github.com/danclive/nson-go"
+	pahopackets "github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTracer(t *testing.T) {
+	var nilTracer *Tracer
+	nilTracer.TX([]byte{1})
+	assert.Nil(t, nilTracer.Frames())
+	assert.False(t, nilTracer.Enabled())
+
+	tracer := &Tracer{}
+
+	// 默认关闭
+	tracer.TX([]byte{1})
+	assert.Empty(t, tracer.Frames())
+
+	tracer.Enable(3)
+	assert.True(t, tracer.Enabled())
+
+	data := []byte{1}
+	tracer.TX(data)
+	data[0] = 9
+	tracer.RX([]byte{2})
+	assert.Exactly(t, 2, len(tracer.Frames()))
+	assert.Exactly(t, []byte{1}, tracer.Frames()[0].Data)
+	assert.Exactly(t, FrameRX, tracer.Frames()[1].Dir)
+
+	tracer.TX([]byte{3})
+	tracer.RX([]byte{4})
+	tracer.TX([]byte{5})
+
+	frames := tracer.Frames()
+	assert.Exactly(t, 3, len(frames))
+	assert.Exactly(t, []byte{3}, frames[0].Data)
+	assert.Exactly(t, []byte{5}, frames[2].Data)
+	assert.Exactly(t, uint64(2), tracer.Dropped())
+
+	tracer.Disable()
+	tracer.TX([]byte{6})
+	assert.Exactly(t, []byte{5}, tracer.Frames()[2].Data)
+
+	// 大小不变时保留记录
+	tracer.Enable(3)
+	assert.Exactly(t, 3, len(tracer.Frames()))
+
+	var buf bytes.Buffer
+	assert.Nil(t, tracer.WriteHex(&buf))
+	assert.Contains(t, buf.String(), " TX 1 bytes\n00000000  03 ")
+
+	tracer.Clear()
+	assert.Empty(t, tracer.Frames())
+}
+
+func TestTracerPcap(t *testing.T) {
+	tracer := &Tracer{}
+	tracer.Enable(0)
+	tracer.SetPort(502)
+
+	tracer.TX([]byte{1, 2, 3})
+	tracer.RX([]byte{4, 5})
+
+	var buf bytes.Buffer
+	assert.Nil(t, tracer.WritePcap(&buf))
+
+	b := buf.Bytes()
+	assert.Exactly(t, 24+(16+43)+(16+42), len(b))
+	assert.Exactly(t, uint32(0xa1b2c3d4), binary.LittleEndian.Uint32(b))
+	assert.Exactly(t, uint32(pcapLinkTypeRaw), binary.LittleEndian.Uint32(b[20:]))
+
+	// 第一帧
+	record := b[24:]
+	assert.Exactly(t, uint32(43), binary.LittleEndian.Uint32(record[8:]))
+
+	packet := record[16 : 16+43]
+	assert.Exactly(t, byte(0x45), packet[0])
+	assert.Exactly(t, uint16(43), binary.BigEndian.Uint16(packet[2:]))
+
+	// IPv4 头部校验和
+	var sum uint32
+	for i := 0; i < 20; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(packet[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	assert.Exactly(t, uint32(0xffff), sum)
+
+	assert.Exactly(t, uint16(pcapLocalPort), binary.BigEndian.Uint16(packet[20:]))
+	assert.Exactly(t, uint16(502), binary.BigEndian.Uint16(packet[22:]))
+	assert.Exactly(t, []byte{1, 2, 3}, packet[40:])
+
+	// 第二帧方向相反，确认号为发送的字节数
+	packet = b[24+16+43+16:]
+	assert.Exactly(t, uint16(502), binary.BigEndian.Uint16(packet[20:]))
+	assert.Exactly(t, uint32(4), binary.BigEndian.Uint32(packet[28:]))
+	assert.Exactly(t, []byte{4, 5}, packet[40:])
+}
+
+func TestModbusTrace(t *testing.T) {
+	InitService(1, 60, 1)
+
+	serv, address := newModbusServer(t)
+	defer serv.Close()
+
+	host, port, _ := net.SplitHostPort(address)
+
+	tracer := GetService().Tracer("plc")
+	tracer.Enable(10)
+
+	conn, err := (&ModbusTCP{}).Connect(device.Slot{
+		ID:     "plc",
+		Name:   "plc",
+		Driver: device.DriverModbusTCP,
+		Params: "host=" + host + "&port=" + port,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	err = conn.Read([]device.Tag{{Name: "hr", Address: "HR0", DataType: device.TypeU16}})
+	assert.Nil(t, err)
+
+	frames := tracer.Frames()
+	assert.Exactly(t, 2, len(frames))
+	assert.Exactly(t, FrameTX, frames[0].Dir)
+	assert.Exactly(t, FrameRX, frames[1].Dir)
+	// MBAP 头部之后为功能码 3
+	assert.Exactly(t, byte(3), frames[0].Data[7])
+
+	p, _ := strconv.Atoi(port)
+	assert.Exactly(t, uint32(p), tracer.port)
+
+	// 运行时关闭，不需要重新连接
+	tracer.Disable()
+	err = conn.Read([]device.Tag{{Name: "hr", Address: "HR0", DataType: device.TypeU16}})
+	assert.Nil(t, err)
+	assert.Exactly(t, 2, len(tracer.Frames()))
+}
+
+func TestHttpTrace(t *testing.T) {
+	InitService(1, 60, 1)
+
+	serv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"temp":21.5}`))
+	}))
+	defer serv.Close()
+
+	tracer := GetService().Tracer("http")
+	tracer.Enable(10)
+
+	conn, err := (&Http{}).Connect(device.Slot{
+		ID:     "http",
+		Name:   "http",
+		Driver: device.DriverHTTP,
+		Params: "url=" + serv.URL + "/api",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tags := []device.Tag{{Name: "temp", Address: "temp", DataType: device.TypeF32}}
+	assert.Nil(t, conn.Read(tags))
+	assert.Exactly(t, nson.F32(21.5), tags[0].Value)
+
+	frames := tracer.Frames()
+	assert.Exactly(t, 2, len(frames))
+	assert.True(t, bytes.HasPrefix(frames[0].Data, []byte("GET /api HTTP/1.1\r\n")))
+	assert.True(t, bytes.HasPrefix(frames[1].Data, []byte("HTTP/1.1 200 OK\r\n")))
+	assert.True(t, bytes.HasSuffix(frames[1].Data, []byte(`{"temp":21.5}`)))
+
+	_, port, _ := net.SplitHostPort(serv.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	assert.Exactly(t, uint32(p), tracer.port)
+	assert.True(t, tracer.Supported())
+}
+
+func TestMqttClientTrace(t *testing.T) {
+	InitService(1, 60, 1)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := mqtt.NewServer(mqtt.WithTCPListener(ln), mqtt.WithLogger(log.Logger))
+	server.Run()
+	defer server.Stop(context.Background())
+
+	tracer := GetService().Tracer("mqtt")
+	tracer.Enable(10)
+
+	conn, err := (&MqttClient{}).Connect(device.Slot{
+		ID:     "mqtt",
+		Name:   "mqtt",
+		Driver: device.DriverMQTTClient,
+		Params: "broker=tcp://" + ln.Addr().String() + "&topic=status&command=status",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 订阅了写入的主题，发送和接收各一帧
+	err = conn.Write([]device.Tag{{Name: "status", Address: "status", DataType: device.TypeString, Value: nson.String("on")}})
+	assert.Nil(t, err)
+
+	assert.Eventually(t, func() bool {
+		return len(tracer.Frames()) == 2
+	}, time.Second*5, time.Millisecond*20)
+
+	frames := tracer.Frames()
+	assert.Exactly(t, FrameTX, frames[0].Dir)
+	assert.Exactly(t, FrameRX, frames[1].Dir)
+
+	packet, err := pahopackets.ReadPacket(bytes.NewReader(frames[1].Data))
+	assert.Nil(t, err)
+	assert.Exactly(t, "status", packet.(*pahopackets.PublishPacket).TopicName)
+	assert.Exactly(t, []byte(`"on"`), packet.(*pahopackets.PublishPacket).Payload)
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	p, _ := strconv.Atoi(port)
+	assert.Exactly(t, uint32(p), tracer.port)
+}
+
+func TestOpcUATraceUnsupported(t *testing.T) {
+	InitService(1, 60, 1)
+
+	tracer := GetService().Tracer("ua")
+	assert.True(t, tracer.Supported())
+
+	// 连接失败也能确定驱动不支持跟踪
+	(&OpcUA{}).Connect(device.Slot{
+		ID:     "ua",
+		Name:   "ua",
+		Driver: device.DriverOPCUA,
+		Params: "endpoint=opc.tcp://127.0.0.1:1&timeout=100ms",
+	})
+	assert.False(t, tracer.Supported())
+
+	var nilTracer *Tracer
+	assert.False(t, nilTracer.Supported())
+}
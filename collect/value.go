@@ -0,0 +1,163 @@
+package collect
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/danclive/july/device"
+	"github.com/danclive/july/util"
+	"github.com/danclive/nson-go"
+)
+
+// 将大端字节解码为标签数据类型对应的值，b 的长度必须 >= device.TypeSize(dataType)
+func decodeValue(dataType string, b []byte) (nson.Value, error) {
+	size := device.TypeSize(dataType)
+	if dataType != device.TypeString && len(b) < size {
+		return nil, fmt.Errorf("data type %v need %v bytes, provide: %v", dataType, size, len(b))
+	}
+
+	switch dataType {
+	case device.TypeBool:
+		return nson.Bool(b[0] != 0), nil
+	case device.TypeI8:
+		return nson.I32(int8(b[0])), nil
+	case device.TypeU8:
+		return nson.U32(b[0]), nil
+	case device.TypeI16:
+		return nson.I32(int16(binary.BigEndian.Uint16(b))), nil
+	case device.TypeU16:
+		return nson.U32(binary.BigEndian.Uint16(b)), nil
+	case device.TypeI32:
+		return nson.I32(int32(binary.BigEndian.Uint32(b))), nil
+	case device.TypeU32:
+		return nson.U32(binary.BigEndian.Uint32(b)), nil
+	case device.TypeI64:
+		return nson.I64(int64(binary.BigEndian.Uint64(b))), nil
+	case device.TypeU64:
+		return nson.U64(binary.BigEndian.Uint64(b)), nil
+	case device.TypeF32:
+		return nson.F32(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+	case device.TypeF64:
+		return nson.F64(math.Float64frombits(binary.BigEndian.Uint64(b))), nil
+	case device.TypeString:
+		for i := 0; i < len(b); i++ {
+			if b[i] == 0 {
+				return nson.String(b[:i]), nil
+			}
+		}
+
+		return nson.String(b), nil
+	}
+
+	return nil, fmt.Errorf("unsupported data type: %v", dataType)
+}
+
+// 将值编码为大端字节，字符串按 size 截断或补零，size 为 0 时不做处理
+func encodeValue(dataType string, value nson.Value, size int) ([]byte, error) {
+	if value == nil {
+		return nil, fmt.Errorf("value is nil")
+	}
+
+	if dataType == device.TypeString {
+		s, ok := value.(nson.String)
+		if !ok {
+			return nil, fmt.Errorf("data type not match, expect: %v, provide: %v", nson.TAG_STRING, value.Tag())
+		}
+
+		if size == 0 {
+			return []byte(s), nil
+		}
+
+		b := make([]byte, size)
+		copy(b, s)
+		return b, nil
+	}
+
+	if dataType == device.TypeBool {
+		if v, ok := value.(nson.Bool); ok {
+			if v {
+				return []byte{1}, nil
+			}
+
+			return []byte{0}, nil
+		}
+	}
+
+	f, ok := util.NsonValueToFloat64(value)
+	if !ok {
+		return nil, fmt.Errorf("value %v can't convert to %v", value, dataType)
+	}
+
+	switch dataType {
+	case device.TypeBool:
+		if f != 0 {
+			return []byte{1}, nil
+		}
+
+		return []byte{0}, nil
+	case device.TypeI8:
+		return []byte{byte(int8(f))}, nil
+	case device.TypeU8:
+		return []byte{byte(f)}, nil
+	case device.TypeI16:
+		return util.UInt16ToBytes(uint16(int16(f)), true), nil
+	case device.TypeU16:
+		return util.UInt16ToBytes(uint16(f), true), nil
+	case device.TypeI32:
+		return util.UInt32ToBytes(uint32(int32(f)), true), nil
+	case device.TypeU32:
+		return util.UInt32ToBytes(uint32(f), true), nil
+	case device.TypeI64:
+		if v, ok := value.(nson.I64); ok {
+			return util.UInt64ToBytes(uint64(v), true), nil
+		}
+
+		return util.UInt64ToBytes(uint64(int64(f)), true), nil
+	case device.TypeU64:
+		if v, ok := value.(nson.U64); ok {
+			return util.UInt64ToBytes(uint64(v), true), nil
+		}
+
+		return util.UInt64ToBytes(uint64(f), true), nil
+	case device.TypeF32:
+		return util.Float32ToBytes(float32(f), true), nil
+	case device.TypeF64:
+		return util.Float64ToBytes(f, true), nil
+	}
+
+	return nil, fmt.Errorf("unsupported data type: %v", dataType)
+}
+
+// 将浮点数转换为标签数据类型对应的值，整数四舍五入后按位宽截断
+func valueFromFloat64(dataType string, f float64) (nson.Value, error) {
+	switch dataType {
+	case device.TypeBool:
+		return nson.Bool(f != 0), nil
+	case device.TypeI8:
+		return nson.I32(int8(math.Round(f))), nil
+	case device.TypeU8:
+		return nson.U32(uint8(math.Round(f))), nil
+	case device.TypeI16:
+		return nson.I32(int16(math.Round(f))), nil
+	case device.TypeU16:
+		return nson.U32(uint16(math.Round(f))), nil
+	case device.TypeI32:
+		return nson.I32(int32(math.Round(f))), nil
+	case device.TypeU32:
+		return nson.U32(uint32(math.Round(f))), nil
+	case device.TypeI64:
+		return nson.I64(int64(math.Round(f))), nil
+	case device.TypeU64:
+		return nson.U64(uint64(math.Round(f))), nil
+	case device.TypeF32:
+		return nson.F32(f), nil
+	case device.TypeF64:
+		return nson.F64(f), nil
+	case device.TypeString:
+		return nson.String(strconv.FormatFloat(f, 'g', -1, 64)), nil
+	}
+
+	return nil, fmt.Errorf("unsupported data type: %v", dataType)
+}
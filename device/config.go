@@ -0,0 +1,88 @@
+package device
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/danclive/july/log"
+	"github.com/danclive/july/util"
+)
+
+// Slot.Config，例如：scan=1s&class=fast:100ms&class=slow:1h&fault_errors=3&fault_bad_pct=50
+// scan 为默认扫描周期，0 表示使用采集服务的 readInterval；
+// class 定义扫描类，格式为 名称:周期，可以有多个；
+// fault_errors 为连续错误（连接失败、连接断开、写入失败）多少次时标记为故障，0 表示不检测；
+// fault_bad_pct 为质量为坏的标签达到多少百分比时标记为故障，0 表示不检测。
+// 读取成功且质量为坏的标签比例低于 fault_bad_pct 时自动清除故障。
+// retain 为是否保存标签的最后值，重启后恢复，质量为不确定，默认不保存；
+// retain_max_age 不为 0 时，不恢复数据源时间早于此时长的值。
+type SlotConfig struct {
+	Scan         time.Duration `cfg:"scan,default=0s"`
+	Classes      []string      `cfg:"class"`
+	FaultErrors  int           `cfg:"fault_errors,default=3"`
+	FaultBadPct  float64       `cfg:"fault_bad_pct,default=0"`
+	Retain       bool          `cfg:"retain,default=false"`
+	RetainMaxAge time.Duration `cfg:"retain_max_age,default=0s"`
+}
+
+// Tag.Config，例如：scan=fast&deadband=0.5&heartbeat=10m
+// scan 为扫描类名称或扫描周期，为空时使用 slot 的默认扫描周期；
+// deadband 为绝对死区，deadband_pct 为百分比死区（启用量程转换时相对于量程，否则相对于上次的值），
+// 同时设置时，变化需同时超过两个死区才记录；
+// heartbeat 不为 0 时，值没有变化超过 heartbeat 也会记录一次。
+type TagConfig struct {
+	Scan        string        `cfg:"scan"`
+	Deadband    float64       `cfg:"deadband,default=0"`
+	DeadbandPct float64       `cfg:"deadband_pct,default=0"`
+	Heartbeat   time.Duration `cfg:"heartbeat,default=0s"`
+}
+
+// 是否只在值变化时记录
+func (c *TagConfig) ReportByException() bool {
+	return c.Deadband > 0 || c.DeadbandPct > 0 || c.Heartbeat > 0
+}
+
+func parseConfig(ptr interface{}, config string) error {
+	u, err := url.ParseQuery(strings.TrimSpace(config))
+	if err != nil {
+		return err
+	}
+
+	return util.MapConfig(ptr, u)
+}
+
+func (s *Slot) ParseConfig() (SlotConfig, error) {
+	var config SlotConfig
+	err := parseConfig(&config, s.Config)
+	return config, err
+}
+
+// 扫描类名称和周期，跳过格式错误的扫描类
+func (c *SlotConfig) ScanClasses() map[string]time.Duration {
+	classes := make(map[string]time.Duration)
+
+	for _, class := range c.Classes {
+		i := strings.LastIndex(class, ":")
+		if i <= 0 {
+			log.Suger.Warnf("invalid scan class %q", class)
+			continue
+		}
+
+		interval, err := time.ParseDuration(class[i+1:])
+		if err != nil || interval <= 0 {
+			log.Suger.Warnf("invalid scan class %q", class)
+			continue
+		}
+
+		classes[strings.TrimSpace(class[:i])] = interval
+	}
+
+	return classes
+}
+
+func (t *Tag) ParseConfig() (TagConfig, error) {
+	var config TagConfig
+	err := parseConfig(&config, t.Config)
+	return config, err
+}
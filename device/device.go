@@ -3,6 +3,7 @@ package device
 import (
 	"fmt"
 	"strconv"
+	"time"
 
 	"github.com/danclive/july/util"
 	"github.com/danclive/march/consts"
@@ -33,6 +34,19 @@ func (*Slot) TableName() string {
 	return "dev_slots"
 }
 
+// slot 故障状态的变化记录
+type SlotFault struct {
+	ID        int64       `xorm:"pk autoincr 'id'" json:"id"`
+	SlotID    string      `xorm:"index 'slot_id'" json:"slot_id"`
+	Fault     int32       `xorm:"'fault'" json:"fault"`   // 1: 故障，-1：恢复
+	Reason    string      `xorm:"'reason'" json:"reason"` // 故障原因
+	CreatedAt util.MyTime `xorm:"created" json:"created"`
+}
+
+func (*SlotFault) TableName() string {
+	return "dev_slot_faults"
+}
+
 type Tag struct {
 	ID              string      `xorm:"pk 'id'" json:"id"`
 	SlotID          string      `xorm:"slot_id" json:"slot_id"`
@@ -47,6 +61,7 @@ type Tag struct {
 	Access          int32       `xorm:"'access'" json:"access"`   // 读写数据模式， 1: RW，-1: RO
 	Upload          int32       `xorm:"'upload'" json:"upload"`   // 上传数据，1: ON，-1: OFF
 	Save            int32       `xorm:"'save'" json:"save"`       // 保存数据，1: ON，-1: OFF
+	Retain          int32       `xorm:"'retain'" json:"retain"`   // 保持数据，MEM 标签的值保存到 bolt，重启后加载，1: ON，-1: OFF
 	Visible         int32       `xorm:"'visible'" json:"visible"` // 可见性，1: ON，-1: OFF
 	Status          int32       `xorm:"'status'" json:"status"`   // 状态 1: ON，-1: OFF
 	Order           int32       `xorm:"'order'" json:"order"`     // 排序
@@ -58,6 +73,7 @@ type Tag struct {
 	HValue          float64     `xorm:"'hvalue'" json:"hvalue"`   // 量程上限
 	LValue          float64     `xorm:"'lvalue'" json:"lvalue"`   // 量程下限
 	Value           nson.Value  `xorm:"-" json:"value"`
+	SourceTime      time.Time   `xorm:"-" json:"-"` // 数据源时间，驱动可以设置
 	DeletedAt       util.MyTime `xorm:"deleted" json:"-"`
 	CreatedAt       util.MyTime `xorm:"created" json:"created"`
 	UpdatedAt       util.MyTime `xorm:"updated" json:"updated"`
@@ -67,7 +83,16 @@ func (*Tag) TableName() string {
 	return "dev_tags"
 }
 
-const DriverMQTT = "MQTT"
+const (
+	DriverMQTT       = "MQTT"
+	DriverModbusTCP  = "MODBUS-TCP"
+	DriverS7TCP      = "S7-TCP"
+	DriverSimulator  = "SIMULATOR"
+	DriverOPCUA      = "OPC-UA"
+	DriverMQTTClient = "MQTT-CLIENT"
+	DriverHTTP       = "HTTP"
+	DriverExec       = "EXEC"
+)
 
 const (
 	TypeIO  = "IO"
@@ -0,0 +1,339 @@
+package device
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/danclive/july/log"
+)
+
+// slot 和标签的内存索引，InitService 时从数据库加载，通过 Service 创建、更新、删除时同步更新。
+// 用于按名称、ID、地址频繁查询的场景，例如读写标签值和 MQTT 上报；
+// 直接修改数据库后需要调用 ReloadIndex。
+type index struct {
+	lock sync.RWMutex
+
+	slots     map[string]Slot
+	slotNames map[string][]string // 名称 -> ID，同名时按加载或创建的顺序
+
+	tags      map[string]Tag
+	tagNames  map[string][]string // 名称 -> ID，所有 slot
+	slotTags  map[string]string   // slot ID + 名称 -> ID
+	addresses map[string]string   // slot ID + 地址 -> ID
+}
+
+func newIndex() *index {
+	x := &index{}
+	x.reset(nil, nil)
+	return x
+}
+
+func indexKey(slotID, name string) string {
+	return slotID + "\x00" + name
+}
+
+func (x *index) reset(slots []Slot, tags []Tag) {
+	x.slots = make(map[string]Slot, len(slots))
+	x.slotNames = make(map[string][]string, len(slots))
+	x.tags = make(map[string]Tag, len(tags))
+	x.tagNames = make(map[string][]string, len(tags))
+	x.slotTags = make(map[string]string, len(tags))
+	x.addresses = make(map[string]string, len(tags))
+
+	for _, slot := range slots {
+		x.putSlotLocked(slot)
+	}
+
+	for _, tag := range tags {
+		x.putTagLocked(tag)
+	}
+}
+
+func (x *index) load(s *Service) error {
+	slots := make([]Slot, 0)
+	if err := s.NoCache().Find(&slots); err != nil {
+		return err
+	}
+
+	tags := make([]Tag, 0)
+	if err := s.NoCache().Find(&tags); err != nil {
+		return err
+	}
+
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	x.reset(slots, tags)
+
+	return nil
+}
+
+func appendID(list []string, id string) []string {
+	for _, v := range list {
+		if v == id {
+			return list
+		}
+	}
+
+	return append(list, id)
+}
+
+func removeID(list []string, id string) []string {
+	for i, v := range list {
+		if v == id {
+			return append(list[:i:i], list[i+1:]...)
+		}
+	}
+
+	return list
+}
+
+// 调用时需持有锁
+func (x *index) putSlotLocked(slot Slot) {
+	if old, ok := x.slots[slot.ID]; ok && old.Name != slot.Name {
+		x.removeNameLocked(x.slotNames, old.Name, old.ID)
+	}
+
+	x.slots[slot.ID] = slot
+	x.slotNames[slot.Name] = appendID(x.slotNames[slot.Name], slot.ID)
+}
+
+// 调用时需持有锁
+func (x *index) putTagLocked(tag Tag) {
+	if old, ok := x.tags[tag.ID]; ok {
+		x.unlinkTagLocked(old)
+		if old.Name != tag.Name {
+			x.removeNameLocked(x.tagNames, old.Name, old.ID)
+		}
+	}
+
+	x.tags[tag.ID] = tag
+	x.tagNames[tag.Name] = appendID(x.tagNames[tag.Name], tag.ID)
+	x.slotTags[indexKey(tag.SlotID, tag.Name)] = tag.ID
+
+	if tag.Address != "" {
+		x.addresses[indexKey(tag.SlotID, tag.Address)] = tag.ID
+	}
+}
+
+// 调用时需持有锁
+func (x *index) removeNameLocked(names map[string][]string, name, id string) {
+	list := removeID(names[name], id)
+	if len(list) == 0 {
+		delete(names, name)
+	} else {
+		names[name] = list
+	}
+}
+
+// 调用时需持有锁
+func (x *index) removeTagLocked(tag Tag) {
+	delete(x.tags, tag.ID)
+	x.removeNameLocked(x.tagNames, tag.Name, tag.ID)
+	x.unlinkTagLocked(tag)
+}
+
+// 删除 slot ID + 名称、地址的索引，同一 slot 中同名或同地址的其他标签不受影响。
+// 调用时需持有锁
+func (x *index) unlinkTagLocked(tag Tag) {
+	if key := indexKey(tag.SlotID, tag.Name); x.slotTags[key] == tag.ID {
+		delete(x.slotTags, key)
+	}
+
+	if key := indexKey(tag.SlotID, tag.Address); x.addresses[key] == tag.ID {
+		delete(x.addresses, key)
+	}
+}
+
+func (x *index) putSlot(slot Slot) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	x.putSlotLocked(slot)
+}
+
+// 删除 slot，不包括标签，没有 slot 的标签也可以查询
+func (x *index) removeSlot(id string) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	if slot, ok := x.slots[id]; ok {
+		delete(x.slots, id)
+		x.removeNameLocked(x.slotNames, slot.Name, id)
+	}
+}
+
+// 删除 slot 的所有标签
+func (x *index) removeSlotTags(id string) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	for _, tag := range x.tags {
+		if tag.SlotID == id {
+			x.removeTagLocked(tag)
+		}
+	}
+}
+
+func (x *index) putTag(tag Tag) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	x.putTagLocked(tag)
+}
+
+func (x *index) removeTag(id string) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	if tag, ok := x.tags[id]; ok {
+		x.removeTagLocked(tag)
+	}
+}
+
+func (x *index) slot(id string) (*Slot, bool) {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+
+	slot, ok := x.slots[id]
+	if !ok {
+		return nil, false
+	}
+
+	return &slot, true
+}
+
+func (x *index) slotByName(name string) (*Slot, bool) {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+
+	list := x.slotNames[name]
+	if len(list) == 0 {
+		return nil, false
+	}
+
+	slot := x.slots[list[0]]
+	return &slot, true
+}
+
+func (x *index) tag(id string) (*Tag, bool) {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+
+	return x.tagByIDLocked(id)
+}
+
+func (x *index) tagBySlotName(slotID, name string) (*Tag, bool) {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+
+	return x.tagByIDLocked(x.slotTags[indexKey(slotID, name)])
+}
+
+func (x *index) tagByAddress(slotID, address string) (*Tag, bool) {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+
+	return x.tagByIDLocked(x.addresses[indexKey(slotID, address)])
+}
+
+// 调用时需持有锁
+func (x *index) tagByIDLocked(id string) (*Tag, bool) {
+	tag, ok := x.tags[id]
+	if !ok {
+		return nil, false
+	}
+
+	return &tag, true
+}
+
+func (x *index) tagByName(name string) (*Tag, bool) {
+	x.lock.RLock()
+	defer x.lock.RUnlock()
+
+	list := x.tagNames[name]
+	if len(list) == 0 {
+		return nil, false
+	}
+
+	tag := x.tags[list[0]]
+	return &tag, true
+}
+
+// 从数据库重新加载 slot 到索引，不存在时从索引删除。
+// 不使用 xorm 的缓存，缓存的对象在并发查询时会被同时读写
+func (s *Service) refreshSlot(id string) {
+	var slot Slot
+	has, err := s.NoCache().Where("id = ?", id).Get(&slot)
+	if err != nil {
+		log.Suger.Errorf("slot: %v refresh index: %v", id, err)
+		return
+	}
+
+	if !has {
+		s.index.removeSlot(id)
+		return
+	}
+
+	s.index.putSlot(slot)
+}
+
+// 从数据库重新加载标签到索引，不存在时从索引删除
+func (s *Service) refreshTag(id string) {
+	var tag Tag
+	has, err := s.NoCache().Where("id = ?", id).Get(&tag)
+	if err != nil {
+		log.Suger.Errorf("tag: %v refresh index: %v", id, err)
+		return
+	}
+
+	if !has {
+		s.index.removeTag(id)
+		return
+	}
+
+	s.index.putTag(tag)
+}
+
+// 从数据库重新加载索引
+func (s *Service) ReloadIndex() error {
+	return s.index.load(s)
+}
+
+// 以下函数从索引查询，返回副本，不存在时返回 false
+
+func (s *Service) LookupSlot(id string) (*Slot, bool) {
+	return s.index.slot(id)
+}
+
+// 同名时返回最早加载或创建的 slot
+func (s *Service) LookupSlotByName(name string) (*Slot, bool) {
+	return s.index.slotByName(name)
+}
+
+func (s *Service) LookupTag(id string) (*Tag, bool) {
+	return s.index.tag(id)
+}
+
+// 所有 slot 中名称为 name 的标签，同名时返回最早加载或创建的标签
+func (s *Service) LookupTagByName(name string) (*Tag, bool) {
+	return s.index.tagByName(name)
+}
+
+func (s *Service) LookupTagBySlotIDAndName(slotID, name string) (*Tag, bool) {
+	return s.index.tagBySlotName(slotID, name)
+}
+
+func (s *Service) LookupTagBySlotIDAndAddress(slotID, address string) (*Tag, bool) {
+	return s.index.tagByAddress(slotID, address)
+}
+
+// DeleteForce 删除的 slot 或标签
+func (s *Service) forgetDeleted(id interface{}, res interface{}) {
+	switch res.(type) {
+	case *Slot:
+		s.index.removeSlot(fmt.Sprint(id))
+	case *Tag:
+		s.index.removeTag(fmt.Sprint(id))
+	}
+}
@@ -0,0 +1,101 @@
+package device
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/danclive/july/log"
+	"github.com/danclive/july/sqlite"
+	"github.com/danclive/march/consts"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndex(t *testing.T) {
+	log.Init(false)
+
+	sqlite.Connect(filepath.Join(t.TempDir(), "july.db"), false)
+	defer sqlite.Close()
+
+	InitService(sqlite.GetEngine())
+	s := GetService()
+
+	slot := &Slot{Name: "plc"}
+	_, err := s.CreateSlot(slot)
+	assert.Nil(t, err)
+
+	a := &Tag{SlotID: slot.ID, Name: "a", Address: "HR0"}
+	_, err = s.CreateTag(a)
+	assert.Nil(t, err)
+
+	b := &Tag{SlotID: "other", Name: "a"}
+	_, err = s.CreateTag(b)
+	assert.Nil(t, err)
+
+	found, ok := s.LookupSlotByName("plc")
+	assert.True(t, ok)
+	assert.Exactly(t, slot.ID, found.ID)
+
+	tag, ok := s.LookupTagBySlotIDAndName(slot.ID, "a")
+	assert.True(t, ok)
+	assert.Exactly(t, a.ID, tag.ID)
+
+	tag, ok = s.LookupTagBySlotIDAndAddress(slot.ID, "HR0")
+	assert.True(t, ok)
+	assert.Exactly(t, a.ID, tag.ID)
+
+	// 同名时返回最早创建的标签
+	tag, ok = s.LookupTagByName("a")
+	assert.True(t, ok)
+	assert.Exactly(t, a.ID, tag.ID)
+
+	// 返回副本
+	tag.Name = "x"
+	tag, _ = s.LookupTag(a.ID)
+	assert.Exactly(t, "a", tag.Name)
+
+	// 更新名称和地址
+	tag.Name = "c"
+	tag.Address = "HR1"
+	_, err = s.UpdateTag(tag)
+	assert.Nil(t, err)
+
+	_, ok = s.LookupTagBySlotIDAndName(slot.ID, "a")
+	assert.False(t, ok)
+	_, ok = s.LookupTagBySlotIDAndAddress(slot.ID, "HR0")
+	assert.False(t, ok)
+	tag, ok = s.LookupTagBySlotIDAndAddress(slot.ID, "HR1")
+	assert.True(t, ok)
+	assert.Exactly(t, "c", tag.Name)
+	tag, _ = s.LookupTagByName("a")
+	assert.Exactly(t, b.ID, tag.ID)
+
+	// 状态变化同步到索引，版本与数据库一致
+	assert.Nil(t, s.SlotOnline(slot.ID))
+	found, _ = s.LookupSlot(slot.ID)
+	assert.Exactly(t, int32(consts.ON), found.LinkStatus)
+
+	found.Name = "plc2"
+	_, err = s.UpdateSlot(found)
+	assert.Nil(t, err)
+	_, ok = s.LookupSlotByName("plc")
+	assert.False(t, ok)
+	_, ok = s.LookupSlotByName("plc2")
+	assert.True(t, ok)
+
+	// 重新加载与同步更新的结果一致
+	assert.Nil(t, s.ReloadIndex())
+	tag, ok = s.LookupTagBySlotIDAndName(slot.ID, "c")
+	assert.True(t, ok)
+
+	assert.Nil(t, s.DeleteForce(b.ID, &Tag{}))
+	_, ok = s.LookupTag(b.ID)
+	assert.False(t, ok)
+
+	assert.Nil(t, s.DeleteSlot(found))
+	_, ok = s.LookupSlot(slot.ID)
+	assert.False(t, ok)
+	_, ok = s.LookupTag(a.ID)
+	assert.False(t, ok)
+	_, ok = s.LookupTagByName("c")
+	assert.False(t, ok)
+}
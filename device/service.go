@@ -13,12 +13,16 @@ import (
 var _service *Service
 
 func InitService(engine *xorm.Engine) {
-	s := &Service{Engine: engine}
+	s := &Service{Engine: engine, index: newIndex()}
 
 	if err := s.Sync(true); err != nil {
 		log.Suger.Fatal(err)
 	}
 
+	if err := s.ReloadIndex(); err != nil {
+		log.Suger.Fatal(err)
+	}
+
 	_service = s
 }
 
@@ -29,10 +33,14 @@ func GetService() *Service {
 type Service struct {
 	*xorm.Engine
 	collect Collect
+	index   *index
 }
 
 type Collect interface {
+	// slot 的驱动、参数或配置变化，重新连接
 	Reset(slotID string)
+	// 只有标签变化，重新加载标签
+	Reload(slotID string)
 }
 
 func (s *Service) Sync(force bool) error {
@@ -63,6 +71,18 @@ func (s *Service) Sync(force bool) error {
 		}
 	}
 
+	has, err = s.IsTableExist(SlotFault{})
+	if err != nil {
+		return err
+	}
+
+	if !has || force {
+		err = s.Sync2(SlotFault{})
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -96,18 +116,41 @@ func (s *Service) CreateSlot(params *Slot) (bool, error) {
 	}
 
 	_, err := s.InsertOne(params)
+	if err != nil {
+		return true, err
+	}
+
+	s.refreshSlot(params.ID)
 
-	return true, err
+	return true, nil
 }
 
 func (s *Service) UpdateSlot(params *Slot) (bool, error) {
-	_, err := s.ID(params.ID).Update(params)
+	old, err := s.GetSlot(params.ID)
+	if err != nil {
+		return false, err
+	}
 
-	if s.collect != nil {
-		s.collect.Reset(params.ID)
+	_, err = s.ID(params.ID).Update(params)
+	if err != nil {
+		return true, err
 	}
 
-	return true, err
+	s.refreshSlot(params.ID)
+	slot, ok := s.LookupSlot(params.ID)
+
+	// 只有影响连接的字段变化时才重新连接
+	if old != nil && ok &&
+		old.Driver == slot.Driver &&
+		old.Params == slot.Params &&
+		old.Config == slot.Config &&
+		old.Status == slot.Status {
+		return true, nil
+	}
+
+	s.slotChanged(params.ID, true)
+
+	return true, nil
 }
 
 func (s *Service) DeleteSlot(params *Slot) error {
@@ -128,7 +171,12 @@ func (s *Service) DeleteSlot(params *Slot) error {
 		return err
 	}
 
+	// 保留故障记录，slot 只是软删除
 	err = session.Commit()
+	if err == nil {
+		s.index.removeSlot(params.ID)
+		s.index.removeSlotTags(params.ID)
+	}
 
 	if s.collect != nil {
 		s.collect.Reset(params.ID)
@@ -137,11 +185,33 @@ func (s *Service) DeleteSlot(params *Slot) error {
 	return err
 }
 
+// slot 或标签变化后，标记为未更新，并通知采集服务。
+// reconnect 为 false 时只重新加载标签
+func (s *Service) slotChanged(slotID string, reconnect bool) {
+	if err := s.SlotUpdated(slotID, false); err != nil {
+		log.Suger.Error(err)
+	}
+
+	if s.collect == nil {
+		return
+	}
+
+	if reconnect {
+		s.collect.Reset(slotID)
+	} else {
+		s.collect.Reload(slotID)
+	}
+}
+
 func (s *Service) DestorySlots() error {
 	item := Slot{}
 	_, err := s.Engine.Exec(fmt.Sprintf("DELETE FROM %v", item.TableName()))
 	s.Engine.ClearCache(&item)
-	return err
+	if err != nil {
+		return err
+	}
+
+	return s.ReloadIndex()
 }
 
 func (s *Service) CreateTag(params *Tag) (bool, error) {
@@ -181,37 +251,64 @@ func (s *Service) CreateTag(params *Tag) (bool, error) {
 		params.Save = consts.OFF
 	}
 
+	if params.Retain == 0 {
+		params.Retain = consts.OFF
+	}
+
 	if params.Visible == 0 {
 		params.Visible = consts.OFF
 	}
 
 	_, err := s.InsertOne(params)
-
-	if s.collect != nil {
-		s.collect.Reset(params.SlotID)
+	if err != nil {
+		return true, err
 	}
 
-	return true, err
+	s.refreshTag(params.ID)
+	s.slotChanged(params.SlotID, false)
+
+	return true, nil
 }
 
 func (s *Service) UpdateTag(params *Tag) (bool, error) {
-	_, err := s.ID(params.ID).Update(params)
+	old, err := s.GetTag(params.ID)
+	if err != nil {
+		return false, err
+	}
 
-	if s.collect != nil {
-		s.collect.Reset(params.SlotID)
+	_, err = s.ID(params.ID).Update(params)
+	if err != nil {
+		return true, err
 	}
 
-	return true, err
+	s.refreshTag(params.ID)
+
+	slotID := params.SlotID
+	if old != nil {
+		if slotID == "" {
+			slotID = old.SlotID
+		} else if old.SlotID != slotID {
+			// 标签移动到其他 slot
+			s.slotChanged(old.SlotID, false)
+		}
+	}
+
+	s.slotChanged(slotID, false)
+
+	return true, nil
 }
 
 func (s *Service) DeleteTag(params *Tag) error {
 	_, err := s.ID(params.ID).Delete(&Tag{})
-
-	if s.collect != nil {
-		s.collect.Reset(params.SlotID)
+	if err != nil {
+		return err
 	}
 
-	return err
+	s.index.removeTag(params.ID)
+
+	s.slotChanged(params.SlotID, false)
+
+	return nil
 }
 
 func (s *Service) DestoryTags(slotID string) error {
@@ -224,7 +321,11 @@ func (s *Service) DestoryTags(slotID string) error {
 	}
 
 	s.Engine.ClearCache(&item)
-	return err
+	if err != nil {
+		return err
+	}
+
+	return s.ReloadIndex()
 }
 
 // list
@@ -307,6 +408,18 @@ func (s *Service) ListTagAndSave() ([]Tag, error) {
 	return items, nil
 }
 
+// 启用保持的 MEM 标签，包括未启用的标签
+func (s *Service) ListTagRetain() ([]Tag, error) {
+	items := make([]Tag, 0)
+
+	err := s.Where("type = ?", TypeMEM).And("retain = ?", consts.ON).Find(&items)
+	if err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
 func (s *Service) ListTagAndUploadBySlot(slotID string) ([]Tag, error) {
 	items := make([]Tag, 0)
 
@@ -486,8 +599,13 @@ func (s *Service) SlotOnline(id string) error {
 	slot.LinkStatus = consts.ON
 
 	_, err = s.ID(slot.ID).Update(slot)
+	if err != nil {
+		return err
+	}
 
-	return err
+	s.refreshSlot(slot.ID)
+
+	return nil
 }
 
 func (s *Service) SlotOffline(id string) error {
@@ -503,8 +621,97 @@ func (s *Service) SlotOffline(id string) error {
 	slot.LinkStatus = consts.OFF
 
 	_, err = s.ID(slot.ID).Update(slot)
+	if err != nil {
+		return err
+	}
 
-	return err
+	s.refreshSlot(slot.ID)
+
+	return nil
+}
+
+// 设置 slot 的故障状态，并记录故障的变化，状态没有变化时不记录
+func (s *Service) SlotFault(id string, fault bool, reason string) error {
+	slot, err := s.GetSlot(id)
+	if err != nil {
+		return err
+	}
+
+	if slot == nil {
+		return errors.New("插槽不存在")
+	}
+
+	value := int32(consts.OFF)
+	if fault {
+		value = consts.ON
+	}
+
+	if slot.Fault == value {
+		return nil
+	}
+
+	session := s.NewSession()
+	defer session.Close()
+
+	if err = session.Begin(); err != nil {
+		return err
+	}
+
+	// 使用 map 更新，不检查版本
+	_, err = session.Table(&Slot{}).ID(slot.ID).Update(map[string]interface{}{"fault": value})
+	if err != nil {
+		session.Rollback()
+		return err
+	}
+
+	_, err = session.InsertOne(&SlotFault{SlotID: slot.ID, Fault: value, Reason: reason})
+	if err != nil {
+		session.Rollback()
+		return err
+	}
+
+	if err = session.Commit(); err != nil {
+		return err
+	}
+
+	s.refreshSlot(slot.ID)
+
+	return nil
+}
+
+// slot 最近的故障记录，按时间倒序，slotID 为空时返回所有 slot 的记录
+func (s *Service) ListSlotFaults(slotID string, limit int) ([]SlotFault, error) {
+	items := make([]SlotFault, 0)
+
+	session := s.Desc("id")
+	if slotID != "" {
+		session = session.Where("slot_id = ?", slotID)
+	}
+
+	if limit > 0 {
+		session = session.Limit(limit)
+	}
+
+	err := session.Find(&items)
+
+	return items, err
+}
+
+// 设置 slot 的更新状态，applied 为 true 时表示最新的配置已经被采集服务应用
+func (s *Service) SlotUpdated(id string, applied bool) error {
+	value := int32(consts.OFF)
+	if applied {
+		value = consts.ON
+	}
+
+	_, err := s.Table(&Slot{}).ID(id).Update(map[string]interface{}{"update": value})
+	if err != nil {
+		return err
+	}
+
+	s.refreshSlot(id)
+
+	return nil
 }
 
 func (s *Service) SlotReset(driver string) error {
@@ -528,6 +735,8 @@ func (s *Service) SlotReset(driver string) error {
 		if err != nil {
 			return err
 		}
+
+		s.refreshSlot(item.ID)
 	}
 
 	return nil
@@ -592,5 +801,8 @@ func (s *Service) GetByName(name string, res interface{}) (has bool, err error)
 
 func (s *Service) DeleteForce(id interface{}, res interface{}) (err error) {
 	_, err = s.ID(id).Unscoped().Delete(res)
+	if err == nil {
+		s.forgetDeleted(id, res)
+	}
 	return
 }
@@ -0,0 +1,120 @@
+package device
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/danclive/july/log"
+	"github.com/danclive/july/sqlite"
+	"github.com/danclive/march/consts"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestService(t *testing.T) *Service {
+	log.Init(false)
+
+	sqlite.Connect(filepath.Join(t.TempDir(), "july.db"), false)
+	t.Cleanup(sqlite.Close)
+
+	InitService(sqlite.GetEngine())
+	return GetService()
+}
+
+func TestSlotUpdated(t *testing.T) {
+	s := newTestService(t)
+
+	slot := &Slot{Name: "plc"}
+	_, err := s.CreateSlot(slot)
+	assert.Nil(t, err)
+
+	assert.Nil(t, s.SlotUpdated(slot.ID, true))
+
+	// 不使用缓存，从数据库重新读取
+	var found Slot
+	has, err := s.NoCache().Where("id = ?", slot.ID).Get(&found)
+	assert.Nil(t, err)
+	assert.True(t, has)
+	assert.Exactly(t, int32(consts.ON), found.Update)
+
+	assert.Nil(t, s.SlotUpdated(slot.ID, false))
+
+	found = Slot{}
+	_, err = s.NoCache().Where("id = ?", slot.ID).Get(&found)
+	assert.Nil(t, err)
+	assert.Exactly(t, int32(consts.OFF), found.Update)
+}
+
+func TestSlotFault(t *testing.T) {
+	s := newTestService(t)
+
+	slot := &Slot{Name: "plc"}
+	_, err := s.CreateSlot(slot)
+	assert.Nil(t, err)
+
+	assert.Nil(t, s.SlotFault(slot.ID, true, "timeout"))
+	// 状态没有变化时不记录
+	assert.Nil(t, s.SlotFault(slot.ID, true, "timeout"))
+
+	var found Slot
+	has, err := s.NoCache().Where("id = ?", slot.ID).Get(&found)
+	assert.Nil(t, err)
+	assert.True(t, has)
+	assert.Exactly(t, int32(consts.ON), found.Fault)
+
+	cached, _ := s.LookupSlot(slot.ID)
+	assert.Exactly(t, int32(consts.ON), cached.Fault)
+
+	assert.Nil(t, s.SlotFault(slot.ID, false, ""))
+
+	found = Slot{}
+	_, err = s.NoCache().Where("id = ?", slot.ID).Get(&found)
+	assert.Nil(t, err)
+	assert.Exactly(t, int32(consts.OFF), found.Fault)
+
+	faults, err := s.ListSlotFaults(slot.ID, 0)
+	assert.Nil(t, err)
+	assert.Exactly(t, 2, len(faults))
+	assert.Exactly(t, int32(consts.OFF), faults[0].Fault)
+	assert.Exactly(t, int32(consts.ON), faults[1].Fault)
+	assert.Exactly(t, "timeout", faults[1].Reason)
+}
+
+func TestDeleteSlotKeepsFaults(t *testing.T) {
+	s := newTestService(t)
+
+	slot := &Slot{Name: "plc"}
+	_, err := s.CreateSlot(slot)
+	assert.Nil(t, err)
+
+	assert.Nil(t, s.SlotFault(slot.ID, true, "timeout"))
+	assert.Nil(t, s.DeleteSlot(slot))
+
+	faults, err := s.ListSlotFaults(slot.ID, 0)
+	assert.Nil(t, err)
+	assert.Exactly(t, 1, len(faults))
+}
+
+func TestUpdateSlotIndex(t *testing.T) {
+	s := newTestService(t)
+
+	slot := &Slot{Name: "plc", Config: "scan=1s", Status: consts.ON}
+	_, err := s.CreateSlot(slot)
+	assert.Nil(t, err)
+
+	// 只修改名称，不需要重新连接，索引仍与数据库一致
+	found, ok := s.LookupSlot(slot.ID)
+	assert.True(t, ok)
+
+	found.Name = "plc2"
+	_, err = s.UpdateSlot(found)
+	assert.Nil(t, err)
+
+	var row Slot
+	_, err = s.NoCache().Where("id = ?", slot.ID).Get(&row)
+	assert.Nil(t, err)
+
+	found, ok = s.LookupSlot(slot.ID)
+	assert.True(t, ok)
+	assert.Exactly(t, row, *found)
+	assert.Exactly(t, "plc2", found.Name)
+}
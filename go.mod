@@ -8,8 +8,12 @@ require (
 	github.com/danclive/nson-go v0.5.0
 	github.com/danclive/queen-go v0.10.1
 	github.com/eclipse/paho.mqtt.golang v1.3.3
+	github.com/goburrow/modbus v0.1.0
+	github.com/goburrow/serial v0.1.0 // indirect
+	github.com/gopcua/opcua v0.3.1
 	github.com/mattn/go-sqlite3 v1.14.7
 	github.com/stretchr/testify v1.7.0
+	github.com/tbrandon/mbserver v0.0.0-20170611213546-993e1772cc62
 	go.etcd.io/bbolt v1.3.5
 	go.uber.org/zap v1.16.0
 	golang.org/x/crypto v0.0.0-20210415154028-4f45737414dc
@@ -3,7 +3,9 @@ package mqtt
 import (
 	"net/url"
 
+	"github.com/danclive/july/collect"
 	"github.com/danclive/july/device"
+	"github.com/danclive/july/log"
 	"github.com/danclive/july/util"
 	"github.com/danclive/march/consts"
 	"github.com/danclive/mqtt"
@@ -63,6 +65,17 @@ func hook() mqtt.Hooks {
 		clientId := client.OptionsReader().ClientID()
 
 		device.GetService().SlotOffline(clientId)
+
+		// 设备断开后，标签的质量为通信中断
+		tags, err := device.GetService().ListTagStatusOnAndTypeIO(clientId)
+		if err != nil {
+			log.Suger.Error(err)
+			return
+		}
+
+		for i := 0; i < len(tags); i++ {
+			collect.CacheSetTagQuality(&tags[i], collect.QualityBadCommFailure)
+		}
 	}
 
 	onStop := func() {
@@ -71,13 +71,8 @@ func (m *MqttRecv) msgArrived(client mqtt.Client, msg packets.Message) (valid bo
 				if dataMessage, ok := data.(map[string]interface{}); ok {
 
 					// 查询设备
-					s, err := device.GetService().GetSlot(clientId)
-					if err != nil {
-						log.Suger.Errorf("GetSlot(clientId): %s", err)
-						return
-					}
-
-					if s == nil {
+					s, ok := device.GetService().LookupSlot(clientId)
+					if !ok {
 						return
 					}
 
@@ -86,13 +81,8 @@ func (m *MqttRecv) msgArrived(client mqtt.Client, msg packets.Message) (valid bo
 					}
 
 					for k, v := range dataMessage {
-						tag, err := device.GetService().GetTagBySlotIDAndAddress(clientId, k)
-						if err != nil {
-							log.Suger.Errorf("GetTagByName(k): %s", err)
-							return
-						}
-
-						if tag == nil {
+						tag, ok := device.GetService().LookupTagBySlotIDAndAddress(clientId, k)
+						if !ok {
 							continue
 						}
 
@@ -141,7 +131,7 @@ func (m *MqttRecv) msgArrived(client mqtt.Client, msg packets.Message) (valid bo
 
 						if value2 != nil {
 							// 缓存
-							collect.CacheSet(tag.ID, value2)
+							collect.CacheReport(tag, collect.Record{Value: value2}, collect.TagDeadband(tag))
 						}
 					}
 
@@ -167,13 +157,8 @@ func (m *MqttRecv) msgArrived(client mqtt.Client, msg packets.Message) (valid bo
 				return
 			}
 
-			s, err := device.GetService().GetSlot(clientId)
-			if err != nil {
-				log.Suger.Errorf("SlotService{}.GetSlot(clientId): %s", err)
-				return
-			}
-
-			if s == nil {
+			s, ok := device.GetService().LookupSlot(clientId)
+			if !ok {
 				return
 			}
 
@@ -185,15 +170,8 @@ func (m *MqttRecv) msgArrived(client mqtt.Client, msg packets.Message) (valid bo
 			// fmt.Println(clientId)
 
 			for k, v := range data {
-				tag, err := device.GetService().GetTagBySlotIDAndAddress(clientId, k)
-				if err != nil {
-					log.Suger.Errorf("SlotService{}.GetTagByName(k): %s", err)
-					return
-				}
-
-				// fmt.Println(tag)
-
-				if tag == nil {
+				tag, ok := device.GetService().LookupTagBySlotIDAndAddress(clientId, k)
+				if !ok {
 					continue
 				}
 
@@ -239,7 +217,7 @@ func (m *MqttRecv) msgArrived(client mqtt.Client, msg packets.Message) (valid bo
 				}
 
 				// 缓存
-				collect.CacheSet(tag.ID, v)
+				collect.CacheReport(tag, collect.Record{Value: v}, collect.TagDeadband(tag))
 			}
 		}
 
@@ -458,6 +458,7 @@ func pushTags(params, recv nson.Message) nson.Message {
 			tag.Access = tags[i].Access
 			tag.Upload = tags[i].Upload
 			tag.Save = tags[i].Save
+			tag.Retain = tags[i].Retain
 			tag.Visible = tags[i].Visible
 			tag.Status = tags[i].Status
 			tag.Order = tags[i].Order
@@ -488,6 +489,7 @@ func pushTags(params, recv nson.Message) nson.Message {
 			Access:   tags[i].Access,
 			Upload:   tags[i].Upload,
 			Save:     tags[i].Save,
+			Retain:   tags[i].Retain,
 			Visible:  tags[i].Visible,
 			Status:   tags[i].Status,
 			Order:    tags[i].Order,
@@ -557,6 +559,7 @@ func pushTag(params, recv nson.Message) nson.Message {
 		tag2.Access = tag.Access
 		tag2.Upload = tag.Upload
 		tag2.Save = tag.Save
+		tag2.Retain = tag.Retain
 		tag2.Visible = tag.Visible
 		tag2.Status = tag.Status
 		tag2.Order = tag.Order
@@ -585,6 +588,7 @@ func pushTag(params, recv nson.Message) nson.Message {
 			Access:   tag.Access,
 			Upload:   tag.Upload,
 			Save:     tag.Save,
+			Retain:   tag.Retain,
 			Visible:  tag.Visible,
 			Status:   tag.Status,
 			Order:    tag.Order,